@@ -0,0 +1,42 @@
+package grpcprom
+
+import "context"
+
+// An AccessLogger logs a message with alternating keys and values at the info
+// or warn level. It's implemented by *slog.Logger, but doesn't require it,
+// so that access logs don't require Go 1.21.
+type AccessLogger interface {
+	InfoContext(ctx context.Context, msg string, args ...any)
+	WarnContext(ctx context.Context, msg string, args ...any)
+}
+
+// AccessLog returns an Option that logs a record of each completed RPC to logger,
+// from the same event that records the metrics, so that they can't disagree.
+// RPCs are logged at the info level if they succeed or else the warn level.
+func AccessLog(logger AccessLogger) Option {
+	return optionFunc(func(o *options) {
+		o.accessLog = func(ctx context.Context, r accessRecord) {
+			msg := "gRPC server request"
+			if r.client {
+				msg = "gRPC client request"
+			}
+			args := []any{
+				"grpc.type", r.typ,
+				"grpc.service", r.Service,
+				"grpc.method", r.Method,
+				"grpc.code", r.Code.String(),
+				"grpc.duration", r.Latency,
+				"grpc.sent_bytes", r.sent,
+				"grpc.recv_bytes", r.recv,
+			}
+			if r.Err != nil {
+				args = append(args, "grpc.error", r.Err.Error())
+			}
+			if r.Code != 0 {
+				logger.WarnContext(ctx, msg, args...)
+			} else {
+				logger.InfoContext(ctx, msg, args...)
+			}
+		}
+	})
+}
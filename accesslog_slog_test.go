@@ -0,0 +1,50 @@
+//go:build go1.21
+
+package grpcprom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+var _ AccessLogger = (*slog.Logger)(nil)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewServerMetrics(AccessLog(slog.New(slog.NewJSONHandler(&buf, nil))))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{WireLength: 128, RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{WireLength: 256, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(codes.NotFound, "missing")})
+
+	var rec map[string]interface{}
+	check(t, json.Unmarshal(buf.Bytes(), &rec))
+	for key, want := range map[string]interface{}{
+		"level":           "WARN",
+		"msg":             "gRPC server request",
+		"grpc.type":       "Unary",
+		"grpc.service":    "pkg.Service",
+		"grpc.method":     "Method",
+		"grpc.code":       "NotFound",
+		"grpc.sent_bytes": float64(256),
+		"grpc.recv_bytes": float64(128),
+		"grpc.error":      "rpc error: code = NotFound desc = missing",
+	} {
+		if got := rec[key]; got != want {
+			t.Errorf("%s = %v; want %v", key, got, want)
+		}
+	}
+	if _, ok := rec["grpc.duration"]; !ok {
+		t.Error("grpc.duration missing")
+	}
+}
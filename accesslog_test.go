@@ -0,0 +1,58 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+type testAccessLogger struct {
+	level string
+	msg   string
+	args  map[string]any
+}
+
+func (l *testAccessLogger) InfoContext(ctx context.Context, msg string, args ...any) {
+	l.log("INFO", msg, args)
+}
+
+func (l *testAccessLogger) WarnContext(ctx context.Context, msg string, args ...any) {
+	l.log("WARN", msg, args)
+}
+
+func (l *testAccessLogger) log(level, msg string, args []any) {
+	l.level, l.msg, l.args = level, msg, make(map[string]any)
+	for i := 0; i+1 < len(args); i += 2 {
+		l.args[fmt.Sprint(args[i])] = args[i+1]
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	var log testAccessLogger
+	m := NewClientMetrics(AccessLog(&log))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now(), Error: status.Error(codes.OK, "")})
+
+	if log.level != "INFO" || log.msg != "gRPC client request" {
+		t.Errorf("unexpected log: got %s %q; want INFO %q", log.level, log.msg, "gRPC client request")
+	}
+	for key, want := range map[string]any{
+		"grpc.service": "pkg.Service",
+		"grpc.method":  "Method",
+		"grpc.code":    "OK",
+	} {
+		if got := log.args[key]; got != want {
+			t.Errorf("%s = %v; want %v", key, got, want)
+		}
+	}
+	if _, ok := log.args["grpc.error"]; ok {
+		t.Error("unexpected grpc.error")
+	}
+}
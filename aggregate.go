@@ -0,0 +1,262 @@
+package grpcprom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// An Aggregator is a collection of metrics collectors, such as multiple
+// ClientMetrics for different targets, which are collected together as one.
+// Series with identical names and label values are combined: counters and
+// most gauges are summed, gauges of maximums and timestamps (e.g.
+// latency_max_seconds or last_error_timestamp_seconds) take the maximum,
+// and histograms are merged bucket by bucket, so the aggregated collectors
+// should be created with the same options. The way series are combined is
+// recorded by ClientMetrics and ServerMetrics when their metrics are created;
+// series of other collectors are combined by their type and name.
+//
+// Gauges of states (e.g. circuit_breaker_state or health_status) and
+// summaries can't be combined, so they're only collected from a single
+// collector. If multiple collectors report the same series, it's collected
+// as an invalid metric, which fails the gather with an error.
+type Aggregator struct {
+	mu        sync.Mutex
+	gatherers []prometheus.Gatherer
+	modes     map[string]aggMode // family name => mode, if recorded
+}
+
+// An aggModer is a collector that records the way its series are combined.
+type aggModer interface {
+	aggModes() map[string]aggMode
+}
+
+// NewAggregator returns a new Aggregator of the given collectors.
+func NewAggregator(collectors ...prometheus.Collector) *Aggregator {
+	a := &Aggregator{}
+	for _, c := range collectors {
+		a.Add(c)
+	}
+	return a
+}
+
+// Add adds the collector to the aggregation.
+// It panics if the collector is invalid.
+func (a *Aggregator) Add(c prometheus.Collector) {
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+	a.mu.Lock()
+	a.gatherers = append(a.gatherers, r)
+	if m, ok := c.(aggModer); ok {
+		if a.modes == nil {
+			a.modes = make(map[string]aggMode)
+		}
+		for name, mode := range m.aggModes() {
+			a.modes[name] = mode
+		}
+	}
+	a.mu.Unlock()
+}
+
+// Describe implements the prometheus.Collector interface.
+// It sends no descriptors, because the aggregated metrics are not
+// known in advance, which makes the Aggregator an unchecked collector.
+func (a *Aggregator) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface.
+func (a *Aggregator) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	gatherers := append([]prometheus.Gatherer(nil), a.gatherers...)
+	modes := a.modes
+	a.mu.Unlock()
+
+	var names []string
+	families := make(map[string]*aggFamily)
+	for _, g := range gatherers {
+		mfs, err := g.Gather()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+			continue
+		}
+		for _, mf := range mfs {
+			fam, ok := families[mf.GetName()]
+			if !ok {
+				mode, ok := modes[mf.GetName()]
+				if !ok {
+					mode = aggModeOf(mf.GetName(), mf.GetType())
+				}
+				fam = &aggFamily{
+					name:   mf.GetName(),
+					help:   mf.GetHelp(),
+					typ:    mf.GetType(),
+					mode:   mode,
+					series: make(map[string]*aggSeries),
+				}
+				families[fam.name] = fam
+				names = append(names, fam.name)
+			}
+			for _, m := range mf.Metric {
+				fam.add(m)
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		families[name].collect(ch)
+	}
+}
+
+// An aggMode is the way series of a family are combined.
+type aggMode int
+
+const (
+	aggSum    aggMode = iota
+	aggMax            // maximums and timestamps
+	aggSingle         // states and summaries, which can't be combined
+)
+
+// aggModeOfType returns the way series of a family are combined by default.
+func aggModeOfType(typ dto.MetricType) aggMode {
+	if typ == dto.MetricType_SUMMARY {
+		return aggSingle
+	}
+	return aggSum
+}
+
+// aggModeOf returns the way series of the named family are combined,
+// if it wasn't recorded when the family was created.
+func aggModeOf(name string, typ dto.MetricType) aggMode {
+	switch {
+	case typ != dto.MetricType_GAUGE:
+		return aggModeOfType(typ)
+	case strings.HasSuffix(name, "_state") || strings.HasSuffix(name, "_status"):
+		return aggSingle
+	case strings.HasSuffix(name, "_max") || strings.HasSuffix(name, "_max_seconds") ||
+		strings.HasSuffix(name, "_timestamp_seconds") || strings.HasSuffix(name, "_rtt_seconds") ||
+		strings.HasSuffix(name, "_age_seconds") || strings.HasSuffix(name, "_ewma_seconds"):
+		return aggMax
+	}
+	return aggSum
+}
+
+type aggFamily struct {
+	name   string
+	help   string
+	typ    dto.MetricType
+	mode   aggMode
+	keys   []string
+	series map[string]*aggSeries
+	descs  map[string]*prometheus.Desc // label names => desc
+}
+
+type aggSeries struct {
+	names   []string
+	values  []string
+	n       int // number of series combined
+	value   float64
+	count   uint64
+	buckets map[float64]uint64
+	summary *dto.Summary // only if not combined
+}
+
+func (f *aggFamily) add(m *dto.Metric) {
+	var key strings.Builder
+	names := make([]string, 0, len(m.Label))
+	values := make([]string, 0, len(m.Label))
+	for _, lp := range m.Label {
+		names = append(names, lp.GetName())
+		values = append(values, lp.GetValue())
+		key.WriteString(lp.GetName())
+		key.WriteByte(0)
+		key.WriteString(lp.GetValue())
+		key.WriteByte(0)
+	}
+	s, ok := f.series[key.String()]
+	if !ok {
+		s = &aggSeries{names: names, values: values}
+		f.series[key.String()] = s
+		f.keys = append(f.keys, key.String())
+	}
+	s.n++
+	switch f.typ {
+	case dto.MetricType_COUNTER:
+		s.value += m.GetCounter().GetValue()
+	case dto.MetricType_GAUGE:
+		v := m.GetGauge().GetValue()
+		switch {
+		case f.mode != aggMax:
+			s.value += v
+		case s.n == 1 || v > s.value:
+			s.value = v
+		}
+	case dto.MetricType_UNTYPED:
+		s.value += m.GetUntyped().GetValue()
+	case dto.MetricType_SUMMARY:
+		s.summary = m.GetSummary()
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		s.value += h.GetSampleSum()
+		s.count += h.GetSampleCount()
+		if s.buckets == nil {
+			s.buckets = make(map[float64]uint64, len(h.Bucket))
+		}
+		for _, b := range h.Bucket {
+			s.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+		}
+	}
+}
+
+func (f *aggFamily) desc(names []string) *prometheus.Desc {
+	key := strings.Join(names, "\x00")
+	if d, ok := f.descs[key]; ok {
+		return d
+	}
+	if f.descs == nil {
+		f.descs = make(map[string]*prometheus.Desc)
+	}
+	d := prometheus.NewDesc(f.name, f.help, names, nil)
+	f.descs[key] = d
+	return d
+}
+
+func (f *aggFamily) collect(ch chan<- prometheus.Metric) {
+	for _, key := range f.keys {
+		s := f.series[key]
+		desc := f.desc(s.names)
+		var (
+			m   prometheus.Metric
+			err error
+		)
+		if f.mode == aggSingle && s.n > 1 {
+			err := fmt.Errorf("grpcprom: %s series %v reported by %d aggregated collectors can't be combined", f.name, s.values, s.n)
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		switch f.typ {
+		case dto.MetricType_COUNTER:
+			m, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, s.value, s.values...)
+		case dto.MetricType_GAUGE:
+			m, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, s.value, s.values...)
+		case dto.MetricType_UNTYPED:
+			m, err = prometheus.NewConstMetric(desc, prometheus.UntypedValue, s.value, s.values...)
+		case dto.MetricType_SUMMARY:
+			quantiles := make(map[float64]float64, len(s.summary.Quantile))
+			for _, q := range s.summary.Quantile {
+				quantiles[q.GetQuantile()] = q.GetValue()
+			}
+			m, err = prometheus.NewConstSummary(desc, s.summary.GetSampleCount(), s.summary.GetSampleSum(), quantiles, s.values...)
+		case dto.MetricType_HISTOGRAM:
+			m, err = prometheus.NewConstHistogram(desc, s.count, s.value, s.buckets, s.values...)
+		default:
+			continue
+		}
+		if err != nil {
+			m = prometheus.NewInvalidMetric(desc, err)
+		}
+		ch <- m
+	}
+}
@@ -0,0 +1,157 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/stats"
+)
+
+func TestAggregator(t *testing.T) {
+	a, b := NewClientMetrics(), NewClientMetrics()
+	for _, m := range []*ClientMetrics{a, b} {
+		ctx := m.handler.TagConn(context.Background(), &stats.ConnTagInfo{})
+		m.handler.HandleConn(ctx, &stats.ConnBegin{Client: true})
+	}
+	want := `
+# HELP grpc_client_connections_total Total number of gRPC client connections opened.
+# TYPE grpc_client_connections_total counter
+grpc_client_connections_total 2
+`
+	if err := testutil.CollectAndCompare(NewAggregator(a, b), strings.NewReader(want), "grpc_client_connections_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregatorGauges(t *testing.T) {
+	gauge := func(name string, v float64) prometheus.Collector {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name})
+		g.Set(v)
+		return g
+	}
+	a := NewAggregator(
+		gauge("grpc_client_requests_pending", 1),
+		gauge("grpc_client_latency_max_seconds", 3),
+		gauge("grpc_client_last_error_timestamp_seconds", 100),
+	)
+	a.Add(gauge("grpc_client_requests_pending", 2))
+	a.Add(gauge("grpc_client_latency_max_seconds", 2))
+	a.Add(gauge("grpc_client_last_error_timestamp_seconds", 200))
+	want := `
+# HELP grpc_client_last_error_timestamp_seconds grpc_client_last_error_timestamp_seconds
+# TYPE grpc_client_last_error_timestamp_seconds gauge
+grpc_client_last_error_timestamp_seconds 200
+# HELP grpc_client_latency_max_seconds grpc_client_latency_max_seconds
+# TYPE grpc_client_latency_max_seconds gauge
+grpc_client_latency_max_seconds 3
+# HELP grpc_client_requests_pending grpc_client_requests_pending
+# TYPE grpc_client_requests_pending gauge
+grpc_client_requests_pending 3
+`
+	if err := testutil.CollectAndCompare(a, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewAggregator(gauge("grpc_client_circuit_breaker_state", 0))
+	want = `
+# HELP grpc_client_circuit_breaker_state grpc_client_circuit_breaker_state
+# TYPE grpc_client_circuit_breaker_state gauge
+grpc_client_circuit_breaker_state 0
+`
+	if err := testutil.CollectAndCompare(state, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	state.Add(gauge("grpc_client_circuit_breaker_state", 2))
+	if err := testutil.CollectAndCompare(state, strings.NewReader(want)); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAggregatorSummaries(t *testing.T) {
+	summary := func() prometheus.Summary {
+		s := prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "grpc_client_latency_seconds",
+			Help:       "Latency.",
+			Objectives: map[float64]float64{0.5: 0.05},
+		})
+		s.Observe(1)
+		return s
+	}
+	a := NewAggregator(summary())
+	want := `
+# HELP grpc_client_latency_seconds Latency.
+# TYPE grpc_client_latency_seconds summary
+grpc_client_latency_seconds{quantile="0.5"} 1
+grpc_client_latency_seconds_sum 1
+grpc_client_latency_seconds_count 1
+`
+	if err := testutil.CollectAndCompare(a, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	a.Add(summary())
+	if err := testutil.CollectAndCompare(a, strings.NewReader(want)); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAggregatorModes(t *testing.T) {
+	m := NewServerMetrics(
+		LatencySeconds(Summary(map[float64]float64{0.5: 0.05})),
+		LatencyEWMASeconds(Enable()),
+		LastMessageAgeSeconds(Methods("/svc/Watch")),
+		CircuitBreakerState(Enable()),
+		TCPInfo(Enable()),
+	)
+	modes := m.aggModes()
+	for name, want := range map[string]aggMode{
+		"grpc_server_requests_pending":         aggSum,
+		"grpc_server_latency_seconds":          aggSingle,
+		"grpc_server_latency_ewma_seconds":     aggMax,
+		"grpc_server_last_message_age_seconds": aggMax,
+		"grpc_server_circuit_breaker_state":    aggSingle,
+	} {
+		if got, ok := modes[name]; !ok || got != want {
+			t.Errorf("mode of %s: got %v, %v; want %v", name, got, ok, want)
+		}
+	}
+	if got, ok := modes["grpc_server_tcp_rtt_seconds"]; ok && got != aggMax {
+		t.Errorf("mode of grpc_server_tcp_rtt_seconds: got %v; want %v", got, aggMax)
+	}
+
+	// Modes recorded by the metrics apply to the families of other collectors.
+	gauge := func(name string, v float64) prometheus.Collector {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name})
+		g.Set(v)
+		return g
+	}
+	a := NewAggregator(m, gauge("grpc_server_latency_ewma_seconds", 2), gauge("grpc_server_latency_ewma_seconds", 1))
+	want := `
+# HELP grpc_server_latency_ewma_seconds grpc_server_latency_ewma_seconds
+# TYPE grpc_server_latency_ewma_seconds gauge
+grpc_server_latency_ewma_seconds 2
+`
+	if err := testutil.CollectAndCompare(a, strings.NewReader(want), "grpc_server_latency_ewma_seconds"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggModeOf(t *testing.T) {
+	for name, want := range map[string]aggMode{
+		"grpc_client_requests_pending":             aggSum,
+		"grpc_client_tcp_retransmits":              aggSum,
+		"grpc_client_tcp_rtt_seconds":              aggMax,
+		"grpc_client_last_message_age_seconds":     aggMax,
+		"grpc_client_latency_ewma_seconds":         aggMax,
+		"grpc_client_latency_max_seconds":          aggMax,
+		"grpc_client_last_error_timestamp_seconds": aggMax,
+		"grpc_client_health_status":                aggSingle,
+	} {
+		if got := aggModeOf(name, dto.MetricType_GAUGE); got != want {
+			t.Errorf("aggModeOf(%q): got %v; want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package grpcprom
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// An AnomalyRule selects the anomalous RPCs passed to an anomaly hook.
+// An RPC is anomalous if it matches any of the conditions.
+type AnomalyRule struct {
+	// MinLatency selects RPCs with at least this latency, if positive.
+	MinLatency time.Duration
+	// Codes selects RPCs completed with any of these codes.
+	Codes []codes.Code
+	// Oversized selects RPCs with messages larger than the maximum size
+	// of their method, as given to the OversizedMessagesTotal option.
+	Oversized bool
+
+	// Rate is the maximum average number of anomalies passed to the hook
+	// per second. If it's zero, it's one. Others are dropped.
+	Rate float64
+	// Burst is the maximum number of anomalies passed to the hook at once.
+	// If it's less than one, it's one.
+	Burst int
+}
+
+// An Anomaly is the outcome of an anomalous RPC.
+type Anomaly struct {
+	Outcome
+
+	// Slow reports whether the RPC's latency is at least the rule's MinLatency.
+	Slow bool
+	// Failed reports whether the RPC's code is one of the rule's Codes.
+	Failed bool
+	// Oversized reports whether the RPC had an oversized message.
+	Oversized bool
+
+	// SentBytes is the number of bytes sent on the wire.
+	SentBytes int
+	// RecvBytes is the number of bytes received on the wire.
+	RecvBytes int
+}
+
+// anomalyHook passes anomalous RPCs to a function, limited by a token bucket.
+// A nil anomalyHook does nothing.
+type anomalyHook struct {
+	rule  AnomalyRule
+	codes [codes.Unauthenticated + 1]bool
+	fn    func(Anomaly)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newAnomalyHook(rule AnomalyRule, fn func(Anomaly)) *anomalyHook {
+	if fn == nil {
+		return nil
+	}
+	if rule.Rate <= 0 {
+		rule.Rate = 1
+	}
+	if rule.Burst < 1 {
+		rule.Burst = 1
+	}
+	a := &anomalyHook{rule: rule, fn: fn, tokens: float64(rule.Burst)}
+	for _, c := range rule.Codes {
+		if int(c) < len(a.codes) {
+			a.codes[c] = true
+		}
+	}
+	return a
+}
+
+// check passes the RPC to the function if it's anomalous and allowed by the rate limit.
+func (a *anomalyHook) check(v *rpcInfo, o Outcome) {
+	if a == nil {
+		return
+	}
+	x := Anomaly{
+		Outcome:   o,
+		Slow:      a.rule.MinLatency > 0 && o.Latency >= a.rule.MinLatency,
+		Failed:    int(o.Code) < len(a.codes) && a.codes[o.Code],
+		Oversized: a.rule.Oversized && v.oversized.Load(),
+		SentBytes: int(v.sentSize.Load()),
+		RecvBytes: int(v.recvSize.Load()),
+	}
+	if (x.Slow || x.Failed || x.Oversized) && a.allow(time.Now()) {
+		a.fn(x)
+	}
+}
+
+// allow reports whether a token is available at the time and takes it.
+func (a *anomalyHook) allow(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.last.IsZero() {
+		a.tokens += now.Sub(a.last).Seconds() * a.rule.Rate
+		if max := float64(a.rule.Burst); a.tokens > max {
+			a.tokens = max
+		}
+	}
+	a.last = now
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
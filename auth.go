@@ -0,0 +1,70 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Auth schemes presented by server requests.
+const (
+	authBearer = "bearer"
+	authBasic  = "basic"
+	authMTLS   = "mtls"
+	authOther  = "other"
+	authNone   = "none"
+)
+
+func newAuthFailures(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable || subsys != "server" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "auth_failures_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests completed with Unauthenticated or PermissionDenied by auth scheme presented.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_code", "grpc_auth_scheme"),
+	)
+}
+
+// countAuthFailure counts the server request by the auth scheme it presented,
+// if it failed with Unauthenticated or PermissionDenied.
+func (h *handler) countAuthFailure(ctx context.Context, info *methodInfo, code codes.Code) {
+	if code != codes.Unauthenticated && code != codes.PermissionDenied {
+		return
+	}
+	lvs := make([]string, 0, len(info.codeLvs[code])+1)
+	h.authFailures.WithLabelValues(append(append(lvs, info.codeLvs[code]...), authScheme(ctx))...).Inc()
+}
+
+// authScheme returns the auth scheme presented by the server request:
+// the scheme of its authorization metadata, if any, or else mtls if it
+// presented a verified client certificate, or else none.
+func authScheme(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) > 0 {
+		scheme, _, _ := strings.Cut(v[0], " ")
+		switch {
+		case strings.EqualFold(scheme, authBearer):
+			return authBearer
+		case strings.EqualFold(scheme, authBasic):
+			return authBasic
+		}
+		return authOther
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return authMTLS
+		}
+	}
+	return authNone
+}
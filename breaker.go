@@ -0,0 +1,113 @@
+package grpcprom
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// An Outcome is the outcome of a completed RPC.
+type Outcome struct {
+	// Service is the name of the service.
+	Service string
+	// Method is the name of the method.
+	Method string
+	// Code is the status code.
+	Code codes.Code
+	// Err is the error, if any.
+	Err error
+	// Latency is the duration of the RPC.
+	Latency time.Duration
+}
+
+// A BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed is the state of a circuit breaker allowing requests.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen is the state of a circuit breaker allowing trial requests.
+	BreakerHalfOpen
+	// BreakerOpen is the state of a circuit breaker rejecting requests.
+	BreakerOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "Closed"
+	case BreakerHalfOpen:
+		return "HalfOpen"
+	case BreakerOpen:
+		return "Open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+type subscriber struct {
+	fn func(Outcome)
+}
+
+// subscribers is a copy-on-write list of outcome subscribers,
+// so that publishing is cheap when there are none.
+type subscribers struct {
+	mu   sync.Mutex
+	list atomic.Pointer[[]*subscriber]
+}
+
+func (s *subscribers) subscribe(fn func(Outcome)) (unsubscribe func()) {
+	sub := &subscriber{fn: fn}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*subscriber
+	if p := s.list.Load(); p != nil {
+		list = append(list, *p...)
+	}
+	list = append(list, sub)
+	s.list.Store(&list)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var list []*subscriber
+		for _, x := range *s.list.Load() {
+			if x != sub {
+				list = append(list, x)
+			}
+		}
+		s.list.Store(&list)
+	}
+}
+
+func (s *subscribers) active() bool {
+	p := s.list.Load()
+	return p != nil && len(*p) > 0
+}
+
+func (s *subscribers) publish(o Outcome) {
+	p := s.list.Load()
+	if p == nil {
+		return
+	}
+	for _, sub := range *p {
+		sub.fn(o)
+	}
+}
+
+func newBreakerState(subsys string, ms *metricSet, opts metricOptions) gaugeVec {
+	if opts.disable {
+		return noopGaugeVec{}
+	}
+	ms.setAggMode("circuit_breaker_state", aggSingle)
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: fmt.Sprintf("State of gRPC %s circuit breakers (0: Closed, 1: HalfOpen, 2: Open).", subsys),
+		},
+		[]string{"grpc_breaker"},
+	)
+}
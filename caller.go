@@ -0,0 +1,100 @@
+package grpcprom
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// A CallerFunc returns the name of the service calling a server request,
+// or the empty string if it's unknown.
+type CallerFunc func(ctx context.Context) string
+
+// CallerFromMetadata returns a CallerFunc that returns the first value of the
+// given key in the incoming metadata of requests.
+func CallerFromMetadata(key string) CallerFunc {
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// CallerFromTLS returns a CallerFunc that returns the first URI SAN,
+// such as a SPIFFE ID, or else the subject common name of the verified
+// client certificate of requests.
+func CallerFromTLS() CallerFunc {
+	return func(ctx context.Context) string {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return ""
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+			return ""
+		}
+		cert := info.State.VerifiedChains[0][0]
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+		return cert.Subject.CommonName
+	}
+}
+
+// otherCaller is the caller label value of callers beyond the limit.
+const otherCaller = "Other"
+
+// callerSet bounds the caller label values to the first max callers seen.
+// A nil callerSet labels nothing.
+type callerSet struct {
+	fn  CallerFunc
+	max int
+	log Logger
+
+	mu     sync.RWMutex
+	names  map[string]string
+	warned bool // the limit was exceeded
+}
+
+func newCallerSet(fn CallerFunc, max int, log Logger) *callerSet {
+	if fn == nil {
+		return nil
+	}
+	return &callerSet{fn: fn, max: max, log: log, names: make(map[string]string)}
+}
+
+// caller returns the caller label value for the context.
+func (c *callerSet) caller(ctx context.Context) string {
+	if c == nil {
+		return ""
+	}
+	name := c.fn(ctx)
+	if name == "" {
+		return unknown
+	}
+	c.mu.RLock()
+	v, ok := c.names[name]
+	c.mu.RUnlock()
+	if ok {
+		return v
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.names[name]; ok {
+		return v
+	}
+	if len(c.names) >= c.max {
+		if !c.warned {
+			c.warned = true
+			c.log.Warn("grpcprom: caller limit exceeded; other callers are labeled "+otherCaller, "max", c.max)
+		}
+		return otherCaller
+	}
+	c.names[name] = name
+	return name
+}
@@ -0,0 +1,67 @@
+package grpcprom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// Causes of requests completed with the Canceled code.
+const (
+	cancelCauseClient = iota
+	cancelCauseDeadline
+	cancelCauseShutdown
+	cancelCauseServer
+
+	numCancelCauses
+)
+
+// cancelCauses are the grpc_cause label values of the causes.
+var cancelCauses = [numCancelCauses]string{
+	cancelCauseClient:   "client",
+	cancelCauseDeadline: "deadline",
+	cancelCauseShutdown: "shutdown",
+	cancelCauseServer:   "server",
+}
+
+// cancelCause returns the cause of a request completed with the Canceled
+// code, given its context and error:
+//
+//   - client: its context was canceled, by the caller of a client request
+//     or by the peer of a server request resetting the stream or closing
+//     the connection, which includes connections closed by server shutdown.
+//   - deadline: its context's deadline was exceeded, such as when a handler
+//     returns Canceled from a downstream request with a propagated deadline.
+//   - shutdown: its client connection was closing.
+//   - server: its context was not done, so the Canceled status was returned
+//     by the server or its handler.
+func cancelCause(ctx context.Context, err error) int {
+	if errors.Is(err, grpc.ErrClientConnClosing) {
+		return cancelCauseShutdown
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return cancelCauseClient
+	case context.DeadlineExceeded:
+		return cancelCauseDeadline
+	}
+	return cancelCauseServer
+}
+
+func newCanceledByCause(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_canceled_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests completed with the Canceled code by cause.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_cause"),
+	)
+}
@@ -0,0 +1,180 @@
+package grpcprom
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// methodChildren are the child metrics of a method.
+type methodChildren struct {
+	pending      prometheus.Gauge
+	handlers     prometheus.Gauge
+	streams      prometheus.Gauge // only for streaming methods
+	streamMsgs   prometheus.Gauge // only for streaming methods
+	pendingMax   addend
+	pendingCount *atomic.Int64
+	latencyMax   prometheus.Observer
+	latencyEWMA  prometheus.Observer
+	timeout      prometheus.Observer
+	deadlineUtil prometheus.Observer
+	noDeadline   prometheus.Counter
+	pickDelay    prometheus.Observer
+	reqMsgs      prometheus.Observer // only for client-streaming methods
+	attempts     prometheus.Observer
+	retries      prometheus.Counter
+	transparent  prometheus.Counter
+	upload       prometheus.Observer // only for client-streaming methods
+	reqSize      prometheus.Observer
+	mdBytes      [2][2]prometheus.Observer // recv, sent; header, trailer
+	mdEntries    [2][2]prometheus.Observer // recv, sent; header, trailer
+	respSize     prometheus.Observer
+	sizeRatio    prometheus.Observer      // only for unary methods
+	msgs         [2][2]prometheus.Counter // recv, sent; uncompressed, compressed; only if enabled
+	canceled     prometheus.Counter
+	canceledBy   [numCancelCauses]prometheus.Counter
+	deprecated   prometheus.Counter // only for deprecated methods
+	compat       *compatChildren    // only if enabled
+}
+
+// codeChildren are the child metrics of a method with a code.
+type codeChildren struct {
+	total        [numDeadlineClasses]prometheus.Counter // by deadline class, or all the same
+	trailersOnly prometheus.Counter
+	attempts     prometheus.Counter
+	latency      prometheus.Observer
+	lastError    prometheus.Gauge // only for error codes
+}
+
+// methodChildren returns the child metrics of the method.
+func (h *handler) methodChildren(info *methodInfo) *methodChildren {
+	if m := info.children.Load(); m != nil {
+		return m
+	}
+	m := &methodChildren{
+		pending:      h.reqsPending.WithLabelValues(info.lvs...),
+		handlers:     h.handlers.WithLabelValues(info.lvs...),
+		pendingMax:   h.reqsPendingMax.With(info.lvs...),
+		pendingCount: h.pendingCounts.method(info.name),
+		latencyMax:   h.latencyMax.With(info.lvs...),
+		latencyEWMA:  h.latencyEWMA.With(info.name, info.lvs),
+		timeout:      h.timeout.With(info.lvs...),
+		deadlineUtil: h.deadlineUtil.With(info.lvs...),
+		noDeadline:   h.noDeadline.WithLabelValues(info.lvs...),
+		pickDelay:    h.pickDelay.With(info.lvs...),
+		reqMsgs:      noopChildObserver,
+		attempts:     h.reqAttempts.With(info.lvs...),
+		retries:      h.retryAttempts.WithLabelValues(info.lvs...),
+		transparent:  h.transparent.WithLabelValues(info.lvs...),
+		upload:       noopChildObserver,
+		reqSize:      h.reqSize.With(info.lvs...),
+		mdBytes:      h.mdBytes.children(info.lvs),
+		mdEntries:    h.mdEntries.children(info.lvs),
+		respSize:     h.respSize.With(info.lvs...),
+		sizeRatio:    noopChildObserver,
+		streams:      noopGauge{},
+		streamMsgs:   noopGauge{},
+		canceled:     h.reqsCanceled.WithLabelValues(info.lvs...),
+		deprecated:   noopCounter{},
+		compat:       h.compat.children(info),
+	}
+	for i, cause := range cancelCauses {
+		m.canceledBy[i] = h.canceledBy.WithLabelValues(append(info.lvs[:len(info.lvs):len(info.lvs)], cause)...)
+	}
+	if info.deprecated {
+		m.deprecated = h.deprecated.WithLabelValues(info.lvs...)
+	}
+	if info.typ == clientStream || info.typ == bidiStream {
+		m.reqMsgs = h.reqMsgs.With(info.lvs...)
+		m.upload = h.upload.With(info.lvs...)
+	}
+	if info.typ == unary {
+		m.sizeRatio = h.sizeRatio.With(info.lvs...)
+	}
+	if isStream(info.typ) {
+		m.streams = h.streamsOpen.WithLabelValues(info.lvs...)
+		m.streamMsgs = h.streamMsgsOpen.WithLabelValues(info.lvs...)
+	}
+	if _, ok := h.msgsTotal.(noopCounterVec); !ok {
+		for dir, dirLv := range [2]string{"recv", "sent"} {
+			for comp, compLv := range [2]string{"false", "true"} {
+				lvs := make([]string, 0, len(info.lvs)+2)
+				m.msgs[dir][comp] = h.msgsTotal.WithLabelValues(append(append(lvs, info.lvs...), dirLv, compLv)...)
+			}
+		}
+	}
+	info.children.Store(m)
+	return m
+}
+
+// codeChildren returns the child metrics of the method with the code.
+func (h *handler) codeChildren(info *methodInfo, c codes.Code) *codeChildren {
+	if int(c) >= len(info.codeChildren) {
+		return h.newCodeChildren(info, c, "", nil)
+	}
+	if m := info.codeChildren[c].Load(); m != nil {
+		return m
+	}
+	m := h.newCodeChildren(info, c, "", nil)
+	info.codeChildren[c].Store(m)
+	return m
+}
+
+// newCodeChildren returns new child metrics of the method with the code,
+// the custom code label value of request metrics, if any, and, if the peer
+// or extra labels are labeled, the trailing label values.
+func (h *handler) newCodeChildren(info *methodInfo, c codes.Code, codeLv string, trailing []string) *codeChildren {
+	lvs := info.codeLabels(c)
+	if h.labeled != nil && trailing == nil {
+		trailing = h.labeled.initLabels()
+	}
+	reqLvs := h.requestLabels(lvs, c)
+	if codeLv != "" {
+		reqLvs = append(lvs[:len(lvs)-1:len(lvs)-1], codeLv)
+	}
+	totalLvs, latencyLvs := reqLvs, reqLvs
+	if len(trailing) > 0 {
+		latencyLvs = append(reqLvs[:len(reqLvs):len(reqLvs)], trailing...)
+	}
+	m := &codeChildren{
+		trailersOnly: h.trailersOnly.WithLabelValues(lvs...),
+		attempts:     h.attempts.WithLabelValues(lvs...),
+		latency:      noopChildObserver,
+		lastError:    noopGauge{},
+	}
+	if h.deadlineLabel {
+		for class, lv := range deadlineClassLabels {
+			totalLvs = append(reqLvs[:len(reqLvs):len(reqLvs)], lv)
+			totalLvs = append(totalLvs, trailing...)
+			m.total[class] = h.reqsTotal.WithLabelValues(totalLvs...)
+		}
+	} else {
+		totalLvs = latencyLvs
+		total := h.reqsTotal.WithLabelValues(totalLvs...)
+		for class := range m.total {
+			m.total[class] = total
+		}
+	}
+	if !h.errorsOnly || c != codes.OK {
+		m.latency = methodObserver(h.latency, info.name).With(latencyLvs...)
+	}
+	if c != codes.OK {
+		m.lastError = h.lastError.WithLabelValues(lvs...)
+	}
+	return m
+}
+
+// sizeObserver returns the sent_bytes or recv_bytes observer of the method with the frame.
+func (h *handler) sizeObserver(info *methodInfo, sent bool, frame int) prometheus.Observer {
+	dir, vec := 0, h.recvBytes
+	if sent {
+		dir, vec = 1, h.sentBytes
+	}
+	if p := info.sizeChildren[dir][frame].Load(); p != nil {
+		return *p
+	}
+	o := vec.With(info.frameLvs[frame]...)
+	info.sizeChildren[dir][frame].Store(&o)
+	return o
+}
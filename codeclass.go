@@ -0,0 +1,59 @@
+package grpcprom
+
+import "google.golang.org/grpc/codes"
+
+// Code classes of requests, which are the grpc_code_class label values.
+const (
+	codeClassOK          = "ok"
+	codeClassCanceled    = "canceled"
+	codeClassClientError = "client_error"
+	codeClassServerError = "server_error"
+)
+
+// codeClass returns the class of the code. Like HTTP 4xx statuses, client
+// errors are caused by the request and server errors are caused by the server.
+func codeClass(c codes.Code) string {
+	switch c {
+	case codes.OK:
+		return codeClassOK
+	case codes.Canceled:
+		return codeClassCanceled
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.ResourceExhausted, codes.FailedPrecondition,
+		codes.Aborted, codes.OutOfRange, codes.Unauthenticated:
+		return codeClassClientError
+	default:
+		return codeClassServerError
+	}
+}
+
+// codeByClass returns a representative code of the class, so that derived
+// metrics may be computed from requests labeled by class.
+func codeByClass(s string) (codes.Code, bool) {
+	switch s {
+	case codeClassOK:
+		return codes.OK, true
+	case codeClassCanceled:
+		return codes.Canceled, true
+	case codeClassClientError:
+		return codes.InvalidArgument, true
+	case codeClassServerError:
+		return codes.Internal, true
+	}
+	return 0, false
+}
+
+// requestLabels returns the label values of the requests_total and
+// latency_seconds metrics given the label values for the code, which
+// end with the grpc_code_class label instead of grpc_code, if classified.
+func (h *handler) requestLabels(lvs []string, c codes.Code) []string {
+	if !h.codeClass {
+		return lvs
+	}
+	return append(lvs[:len(lvs)-1:len(lvs)-1], codeClass(c))
+}
+
+// A CodeMapperFunc returns the code label value of an RPC's error,
+// which is nil if the RPC succeeded, or an empty string to use the
+// value of its status code.
+type CodeMapperFunc func(err error) string
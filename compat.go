@@ -0,0 +1,163 @@
+package grpcprom
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// compatTypes are the grpc_type label values of go-grpc-prometheus.
+var compatTypes = map[string]string{
+	unknown:      "unknown",
+	unary:        "unary",
+	clientStream: "client_stream",
+	serverStream: "server_stream",
+	bidiStream:   "bidi_stream",
+}
+
+// compatMetrics are the metrics of grpc-ecosystem/go-grpc-prometheus,
+// with its names and labels. A nil compatMetrics records nothing.
+type compatMetrics struct {
+	started  *prometheus.CounterVec
+	handled  *prometheus.CounterVec
+	msgRecv  *prometheus.CounterVec
+	msgSent  *prometheus.CounterVec
+	handling *prometheus.HistogramVec
+}
+
+// compatChildren are the compatible child metrics of a method.
+type compatChildren struct {
+	lvs      []string
+	handled  [codes.Unauthenticated + 1]atomic.Pointer[prometheus.Counter]
+	started  prometheus.Counter
+	msgRecv  prometheus.Counter
+	msgSent  prometheus.Counter
+	handling prometheus.Observer
+}
+
+func newCompat(subsys string, ms *metricSet, opts histogramOptions) *compatMetrics {
+	if opts.disable {
+		return nil
+	}
+	help := map[string]string{
+		"started":  "Total number of RPCs started on the server.",
+		"handled":  "Total number of RPCs completed on the server, regardless of success or failure.",
+		"msgRecv":  "Total number of RPC stream messages received on the server.",
+		"msgSent":  "Total number of gRPC stream messages sent by the server.",
+		"handling": "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+	}
+	if subsys == "client" {
+		help = map[string]string{
+			"started":  "Total number of RPCs started on the client.",
+			"handled":  "Total number of RPCs completed by the client, regardless of success or failure.",
+			"msgRecv":  "Total number of RPC stream messages received by the client.",
+			"msgSent":  "Total number of gRPC stream messages sent by the client.",
+			"handling": "Histogram of response latency (seconds) of the gRPC until it is finished by the application.",
+		}
+	}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return ms.counterVec(
+			prometheus.CounterOpts{
+				Name: name,
+				Help: help,
+			},
+			append([]string{"grpc_type", "grpc_service", "grpc_method"}, labels...),
+		)
+	}
+	buckets := opts.buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	return &compatMetrics{
+		started: counter("started_total", help["started"]),
+		handled: counter("handled_total", help["handled"], "grpc_code"),
+		msgRecv: counter("msg_received_total", help["msgRecv"]),
+		msgSent: counter("msg_sent_total", help["msgSent"]),
+		handling: ms.histogramVec(
+			prometheus.HistogramOpts{
+				Name:    "handling_seconds",
+				Help:    help["handling"],
+				Buckets: buckets,
+			},
+			[]string{"grpc_type", "grpc_service", "grpc_method"},
+		),
+	}
+}
+
+// labels returns the compatible label values of the method.
+func (c *compatMetrics) labels(info *methodInfo) []string {
+	return []string{compatTypes[info.typ], info.server, info.method}
+}
+
+// children returns the compatible child metrics of the method.
+func (c *compatMetrics) children(info *methodInfo) *compatChildren {
+	if c == nil {
+		return nil
+	}
+	lvs := c.labels(info)
+	return &compatChildren{
+		lvs:      lvs,
+		started:  c.started.WithLabelValues(lvs...),
+		msgRecv:  c.msgRecv.WithLabelValues(lvs...),
+		msgSent:  c.msgSent.WithLabelValues(lvs...),
+		handling: c.handling.WithLabelValues(lvs...),
+	}
+}
+
+// handledCounter returns the compatible handled counter of the method with the code.
+func (c *compatMetrics) handledCounter(children *compatChildren, code codes.Code) prometheus.Counter {
+	lvs := children.lvs
+	if int(code) >= len(children.handled) {
+		return c.handled.WithLabelValues(append(lvs[:len(lvs):len(lvs)], code.String())...)
+	}
+	if p := children.handled[code].Load(); p != nil {
+		return *p
+	}
+	counter := c.handled.WithLabelValues(append(lvs[:len(lvs):len(lvs)], code.String())...)
+	children.handled[code].Store(&counter)
+	return counter
+}
+
+// init initializes the compatible metrics of the method with the codes.
+func (c *compatMetrics) init(info *methodInfo, cs []codes.Code) error {
+	if c == nil {
+		return nil
+	}
+	lvs := c.labels(info)
+	if _, err := c.started.GetMetricWithLabelValues(lvs...); err != nil {
+		return fmt.Errorf("grpcprom: failed to initialize compatible metrics: %w", err)
+	}
+	if _, err := c.handling.GetMetricWithLabelValues(lvs...); err != nil {
+		return fmt.Errorf("grpcprom: failed to initialize compatible metrics: %w", err)
+	}
+	for _, code := range cs {
+		if _, err := c.handled.GetMetricWithLabelValues(append(lvs, code.String())...); err != nil {
+			return fmt.Errorf("grpcprom: failed to initialize compatible metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *compatMetrics) Describe(ch chan<- *prometheus.Desc) {
+	if c == nil {
+		return
+	}
+	c.started.Describe(ch)
+	c.handled.Describe(ch)
+	c.msgRecv.Describe(ch)
+	c.msgSent.Describe(ch)
+	c.handling.Describe(ch)
+}
+
+func (c *compatMetrics) Collect(ch chan<- prometheus.Metric) {
+	if c == nil {
+		return
+	}
+	c.started.Collect(ch)
+	c.handled.Collect(ch)
+	c.msgRecv.Collect(ch)
+	c.msgSent.Collect(ch)
+	c.handling.Collect(ch)
+}
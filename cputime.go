@@ -0,0 +1,73 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cpuTimer measures the CPU time of server handlers by locking their
+// goroutines to threads and reading the thread CPU clock, where supported.
+// It doesn't include the CPU time of other goroutines started by handlers.
+// A nil cpuTimer does nothing.
+type cpuTimer struct {
+	h     *handler
+	total counterVec
+}
+
+func newCPUTime(h *handler, subsys string, ms *metricSet, prefix []string, opts metricOptions) *cpuTimer {
+	if opts.disable || subsys != "server" || !threadCPUTimeSupported {
+		return nil
+	}
+	return &cpuTimer{
+		h: h,
+		total: newCounterVec(
+			ms,
+			opts,
+			prometheus.CounterOpts{
+				Name: "handler_cpu_seconds_total",
+				Help: fmt.Sprintf("Total CPU time consumed by gRPC %s handler goroutines.", subsys),
+			},
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		),
+	}
+}
+
+// start starts measuring the CPU time of the RPC's handler and returns
+// a function to stop it, or nil if it's not measured.
+func (c *cpuTimer) start(ctx context.Context) (stop func()) {
+	if c == nil {
+		return nil
+	}
+	v, ok := ctx.Value(c.h).(*rpcInfo)
+	if !ok {
+		return nil
+	}
+	runtime.LockOSThread()
+	begin, ok := threadCPUTime()
+	if !ok {
+		runtime.UnlockOSThread()
+		return nil
+	}
+	return func() {
+		end, ok := threadCPUTime()
+		runtime.UnlockOSThread()
+		if ok && end > begin {
+			c.total.WithLabelValues(v.lvs...).Add((end - begin).Seconds())
+		}
+	}
+}
+
+func (c *cpuTimer) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		c.total.Describe(ch)
+	}
+}
+
+func (c *cpuTimer) Collect(ch chan<- prometheus.Metric) {
+	if c != nil {
+		c.total.Collect(ch)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package grpcprom
+
+import "time"
+
+const threadCPUTimeSupported = false
+
+// threadCPUTime isn't supported on this platform.
+func threadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
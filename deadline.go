@@ -0,0 +1,44 @@
+package grpcprom
+
+import (
+	"context"
+	"time"
+)
+
+// Deadline classes of requests.
+const (
+	deadlineNone = iota
+	deadlineUnder100ms
+	deadlineUnder1s
+	deadlineUnder10s
+	deadlineOver10s
+	numDeadlineClasses
+)
+
+// deadlineClassLabels are the grpc_deadline label values of the deadline classes.
+var deadlineClassLabels = [numDeadlineClasses]string{
+	deadlineNone:       "none",
+	deadlineUnder100ms: "<100ms",
+	deadlineUnder1s:    "<1s",
+	deadlineUnder10s:   "<10s",
+	deadlineOver10s:    ">=10s",
+}
+
+// deadlineClass returns the class of the deadline of ctx
+// relative to the beginning of the request.
+func deadlineClass(ctx context.Context, begin time.Time) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return deadlineNone
+	}
+	switch d := deadline.Sub(begin); {
+	case d < 100*time.Millisecond:
+		return deadlineUnder100ms
+	case d < time.Second:
+		return deadlineUnder1s
+	case d < 10*time.Second:
+		return deadlineUnder10s
+	default:
+		return deadlineOver10s
+	}
+}
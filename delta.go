@@ -0,0 +1,156 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// A DeltaSnapshot is a snapshot of metrics with delta temporality.
+// Counters, and the sums, counts, and buckets of histograms and summaries,
+// are the changes since the start of the snapshot. Gauges are current values.
+// Summary quantiles are omitted, because they can't be differenced.
+type DeltaSnapshot struct {
+	Start    time.Time
+	End      time.Time
+	Families []*dto.MetricFamily
+}
+
+// A DeltaExporter exports snapshots of metrics with delta temporality, for push
+// pipelines and monitoring systems which prefer deltas to cumulative values.
+// Each snapshot is the difference between the metrics and the previous snapshot.
+// A series which decreases is assumed to have been reset, so its current value
+// is its delta.
+type DeltaExporter struct {
+	g prometheus.Gatherer
+
+	mu    sync.Mutex
+	start time.Time
+	prev  map[string]*dto.Metric // family name, label pairs => cumulative metric
+}
+
+// NewDeltaExporter returns a new DeltaExporter of the given collectors,
+// whose first snapshot starts now.
+func NewDeltaExporter(collectors ...prometheus.Collector) (*DeltaExporter, error) {
+	r := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	e := &DeltaExporter{g: r}
+	if _, err := e.Export(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Export returns a snapshot of the changes since the previous snapshot.
+func (e *DeltaExporter) Export() (*DeltaSnapshot, error) {
+	mfs, err := e.g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	snap := &DeltaSnapshot{Start: e.start, End: now}
+	next := make(map[string]*dto.Metric)
+	for _, mf := range mfs {
+		delta := &dto.MetricFamily{
+			Name: mf.Name,
+			Help: mf.Help,
+			Type: mf.Type,
+		}
+		for _, m := range mf.Metric {
+			key := deltaKey(mf.GetName(), m)
+			next[key] = m
+			delta.Metric = append(delta.Metric, deltaMetric(mf.GetType(), m, e.prev[key]))
+		}
+		snap.Families = append(snap.Families, delta)
+	}
+	e.start, e.prev = now, next
+	return snap, nil
+}
+
+// Run calls fn with a snapshot each interval until ctx is done or fn returns an error.
+// It returns the error of ctx, Export, or fn.
+func (e *DeltaExporter) Run(ctx context.Context, interval time.Duration, fn func(*DeltaSnapshot) error) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		snap, err := e.Export()
+		if err != nil {
+			return err
+		}
+		if err := fn(snap); err != nil {
+			return err
+		}
+	}
+}
+
+func deltaKey(name string, m *dto.Metric) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, lp := range m.Label {
+		key.WriteByte(0)
+		key.WriteString(lp.GetName())
+		key.WriteByte(0)
+		key.WriteString(lp.GetValue())
+	}
+	return key.String()
+}
+
+// deltaMetric returns the change of cur since prev, which may be nil.
+func deltaMetric(typ dto.MetricType, cur, prev *dto.Metric) *dto.Metric {
+	d := &dto.Metric{Label: cur.Label, TimestampMs: cur.TimestampMs}
+	switch typ {
+	case dto.MetricType_COUNTER:
+		v := cur.GetCounter().GetValue()
+		if p := prev.GetCounter().GetValue(); p <= v {
+			v -= p
+		}
+		d.Counter = &dto.Counter{Value: proto.Float64(v)}
+	case dto.MetricType_HISTOGRAM:
+		h, p := cur.GetHistogram(), prev.GetHistogram()
+		if p.GetSampleCount() > h.GetSampleCount() {
+			p = nil // reset
+		}
+		d.Histogram = &dto.Histogram{
+			SampleCount: proto.Uint64(h.GetSampleCount() - p.GetSampleCount()),
+			SampleSum:   proto.Float64(h.GetSampleSum() - p.GetSampleSum()),
+		}
+		prevBuckets := make(map[float64]uint64, len(p.GetBucket()))
+		for _, b := range p.GetBucket() {
+			prevBuckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		for _, b := range h.Bucket {
+			d.Histogram.Bucket = append(d.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      b.UpperBound,
+				CumulativeCount: proto.Uint64(b.GetCumulativeCount() - prevBuckets[b.GetUpperBound()]),
+			})
+		}
+	case dto.MetricType_SUMMARY:
+		s, p := cur.GetSummary(), prev.GetSummary()
+		if p.GetSampleCount() > s.GetSampleCount() {
+			p = nil // reset
+		}
+		d.Summary = &dto.Summary{
+			SampleCount: proto.Uint64(s.GetSampleCount() - p.GetSampleCount()),
+			SampleSum:   proto.Float64(s.GetSampleSum() - p.GetSampleSum()),
+		}
+	default:
+		d.Gauge, d.Untyped = cur.Gauge, cur.Untyped
+	}
+	return d
+}
@@ -0,0 +1,59 @@
+package grpcprom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/stats"
+)
+
+func TestDeltaExporter(t *testing.T) {
+	m := NewServerMetrics(LatencySeconds(Buckets([]float64{1})))
+	h := m.handler
+	rpc := func() {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	rpc()
+	e, err := NewDeltaExporter(m)
+	check(t, err)
+	for _, n := range []int{2, 0, 3} {
+		for i := 0; i < n; i++ {
+			rpc()
+		}
+		snap, err := e.Export()
+		check(t, err)
+		if !snap.Start.Before(snap.End) {
+			t.Fatalf("snapshot start %v not before end %v", snap.Start, snap.End)
+		}
+		total := deltaFamily(t, snap, "grpc_server_requests_total")
+		if got := total.Metric[0].GetCounter().GetValue(); got != float64(n) {
+			t.Errorf("requests_total delta = %v; want %v", got, n)
+		}
+		latency := deltaFamily(t, snap, "grpc_server_latency_seconds").Metric[0].GetHistogram()
+		if got := latency.GetSampleCount(); got != uint64(n) {
+			t.Errorf("latency_seconds count delta = %v; want %v", got, n)
+		}
+		if got := latency.Bucket[0].GetCumulativeCount(); got != uint64(n) {
+			t.Errorf("latency_seconds bucket delta = %v; want %v", got, n)
+		}
+		pending := deltaFamily(t, snap, "grpc_server_requests_pending")
+		if got := pending.Metric[0].GetGauge().GetValue(); got != 0 {
+			t.Errorf("requests_pending = %v; want 0", got)
+		}
+	}
+}
+
+func deltaFamily(t *testing.T, snap *DeltaSnapshot, name string) *dto.MetricFamily {
+	t.Helper()
+	for _, mf := range snap.Families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	t.Fatalf("family %s not found", name)
+	return nil
+}
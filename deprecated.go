@@ -0,0 +1,29 @@
+package grpcprom
+
+import (
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// isDeprecated reports whether the method or its service is marked deprecated
+// in the proto descriptors registered with protoregistry.GlobalFiles.
+func isDeprecated(service, method string) bool {
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return false
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return false
+	}
+	if opts, ok := sd.Options().(*descriptorpb.ServiceOptions); ok && opts.GetDeprecated() {
+		return true
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return false
+	}
+	opts, ok := md.Options().(*descriptorpb.MethodOptions)
+	return ok && opts.GetDeprecated()
+}
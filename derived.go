@@ -0,0 +1,185 @@
+package grpcprom
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+)
+
+// MethodStats are the statistics of a method from which derived metrics are computed.
+type MethodStats struct {
+	// Type is the type of the method.
+	Type string
+	// Service is the name of the method's service.
+	Service string
+	// Method is the name of the method.
+	Method string
+
+	// Requests are the numbers of requests completed by code.
+	Requests map[codes.Code]float64
+	// Pending is the number of requests pending.
+	Pending float64
+}
+
+// Total returns the total number of requests completed.
+func (s *MethodStats) Total() float64 {
+	var n float64
+	for _, v := range s.Requests {
+		n += v
+	}
+	return n
+}
+
+// A DerivedMetric is a gauge computed from the statistics of each method when
+// it's collected, with the same labels as the method's request metrics.
+type DerivedMetric struct {
+	// Name is the name of the metric, which is prefixed by the namespace
+	// and subsystem of the metrics (e.g. "error_ratio" is exported as
+	// grpc_server_error_ratio by ServerMetrics).
+	Name string
+	// Help is the help text of the metric.
+	Help string
+	// Value returns the value of the metric for the method,
+	// or false if it doesn't have a value.
+	Value func(*MethodStats) (float64, bool)
+}
+
+// derivedCollector collects derived metrics from the handler's request metrics.
+// A nil derivedCollector collects nothing.
+type derivedCollector struct {
+	h       *handler
+	metrics []DerivedMetric
+	descs   []*prometheus.Desc
+	names   []string // label names of methods
+}
+
+func newDerived(h *handler, subsys string, ms *metricSet, prefix []string, metrics []DerivedMetric) *derivedCollector {
+	if len(metrics) == 0 {
+		return nil
+	}
+	d := &derivedCollector{
+		h:       h,
+		metrics: metrics,
+		names:   labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	}
+	for _, m := range metrics {
+		d.descs = append(d.descs, ms.desc(
+			dto.MetricType_GAUGE,
+			m.Name,
+			m.Help,
+			d.names,
+		))
+	}
+	return d
+}
+
+func (d *derivedCollector) Describe(ch chan<- *prometheus.Desc) {
+	if d == nil {
+		return
+	}
+	for _, desc := range d.descs {
+		ch <- desc
+	}
+}
+
+func (d *derivedCollector) Collect(ch chan<- prometheus.Metric) {
+	if d == nil {
+		return
+	}
+	stats := d.stats()
+	for i, m := range d.metrics {
+		for _, s := range stats {
+			if v, ok := m.Value(s.MethodStats); ok {
+				ch <- prometheus.MustNewConstMetric(d.descs[i], prometheus.GaugeValue, v, s.lvs...)
+			}
+		}
+	}
+}
+
+type methodStats struct {
+	*MethodStats
+	lvs []string
+}
+
+// stats returns the statistics of methods read from the request metrics,
+// sorted by their label values.
+func (d *derivedCollector) stats() []methodStats {
+	byKey := make(map[string]methodStats)
+	get := func(m *dto.Metric) (methodStats, map[string]string) {
+		labels := make(map[string]string, len(m.Label))
+		for _, lp := range m.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		lvs := make([]string, len(d.names))
+		for i, name := range d.names {
+			lvs[i] = labels[name]
+		}
+		key := strings.Join(lvs, "\xff")
+		s, ok := byKey[key]
+		if !ok {
+			s = methodStats{
+				MethodStats: &MethodStats{
+					Type:     labels["grpc_type"],
+					Service:  labels["grpc_service"],
+					Method:   labels["grpc_method"],
+					Requests: make(map[codes.Code]float64),
+				},
+				lvs: lvs,
+			}
+			byKey[key] = s
+		}
+		return s, labels
+	}
+	for _, m := range collectMetrics(d.h.reqsTotal) {
+		s, labels := get(m)
+		code, ok := codeByLabel(labels["grpc_code"])
+		if d.h.codeClass {
+			code, ok = codeByClass(labels["grpc_code_class"])
+		}
+		if ok {
+			s.Requests[code] += m.GetCounter().GetValue()
+		}
+	}
+	for _, m := range collectMetrics(d.h.reqsPending) {
+		s, _ := get(m)
+		s.Pending += m.GetGauge().GetValue()
+	}
+	stats := make([]methodStats, 0, len(byKey))
+	for _, s := range byKey {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return strings.Join(stats[i].lvs, "\xff") < strings.Join(stats[j].lvs, "\xff")
+	})
+	return stats
+}
+
+// codeByLabel returns the code of the label value.
+func codeByLabel(s string) (codes.Code, bool) {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if c.String() == s {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// collectMetrics returns the metrics collected from c.
+func collectMetrics(c prometheus.Collector) []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var ms []*dto.Metric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err == nil {
+			ms = append(ms, pb)
+		}
+	}
+	return ms
+}
@@ -0,0 +1,185 @@
+package grpcprom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
+)
+
+// Reasons of connection failures.
+const (
+	dialRefused = "refused"
+	dialTimeout = "timeout"
+	dialDNS     = "dns"
+	dialTLS     = "tls"
+	dialOther   = "other"
+)
+
+func newConnFailures(subsys string, ms *metricSet, opts metricOptions) counterVec {
+	if opts.disable || subsys != "client" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "connection_failures_total",
+			Help: fmt.Sprintf("Total number of gRPC %s connections which failed to be established.", subsys),
+		},
+		[]string{"grpc_target", "grpc_reason"},
+	)
+}
+
+func newConnAttempts(subsys string, ms *metricSet, opts metricOptions) counterVec {
+	if opts.disable || subsys != "client" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "connection_attempts_total",
+			Help: fmt.Sprintf("Total number of gRPC %s connections dialed.", subsys),
+		},
+		[]string{"grpc_target"},
+	)
+}
+
+func newReconnectBackoff(subsys string, ms *metricSet, opts histogramOptions) *backoffs {
+	if opts.disable || subsys != "client" {
+		return nil
+	}
+	return &backoffs{
+		seconds: newHistogramObserver(
+			ms,
+			"reconnect_backoff_seconds",
+			fmt.Sprintf("Duration of gRPC %s backoffs between failed connection attempts.", subsys),
+			[]string{"grpc_target"},
+			opts,
+		),
+		failed: make(map[string]time.Time),
+	}
+}
+
+// backoffs observes the time between failed connection attempts to targets
+// and their next attempts. A nil backoffs observes nothing.
+type backoffs struct {
+	seconds observer
+
+	mu     sync.Mutex
+	failed map[string]time.Time // target => time of failure
+}
+
+// fail records a failed connection attempt to the target.
+func (b *backoffs) fail(target string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.failed[target] = time.Now()
+	b.mu.Unlock()
+}
+
+// attempt observes the backoff before a connection attempt to the target,
+// if its last attempt failed.
+func (b *backoffs) attempt(target string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	t, ok := b.failed[target]
+	delete(b.failed, target)
+	b.mu.Unlock()
+	if ok {
+		b.seconds.With(target).Observe(time.Since(t).Seconds())
+	}
+}
+
+func (b *backoffs) Describe(ch chan<- *prometheus.Desc) {
+	if b != nil {
+		b.seconds.Describe(ch)
+	}
+}
+
+func (b *backoffs) Collect(ch chan<- prometheus.Metric) {
+	if b != nil {
+		b.seconds.Collect(ch)
+	}
+}
+
+// failuresDialer returns a dialer which wraps dial, counts its attempts and
+// failures, and observes the backoffs between them.
+func (h *handler) failuresDialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	_, noFailures := h.connFailures.(noopCounterVec)
+	_, noAttempts := h.connAttempts.(noopCounterVec)
+	if noFailures && noAttempts && h.backoffs == nil {
+		return dial
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		h.connAttempts.WithLabelValues(addr).Inc()
+		h.backoffs.attempt(addr)
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			h.connFailed(ctx, addr, err, dialReason(err))
+		}
+		return conn, err
+	}
+}
+
+// connFailed records the connection failure, unless the context was canceled,
+// such as when the ClientConn was closed.
+func (h *handler) connFailed(ctx context.Context, target string, err error, reason string) {
+	if errors.Is(err, context.Canceled) || ctx.Err() == context.Canceled {
+		return
+	}
+	h.connFailures.WithLabelValues(target, reason).Inc()
+	h.backoffs.fail(target)
+}
+
+// dialReason returns the reason of the dial error.
+func dialReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return dialDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialTimeout
+	}
+	return dialOther
+}
+
+// failuresCreds are transport credentials which count their failed client handshakes.
+type failuresCreds struct {
+	credentials.TransportCredentials
+	h *handler
+}
+
+func (c *failuresCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		reason := dialTLS
+		if r := dialReason(err); r == dialTimeout {
+			reason = r
+		}
+		target := authority
+		if addr := rawConn.RemoteAddr(); addr != nil {
+			target = addr.String()
+		}
+		c.h.connFailed(ctx, target, err, reason)
+	}
+	return conn, info, err
+}
+
+func (c *failuresCreds) Clone() credentials.TransportCredentials {
+	return &failuresCreds{c.TransportCredentials.Clone(), c.h}
+}
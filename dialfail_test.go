@@ -0,0 +1,120 @@
+package grpcprom
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestConnectionFailures(t *testing.T) {
+	m := NewClientMetrics()
+	ctx := context.Background()
+
+	// Find an address which refuses connections.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	check(t, err)
+	refused := lis.Addr().String()
+	check(t, lis.Close())
+	if _, err := m.Dialer(nil)(ctx, refused); err == nil {
+		t.Fatal("unexpected dial success")
+	}
+
+	for _, dialErr := range []error{
+		&net.DNSError{Err: "no such host", Name: "missing.invalid", IsNotFound: true},
+		context.DeadlineExceeded,
+		context.Canceled,
+	} {
+		dial := m.Dialer(func(context.Context, string) (net.Conn, error) { return nil, dialErr })
+		if _, err := dial(ctx, "missing.invalid:443"); err == nil {
+			t.Fatal("unexpected dial success")
+		}
+	}
+
+	client, server := net.Pipe()
+	go server.Close()
+	creds := m.TransportCredentials(credentials.NewTLS(&tls.Config{ServerName: "example.com"})).Clone()
+	if _, _, err := creds.ClientHandshake(ctx, "example.com", pipeAddrConn{client}); err == nil {
+		t.Fatal("unexpected handshake success")
+	}
+
+	want := `
+		# HELP grpc_client_connection_failures_total Total number of gRPC client connections which failed to be established.
+		# TYPE grpc_client_connection_failures_total counter
+		grpc_client_connection_failures_total{grpc_reason="dns",grpc_target="missing.invalid:443"} 1
+		grpc_client_connection_failures_total{grpc_reason="refused",grpc_target="` + refused + `"} 1
+		grpc_client_connection_failures_total{grpc_reason="timeout",grpc_target="missing.invalid:443"} 1
+		grpc_client_connection_failures_total{grpc_reason="tls",grpc_target="192.0.2.1:443"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_connection_failures_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pipeAddrConn is a net.Conn with a remote address.
+type pipeAddrConn struct{ net.Conn }
+
+func (pipeAddrConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443} }
+
+func TestReconnectBackoff(t *testing.T) {
+	m := NewClientMetrics(ReconnectBackoffSeconds(NoBuckets()))
+	fails := 2
+	dial := m.Dialer(func(context.Context, string) (net.Conn, error) {
+		if fails > 0 {
+			fails--
+			return nil, syscall.ECONNREFUSED
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	for i := 0; i < 4; i++ {
+		if conn, err := dial(context.Background(), "192.0.2.1:443"); err == nil {
+			conn.Close()
+		}
+	}
+	want := `
+		# HELP grpc_client_reconnect_backoff_seconds_count Duration of gRPC client backoffs between failed connection attempts count.
+		# TYPE grpc_client_reconnect_backoff_seconds_count counter
+		grpc_client_reconnect_backoff_seconds_count{grpc_target="192.0.2.1:443"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_reconnect_backoff_seconds_count"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectionAttempts(t *testing.T) {
+	m := NewClientMetrics(ConnectionAttemptsTotal(Enable()))
+	fails := 1
+	dial := m.Dialer(func(context.Context, string) (net.Conn, error) {
+		if fails > 0 {
+			fails--
+			return nil, syscall.ECONNREFUSED
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	for i := 0; i < 2; i++ {
+		if conn, err := dial(context.Background(), "192.0.2.1:443"); err == nil {
+			conn.Close()
+		}
+	}
+	want := `
+		# HELP grpc_client_connection_attempts_total Total number of gRPC client connections dialed.
+		# TYPE grpc_client_connection_attempts_total counter
+		grpc_client_connection_attempts_total{grpc_target="192.0.2.1:443"} 2
+		# HELP grpc_client_connection_failures_total Total number of gRPC client connections which failed to be established.
+		# TYPE grpc_client_connection_failures_total counter
+		grpc_client_connection_failures_total{grpc_reason="refused",grpc_target="192.0.2.1:443"} 1
+	`
+	names := []string{"grpc_client_connection_attempts_total", "grpc_client_connection_failures_total"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,164 @@
+package grpcprom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultHalfLife is the default half-life of exponentially-weighted moving averages.
+const DefaultHalfLife = 10 * time.Second
+
+// ewmaVec is a vector of gauges reporting exponentially-weighted moving averages
+// of their observed values, which decay by half each half-life. It also tracks
+// the averages of full method names, regardless of their other label values,
+// so that they may be read by load balancing code.
+type ewmaVec struct {
+	desc     *prometheus.Desc
+	halfLife time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	values  map[uint64][]*ewmaValue // hash of label values => values
+	methods map[string]*ewmaValue   // full method name => value
+}
+
+type ewmaValue struct {
+	lvs  []string
+	avg  float64
+	last time.Time // zero until observed
+}
+
+// observe updates the average with the value. It must be called with m.mu held.
+func (v *ewmaValue) observe(value, halfLife float64, now time.Time) {
+	if v.last.IsZero() {
+		v.avg, v.last = value, now
+		return
+	}
+	if dt := now.Sub(v.last).Seconds(); dt > 0 {
+		alpha := 1 - math.Exp2(-dt/halfLife)
+		v.avg += alpha * (value - v.avg)
+		v.last = now
+	} else {
+		// Concurrent observations are averaged as if they were a moment apart.
+		v.avg += (value - v.avg) / 2
+	}
+}
+
+func newLatencyEWMA(subsys string, ms *metricSet, prefix []string, opts metricOptions) *ewmaVec {
+	if opts.disable {
+		return nil
+	}
+	halfLife := opts.halfLife
+	if halfLife <= 0 {
+		halfLife = DefaultHalfLife
+	}
+	ms.setAggMode("latency_ewma_seconds", aggMax)
+	return &ewmaVec{
+		desc: ms.desc(
+			dto.MetricType_GAUGE,
+			"latency_ewma_seconds",
+			fmt.Sprintf("Exponentially-weighted moving average latency of gRPC %s requests.", subsys),
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		),
+		halfLife: halfLife,
+		now:      time.Now,
+		values:   make(map[uint64][]*ewmaValue),
+		methods:  make(map[string]*ewmaValue),
+	}
+}
+
+// get returns the value with the label values. It must be called with m.mu held.
+func (m *ewmaVec) get(lvs []string) *ewmaValue {
+	h := hashLabelValues(lvs)
+	for _, v := range m.values[h] {
+		if equalLabelValues(v.lvs, lvs) {
+			return v
+		}
+	}
+	v := &ewmaValue{lvs: append([]string(nil), lvs...)}
+	m.values[h] = append(m.values[h], v)
+	return v
+}
+
+// With returns an observer of the method with the label values.
+// A nil ewmaVec returns a no-op observer.
+func (m *ewmaVec) With(method string, lvs []string) prometheus.Observer {
+	if m == nil {
+		return noopChildObserver
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.methods[method]
+	if v == nil {
+		v = &ewmaValue{}
+		m.methods[method] = v
+	}
+	return &ewmaChild{m: m, v: m.get(lvs), method: v}
+}
+
+// duration returns the average of the full method name in seconds
+// as a duration, if it's been observed.
+func (m *ewmaVec) duration(method string) (time.Duration, bool) {
+	if m == nil {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.methods[method]
+	if !ok || v.last.IsZero() {
+		return 0, false
+	}
+	return time.Duration(v.avg * float64(time.Second)), true
+}
+
+func (m *ewmaVec) Describe(ch chan<- *prometheus.Desc) {
+	if m != nil {
+		ch <- m.desc
+	}
+}
+
+// Collect sends a snapshot of the values, so that observations
+// aren't blocked while the metrics are sent.
+func (m *ewmaVec) Collect(ch chan<- prometheus.Metric) {
+	if m == nil {
+		return
+	}
+	type sample struct {
+		lvs []string
+		avg float64
+	}
+	m.mu.Lock()
+	samples := make([]sample, 0, len(m.values))
+	for _, vs := range m.values {
+		for _, v := range vs {
+			if !v.last.IsZero() {
+				samples = append(samples, sample{v.lvs, v.avg})
+			}
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range samples {
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, s.avg, s.lvs...)
+	}
+}
+
+// ewmaChild is a child of an ewmaVec.
+type ewmaChild struct {
+	m      *ewmaVec
+	v      *ewmaValue
+	method *ewmaValue
+}
+
+func (c *ewmaChild) Observe(value float64) {
+	now := c.m.now()
+	halfLife := c.m.halfLife.Seconds()
+	c.m.mu.Lock()
+	c.v.observe(value, halfLife, now)
+	c.method.observe(value, halfLife, now)
+	c.m.mu.Unlock()
+}
@@ -0,0 +1,101 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+)
+
+// An ExtraLabelsFunc returns the values of extra labels for the RPC
+// with the context and full method name (e.g. "/pkg.Service/Method").
+// It must return a value for each label.
+type ExtraLabelsFunc func(ctx context.Context, fullMethod string) []string
+
+// labeledChildren caches the child metrics of methods with codes for each
+// custom code label value and set of trailing label values, which are the
+// peer and the extra labels. A nil labeledChildren labels nothing.
+type labeledChildren struct {
+	n       int // number of trailing labels
+	extract ExtraLabelsFunc
+	warned  atomic.Bool // extract returned the wrong number of values
+
+	mu       sync.RWMutex
+	children map[labeledChildrenKey]*codeChildren
+}
+
+type labeledChildrenKey struct {
+	info   *methodInfo
+	code   codes.Code
+	codeLv string // custom code label value
+	lvs    string // joined trailing label values
+}
+
+func newLabeledChildren(peer bool, extra []string, extract ExtraLabelsFunc, mapper CodeMapperFunc) *labeledChildren {
+	n := len(extra)
+	if peer {
+		n++
+	}
+	if n == 0 && mapper == nil {
+		return nil
+	}
+	return &labeledChildren{
+		n:        n,
+		extract:  extract,
+		children: make(map[labeledChildrenKey]*codeChildren),
+	}
+}
+
+// initLabels returns the empty trailing label values with which metrics are initialized.
+func (l *labeledChildren) initLabels() []string {
+	if l == nil {
+		return nil
+	}
+	return make([]string, l.n)
+}
+
+// trailingLabels returns the trailing label values of the RPC with the context.
+// If the extra labels are invalid, their values are empty.
+func (h *handler) trailingLabels(ctx context.Context, info *methodInfo) []string {
+	lvs := make([]string, 0, h.labeled.n)
+	if h.peers != nil {
+		lvs = append(lvs, h.peerLabel(ctx))
+	}
+	if h.labeled.extract != nil {
+		n := h.labeled.n - len(lvs)
+		if extra := h.labeled.extract(ctx, info.name); len(extra) == n {
+			lvs = append(lvs, extra...)
+		} else {
+			if !h.labeled.warned.Swap(true) {
+				h.log.Warn("grpcprom: extra labels function returned the wrong number of values; they're labeled empty",
+					"method", info.name, "got", len(extra), "want", n)
+			}
+			lvs = append(lvs, make([]string, n)...)
+		}
+	}
+	return lvs
+}
+
+// labeledCodeChildren returns the child metrics of the method with the code,
+// the custom code label value, if any, and the trailing label values of the
+// RPC with the context.
+func (h *handler) labeledCodeChildren(ctx context.Context, info *methodInfo, c codes.Code, codeLv string) *codeChildren {
+	lvs := h.trailingLabels(ctx, info)
+	key := labeledChildrenKey{info, c, codeLv, strings.Join(lvs, "\xff")}
+	h.labeled.mu.RLock()
+	m, ok := h.labeled.children[key]
+	h.labeled.mu.RUnlock()
+	if ok {
+		return m
+	}
+	m = h.newCodeChildren(info, c, codeLv, lvs)
+	h.labeled.mu.Lock()
+	defer h.labeled.mu.Unlock()
+	if v, ok := h.labeled.children[key]; ok {
+		return v
+	}
+	h.labeled.children[key] = m
+	return m
+}
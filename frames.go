@@ -0,0 +1,113 @@
+package grpcprom
+
+// HTTP/2 frames inspected by connection wrappers.
+const (
+	frameData      = 0x0
+	frameHeaders   = 0x1
+	frameRSTStream = 0x3
+	frameSettings  = 0x4
+	framePing      = 0x6
+	frameGoAway    = 0x7
+
+	flagAck = 0x1
+
+	errCodeNo              = 0x0
+	errCodeEnhanceYourCalm = 0xb
+
+	maxFramePayload = 64
+
+	// maxSettingsPayload is the maximum payload of the first SETTINGS frame,
+	// which may not exceed the initial maximum frame size.
+	maxSettingsPayload = 1 << 14
+)
+
+// clientPreface is the HTTP/2 client connection preface,
+// which precedes the frames sent by clients.
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// A frameScanner scans the HTTP/2 frames of one direction of a connection.
+// It must only be used by a single reader or writer.
+//
+// Frames can only be inspected on plaintext connections. If the connection is
+// encrypted, such as by gRPC's transport credentials, its bytes aren't frames,
+// so the scanner verifies that the direction starts with the client preface,
+// if given, and a SETTINGS frame, as HTTP/2 requires. Otherwise, it stops
+// scanning for good rather than reporting frames made of garbage.
+type frameScanner struct {
+	preface string                                // remainder of the preface expected before the first frame
+	keep    func(typ byte) bool                   // reports whether to keep payloads of the type
+	frame   func(typ, flags byte, payload []byte) // called with each complete frame
+
+	started bool // the first frame was verified
+	stopped bool // the direction isn't plaintext HTTP/2
+
+	hdr     [9]byte
+	hdrLen  int
+	left    int
+	payload []byte // up to maxFramePayload bytes, if kept
+}
+
+// scan scans the bytes of the connection.
+func (s *frameScanner) scan(b []byte) {
+	if s.stopped {
+		return
+	}
+	if n := len(s.preface); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		if string(b[:n]) != s.preface[:n] {
+			s.stopped = true
+			return
+		}
+		s.preface = s.preface[n:]
+		b = b[n:]
+	}
+	for len(b) > 0 {
+		if s.hdrLen < len(s.hdr) {
+			n := copy(s.hdr[s.hdrLen:], b)
+			s.hdrLen += n
+			b = b[n:]
+			if s.hdrLen < len(s.hdr) {
+				return
+			}
+			s.left = int(s.hdr[0])<<16 | int(s.hdr[1])<<8 | int(s.hdr[2])
+			s.payload = s.payload[:0]
+			if !s.started {
+				if !firstFrame(s.hdr, s.left) {
+					s.stopped = true
+					return
+				}
+				s.started = true
+			}
+		}
+		n := s.left
+		if n > len(b) {
+			n = len(b)
+		}
+		if s.keep(s.hdr[3]) {
+			if m := maxFramePayload - len(s.payload); m < n {
+				s.payload = append(s.payload, b[:m]...)
+			} else {
+				s.payload = append(s.payload, b[:n]...)
+			}
+		}
+		s.left -= n
+		b = b[n:]
+		if s.left == 0 {
+			s.frame(s.hdr[3], s.hdr[4], s.payload)
+			s.hdrLen = 0
+		}
+	}
+}
+
+// firstFrame reports whether the header and length are those of the first
+// frame of an HTTP/2 connection: a SETTINGS frame without the ACK flag on
+// stream zero, whose payload is a whole number of settings.
+func firstFrame(hdr [9]byte, length int) bool {
+	return hdr[3] == frameSettings &&
+		hdr[4]&flagAck == 0 &&
+		hdr[5]|hdr[6]|hdr[7]|hdr[8] == 0 &&
+		length%6 == 0 &&
+		length <= maxSettingsPayload
+}
@@ -0,0 +1,138 @@
+package grpcprom
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// goAwayConns counts the first HTTP/2 GOAWAY frame of each connection by its
+// error code: those read by clients and those written by servers. Servers may
+// write two frames to drain a connection gracefully, so only the first is
+// counted. A nil goAwayConns does nothing.
+type goAwayConns struct {
+	client bool
+	vec    *prometheus.CounterVec
+	total  [len(h2ErrCodes) + 1]prometheus.Counter // code or unknown
+}
+
+func newGoAway(subsys string, ms *metricSet, opts metricOptions) *goAwayConns {
+	if opts.disable {
+		return nil
+	}
+	name, help := "goaway_sent_total", "Total number of gRPC server connections drained by sending an HTTP/2 GOAWAY frame."
+	if subsys == "client" {
+		name, help = "goaway_received_total", "Total number of gRPC client connections which received an HTTP/2 GOAWAY frame."
+	}
+	g := &goAwayConns{
+		client: subsys == "client",
+		vec: ms.counterVec(
+			prometheus.CounterOpts{
+				Name: name,
+				Help: help,
+			},
+			[]string{"grpc_http2_error"},
+		),
+	}
+	for code, codeLv := range h2ErrCodes {
+		g.total[code] = g.vec.WithLabelValues(codeLv)
+	}
+	g.total[len(h2ErrCodes)] = g.vec.WithLabelValues("UNKNOWN")
+	return g
+}
+
+func (g *goAwayConns) listener(lis net.Listener) net.Listener {
+	if g == nil {
+		return lis
+	}
+	return &goAwayListener{Listener: lis, g: g}
+}
+
+func (g *goAwayConns) dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	if g == nil {
+		return dial
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return g.track(conn), nil
+	}
+}
+
+// track returns the connection with the frames read by a client
+// or written by a server scanned. Both start with the server's SETTINGS
+// frame, and nothing is counted for a connection without it, such as
+// one encrypted by gRPC's transport credentials.
+func (g *goAwayConns) track(conn net.Conn) net.Conn {
+	c := &goAwayConn{Conn: conn, g: g}
+	c.frames = frameScanner{keep: keepGoAway, frame: c.frame}
+	return c
+}
+
+func keepGoAway(typ byte) bool { return typ == frameGoAway }
+
+func (g *goAwayConns) Describe(ch chan<- *prometheus.Desc) {
+	if g != nil {
+		g.vec.Describe(ch)
+	}
+}
+
+func (g *goAwayConns) Collect(ch chan<- prometheus.Metric) {
+	if g != nil {
+		g.vec.Collect(ch)
+	}
+}
+
+type goAwayListener struct {
+	net.Listener
+	g *goAwayConns
+}
+
+func (lis *goAwayListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return lis.g.track(conn), nil
+}
+
+type goAwayConn struct {
+	net.Conn
+	g      *goAwayConns
+	frames frameScanner // guarded by the single reader or writer
+	seen   bool         // guarded by the single reader or writer
+}
+
+func (c *goAwayConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.g.client {
+		c.frames.scan(b[:n])
+	}
+	return n, err
+}
+
+func (c *goAwayConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if !c.g.client {
+		c.frames.scan(b[:n])
+	}
+	return n, err
+}
+
+// frame counts the connection's first GOAWAY frame by its error code,
+// which follows the last stream ID.
+func (c *goAwayConn) frame(typ, flags byte, payload []byte) {
+	if typ != frameGoAway || len(payload) < 8 || c.seen {
+		return
+	}
+	c.seen = true
+	code := binary.BigEndian.Uint32(payload[4:])
+	if code > uint32(len(h2ErrCodes)) {
+		code = uint32(len(h2ErrCodes))
+	}
+	c.g.total[code].Inc()
+}
@@ -0,0 +1,95 @@
+package grpcprom
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+func TestGoAwaySent(t *testing.T) {
+	m := NewServerMetrics(GoAwayTotal(Enable()))
+	server, client := net.Pipe()
+	defer client.Close()
+	conn, err := m.Listener(&pipeListener{conn: server}).Accept()
+	check(t, err)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.Discard, client)
+	}()
+	// A graceful drain writes two frames, which are counted once.
+	fr := http2.NewFramer(conn, nil)
+	check(t, fr.WriteSettings())
+	check(t, fr.WriteGoAway(1<<31-1, http2.ErrCodeNo, nil))
+	check(t, fr.WriteGoAway(1, http2.ErrCodeNo, nil))
+	conn.Close()
+	<-done
+
+	g := m.handler.goAway
+	if got := testutil.ToFloat64(g.total[http2.ErrCodeNo]); got != 1 {
+		t.Errorf("goaway_sent_total{NO_ERROR} = %v; want 1", got)
+	}
+	if n := testutil.CollectAndCount(m, "grpc_server_goaway_sent_total"); n != len(h2ErrCodes)+1 {
+		t.Errorf("goaway_sent_total series = %d; want %d", n, len(h2ErrCodes)+1)
+	}
+}
+
+func TestGoAwayReceived(t *testing.T) {
+	m := NewClientMetrics(GoAwayTotal(Enable()))
+	server, client := net.Pipe()
+	defer server.Close()
+	dial := m.Dialer(func(context.Context, string) (net.Conn, error) { return client, nil })
+	conn, err := dial(context.Background(), "pipe")
+	check(t, err)
+	defer conn.Close()
+
+	go func() {
+		fr := http2.NewFramer(server, nil)
+		fr.WriteSettings()
+		fr.WriteGoAway(1, http2.ErrCodeEnhanceYourCalm, []byte("too_many_pings"))
+		server.Close()
+	}()
+	_, err = io.Copy(io.Discard, conn)
+	check(t, err)
+
+	g := m.handler.goAway
+	if got := testutil.ToFloat64(g.total[http2.ErrCodeEnhanceYourCalm]); got != 1 {
+		t.Errorf("goaway_received_total{ENHANCE_YOUR_CALM} = %v; want 1", got)
+	}
+}
+
+func TestGoAwayEncrypted(t *testing.T) {
+	m := NewServerMetrics(GoAwayTotal(Enable()))
+	server, client := net.Pipe()
+	defer client.Close()
+	conn, err := m.Listener(&pipeListener{conn: server}).Accept()
+	check(t, err)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.Discard, client)
+	}()
+	// Without a leading SETTINGS frame, such as when a TLS handshake record
+	// comes first, the frames that follow aren't counted.
+	_, err = conn.Write([]byte{0x16, 0x03, 0x03, 0x00, 0x00})
+	check(t, err)
+	fr := http2.NewFramer(conn, nil)
+	check(t, fr.WriteSettings())
+	check(t, fr.WriteGoAway(1, http2.ErrCodeEnhanceYourCalm, nil))
+	conn.Close()
+	<-done
+
+	for code, c := range m.handler.goAway.total {
+		if got := testutil.ToFloat64(c); got != 0 {
+			t.Errorf("goaway_sent_total{%v} of encrypted connection = %v; want 0", http2.ErrCode(code), got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package grpcpromtest provides helpers for testing the metrics exported by
+// grpcprom, such as to lock down an application's gRPC metric schema in CI
+// with golden exposition-format files.
+package grpcpromtest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("grpcprom.update", false, "update golden files of gRPC metrics")
+
+// Gather returns the metric families collected from c, such as a grpcprom
+// ServerMetrics or ClientMetrics, sorted by name. If names are given, only
+// the families with those names are returned. Volatile values are normalized:
+// the sums of durations are zero, every observation is in the first bucket
+// of duration histograms, and duration gauges and counters are zero.
+func Gather(c prometheus.Collector, names ...string) ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		keep := make(map[string]bool, len(names))
+		for _, name := range names {
+			keep[name] = true
+		}
+		filtered := mfs[:0]
+		for _, mf := range mfs {
+			if keep[mf.GetName()] {
+				filtered = append(filtered, mf)
+			}
+		}
+		mfs = filtered
+	}
+	for _, mf := range mfs {
+		normalize(mf)
+	}
+	return mfs, nil
+}
+
+// Format returns the metric families collected from c in the text
+// exposition format, as returned by Gather.
+func Format(c prometheus.Collector, names ...string) ([]byte, error) {
+	mfs, err := Gather(c, names...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// CompareGolden compares the metric families collected from c, as formatted
+// by Format, with the golden file at path. If the -grpcprom.update flag is set,
+// the golden file is written instead.
+func CompareGolden(t testing.TB, c prometheus.Collector, path string, names ...string) {
+	t.Helper()
+	got, err := Format(c, names...)
+	if err != nil {
+		t.Fatalf("grpcpromtest: failed to format metrics: %v", err)
+	}
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("grpcpromtest: failed to create golden file directory: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("grpcpromtest: failed to write golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("grpcpromtest: failed to read golden file (update with -grpcprom.update): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("grpcpromtest: metrics differ from golden file %s (update with -grpcprom.update):\n%s", path, diff(string(want), string(got)))
+	}
+}
+
+// normalize normalizes the volatile values of the metric family.
+func normalize(mf *dto.MetricFamily) {
+	if !isDuration(mf.GetName()) {
+		return
+	}
+	zero := func() *float64 { v := 0.0; return &v }
+	for _, m := range mf.Metric {
+		switch {
+		case m.Histogram != nil:
+			m.Histogram.SampleSum = zero()
+			for _, b := range m.Histogram.Bucket {
+				b.CumulativeCount = m.Histogram.SampleCount
+				b.CumulativeCountFloat = nil
+				b.Exemplar = nil
+			}
+		case m.Summary != nil:
+			m.Summary.SampleSum = zero()
+			for _, q := range m.Summary.Quantile {
+				q.Value = zero()
+			}
+		case m.Gauge != nil:
+			m.Gauge.Value = zero()
+		case m.Counter != nil:
+			if !strings.HasSuffix(mf.GetName(), "_count") {
+				m.Counter.Value = zero()
+				m.Counter.Exemplar = nil
+			}
+		}
+		m.TimestampMs = nil
+	}
+}
+
+// isDuration returns true if the metric's values are durations or times.
+func isDuration(name string) bool {
+	return strings.Contains(name, "_seconds")
+}
+
+// diff returns the lines of want and got that differ.
+func diff(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	inWant := make(map[string]bool, len(wantLines))
+	for _, l := range wantLines {
+		inWant[l] = true
+	}
+	inGot := make(map[string]bool, len(gotLines))
+	for _, l := range gotLines {
+		inGot[l] = true
+	}
+	var buf strings.Builder
+	for _, l := range wantLines {
+		if !inGot[l] {
+			fmt.Fprintf(&buf, "- %s\n", l)
+		}
+	}
+	for _, l := range gotLines {
+		if !inWant[l] {
+			fmt.Fprintf(&buf, "+ %s\n", l)
+		}
+	}
+	return buf.String()
+}
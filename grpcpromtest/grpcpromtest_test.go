@@ -0,0 +1,55 @@
+package grpcpromtest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"bursavich.dev/grpcprom"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+func serve(m *grpcprom.ServerMetrics, code codes.Code, latency time.Duration) {
+	sh := m.StatsHandler()
+	ctx := sh.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	begin := time.Now()
+	sh.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+	time.Sleep(latency)
+	sh.HandleRPC(ctx, &stats.End{BeginTime: begin, EndTime: time.Now(), Error: status.Error(code, "")})
+}
+
+func TestCompareGolden(t *testing.T) {
+	m := grpcprom.NewServerMetrics(grpcprom.LatencyMaxSeconds(grpcprom.Enable()))
+	serve(m, codes.OK, time.Millisecond)
+	serve(m, codes.NotFound, 3*time.Millisecond)
+	CompareGolden(t, m, "testdata/server.golden",
+		"grpc_server_latency_seconds",
+		"grpc_server_latency_max_seconds",
+		"grpc_server_requests_total",
+	)
+}
+
+func TestGather(t *testing.T) {
+	m := grpcprom.NewServerMetrics(grpcprom.LatencySeconds(grpcprom.NoBuckets()))
+	serve(m, codes.OK, time.Millisecond)
+	mfs, err := Gather(m, "grpc_server_latency_seconds_count", "grpc_server_latency_seconds_sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 2 {
+		t.Fatalf("unexpected families: got: %d; want: 2", len(mfs))
+	}
+	for _, mf := range mfs {
+		got := mf.Metric[0].GetCounter().GetValue()
+		want := 0.0
+		if strings.HasSuffix(mf.GetName(), "_count") {
+			want = 1
+		}
+		if got != want {
+			t.Errorf("unexpected %s: got: %v; want: %v", mf.GetName(), got, want)
+		}
+	}
+}
@@ -2,16 +2,29 @@ package grpcprom
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
 )
 
 const (
@@ -20,6 +33,15 @@ const (
 	trailer = "Trailer"
 )
 
+const (
+	headerFrame = iota
+	payloadFrame
+	trailerFrame
+	numFrames
+)
+
+var frames = [numFrames]string{header, payload, trailer}
+
 const (
 	unknown      = "Unknown"
 	unary        = "Unary"
@@ -29,134 +51,682 @@ const (
 )
 
 type handler struct {
-	methods sync.Map // name => info
+	serverLabel   bool
+	infra         infraMode
+	fallback      [2]string // service and method labels of unparseable methods
+	parser        MethodParserFunc
+	skip          SkipFunc
+	filter        func(fullMethod string) bool
+	methodLabels  int // number of labels returned by the parser
+	errorsOnly    bool
+	uncompressed  [2]bool // recv, sent payload sizes
+	deadlineLabel bool
+	codeClass     bool // label requests by code class instead of code
+	codeMapper    CodeMapperFunc
+	pprofLabels   bool
+	traceTasks    bool
+	log           Logger
+	callers       *callerSet
+	peers         *peerSet
+	labeled       *labeledChildren
+	anomalies     *anomalyHook
+	accessLog     func(context.Context, accessRecord)
+	subs          subscribers
+	hooks         observerHooks
+	registerer    prometheus.Registerer
+	metrics       *metricSet // records the metadata of metrics
+
+	initMu  sync.Mutex                                // serializes init
+	mu      sync.Mutex                                // serializes stores of methods
+	methods atomic.Pointer[map[methodKey]*methodInfo] // copied on write
+	strs    map[string]string                         // interned strings, guarded by mu
+
+	pendingCounts pendingCounts
 
-	connsOpen   prometheus.Gauge
-	connsTotal  prometheus.Counter
-	reqsPending gaugeVec
-	reqsTotal   counterVec
-	latency     observer
-	sentBytes   observer
-	recvBytes   observer
+	conns       sync.Map // connAddrs => *connInfo
+	connsByAddr sync.Map // remote *net.TCPAddr => *connInfo, for lookups without allocation
+
+	connsOpen      prometheus.Gauge
+	connsTotal     prometheus.Counter
+	connsIdle      prometheus.Gauge
+	connsIdleTime  observer
+	reqsPending    gaugeVec
+	handlers       gaugeVec
+	streamsOpen    gaugeVec
+	streamMsgsOpen gaugeVec
+	reqsPendingMax adder
+	reqsTotal      counterVec
+	reqsRejected   counterVec
+	reqsCanceled   counterVec
+	canceledBy     counterVec
+	authFailures   counterVec
+	attempts       counterVec
+	deprecated     counterVec
+	trailersOnly   counterVec
+	latency        observer
+	latencyMax     observer
+	latencyEWMA    *ewmaVec
+	timeout        observer
+	noDeadline     counterVec
+	pickDelay      observer
+	opDuration     observer
+	lastError      gaugeVec
+	sentBytes      observer
+	recvBytes      observer
+	reqSize        observer
+	mdBytes        *metadataObserver
+	mdEntries      *metadataObserver
+	respSize       observer
+	reqMsgs        observer
+	reqAttempts    observer
+	retryAttempts  counterVec
+	transparent    counterVec
+	upload         observer
+	msgsTotal      counterVec
+	sizeRatio      observer
+	deadlineUtil   observer
+	msgAge         *msgAgeCollector
+	stale          *staleCollector
+	oversized      *oversizeCounter
+	topK           *topKCollector
+	locality       *localityCollector
+	breakerState   gaugeVec
+	healthStatus   gaugeVec
+	connFailures   counterVec
+	connAttempts   counterVec
+	backoffs       *backoffs
+	tcpConns       *tcpConns
+	keepalive      *keepaliveConns
+	rst            *rstConns
+	goAway         *goAwayConns
+	cpuTime        *cpuTimer
+	derived        *derivedCollector
+	overhead       *overheadTimer
+	compat         *compatMetrics
 }
 
 func newMetrics(subsys string, opts ...Option) *handler {
+	return newHandler(subsys, newOptions(subsys, opts...))
+}
+
+// newOptions returns the options of the subsystem, which are the defaults
+// with the given options applied.
+func newOptions(subsys string, opts ...Option) *options {
 	o := &options{
+		logger:    noopLogger{},
+		namespace: defaultNamespace,
+		fallback:  [2]string{unknown, unknown},
+		connsIdleTime: histogramOptions{
+			buckets: DefaultConnectionIdleBuckets,
+		},
 		latency: histogramOptions{
-			buckets: DefaultLatencyBuckets,
+			buckets: DefaultServerLatencyBuckets,
+		},
+		latencyMax: metricOptions{
+			disable: true,
+		},
+		latencyEWMA: metricOptions{
+			disable: true,
+		},
+		timeout: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultClientLatencyBuckets,
+		},
+		noDeadline: metricOptions{
+			disable: true,
+		},
+		canceledBy: metricOptions{
+			disable: true,
+		},
+		pickDelay: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultServerLatencyBuckets,
+		},
+		opDuration: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultServerLatencyBuckets,
+		},
+		reqMsgs: histogramOptions{
+			buckets: DefaultMessageBuckets,
+		},
+		reqAttempts: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultAttemptBuckets,
+		},
+		retryAttempts: metricOptions{
+			disable: true,
+		},
+		transparent: metricOptions{
+			disable: true,
+		},
+		connAttempts: metricOptions{
+			disable: true,
+		},
+		backoffs: histogramOptions{
+			buckets: DefaultBackoffBuckets,
 		},
+		upload: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultServerLatencyBuckets,
+		},
+		msgsTotal: metricOptions{
+			disable: true,
+		},
+		reqSize: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultRPCSizeBuckets,
+		},
+		mdBytes: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultBytesBuckets,
+		},
+		mdEntries: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultMetadataEntryBuckets,
+		},
+		respSize: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultRPCSizeBuckets,
+		},
+		deadlineUtil: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultDeadlineUtilizationBuckets,
+		},
+		sizeRatio: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultSizeRatioBuckets,
+		},
+		reqsPendingMax: metricOptions{
+			disable: true,
+		},
+		lastError: metricOptions{
+			disable: true,
+		},
+		cpuTime: metricOptions{
+			disable: true,
+		},
+		handlers: metricOptions{
+			disable: true,
+		},
+		streamsOpen: metricOptions{
+			disable: true,
+		},
+		streamMsgsOpen: metricOptions{
+			disable: true,
+		},
+		keepalive: metricOptions{
+			disable: true,
+		},
+		rst: metricOptions{
+			disable: true,
+		},
+		goAway: metricOptions{
+			disable: true,
+		},
+		compat: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       prometheus.DefBuckets,
+		},
+		overhead: histogramOptions{
+			metricOptions: metricOptions{disable: true},
+			buckets:       DefaultOverheadBuckets,
+		},
+	}
+	if subsys == "client" {
+		o.latency.buckets = DefaultClientLatencyBuckets
+		o.upload.buckets = DefaultClientLatencyBuckets
 	}
 	for _, opt := range opts {
 		opt.applyOption(o)
 	}
-	return &handler{
-		connsOpen:   newConnsOpen(subsys, o.connsOpen),
-		connsTotal:  newConnsTotal(subsys, o.connsTotal),
-		reqsPending: newReqsPending(subsys, o.reqsPending),
-		reqsTotal:   newReqsTotal(subsys, o.reqsTotal),
-		latency:     newLatency(subsys, o.latency),
-		sentBytes:   newSentBytes(subsys, o.sentBytes),
-		recvBytes:   newRecvBytes(subsys, o.recvBytes),
+	return o
+}
+
+func newHandler(subsys string, o *options) *handler {
+	var prefix []string
+	if subsys == "client" {
+		// Client requests are labeled by connection instead of server.
+		o.serverLabel = o.connLabel
+	}
+	if o.serverLabel {
+		if subsys == "client" {
+			prefix = append(prefix, "grpc_conn")
+		} else {
+			prefix = append(prefix, "grpc_server")
+		}
+	}
+	if subsys != "server" {
+		o.caller = nil
+		o.peerLabel = false
+	}
+	if o.caller != nil {
+		prefix = append(prefix, "grpc_caller")
+	}
+	codeLabel := "grpc_code"
+	if o.codeClass {
+		codeLabel = "grpc_code_class"
 	}
+	var totalLabels, latencyLabels []string
+	if o.deadlineLabel {
+		totalLabels = append(totalLabels, "grpc_deadline")
+	}
+	if o.peerLabel {
+		totalLabels = append(totalLabels, "grpc_peer")
+		latencyLabels = append(latencyLabels, "grpc_peer")
+	}
+	if o.extractLabels == nil {
+		o.extraLabels = nil
+	}
+	totalLabels = append(totalLabels, o.extraLabels...)
+	latencyLabels = append(latencyLabels, o.extraLabels...)
+	if o.methodParser != nil {
+		prefix = append(prefix, o.methodLabels...)
+	}
+	ms := newMetricSet(o.namespace, subsystemName(o.subsysPrefix, subsys))
+	h := &handler{
+		serverLabel:    o.serverLabel,
+		infra:          o.infra,
+		fallback:       o.fallback,
+		parser:         o.methodParser,
+		skip:           filterSkip(o.filter, o.skip),
+		filter:         o.filter,
+		methodLabels:   len(o.methodLabels),
+		errorsOnly:     o.errorsOnly,
+		uncompressed:   [2]bool{o.recvBytes.uncompressed, o.sentBytes.uncompressed},
+		deadlineLabel:  o.deadlineLabel,
+		codeClass:      o.codeClass,
+		pprofLabels:    o.pprofLabels,
+		traceTasks:     o.traceTasks,
+		log:            o.logger,
+		callers:        newCallerSet(o.caller, o.maxCallers, o.logger),
+		peers:          newPeerSet(o.peerLabel, o.maxPeers, o.logger),
+		labeled:        newLabeledChildren(o.peerLabel, o.extraLabels, o.extractLabels, o.codeMapper),
+		codeMapper:     o.codeMapper,
+		anomalies:      newAnomalyHook(o.anomalyRule, o.anomalyFn),
+		accessLog:      o.accessLog,
+		hooks:          o.hooks,
+		registerer:     o.registerer,
+		metrics:        ms,
+		strs:           make(map[string]string),
+		connsOpen:      newConnsOpen(subsys, ms, o.connsOpen),
+		connsTotal:     newConnsTotal(subsys, ms, o.connsTotal),
+		connsIdle:      newConnsIdle(subsys, ms, o.connsIdle),
+		connsIdleTime:  newConnsIdleTime(subsys, ms, o.connsIdleTime),
+		reqsPending:    newReqsPending(subsys, ms, prefix, o.reqsPending),
+		handlers:       newHandlersRunning(subsys, ms, prefix, o.handlers),
+		streamsOpen:    newStreamsOpen(subsys, ms, prefix, o.streamsOpen),
+		streamMsgsOpen: newStreamMsgsOpen(subsys, ms, prefix, o.streamMsgsOpen),
+		reqsPendingMax: newReqsPendingMax(subsys, ms, prefix, o.reqsPendingMax),
+		reqsTotal:      newReqsTotal(subsys, ms, prefix, codeLabel, totalLabels, o.reqsTotal),
+		reqsRejected:   newReqsRejected(subsys, ms, prefix, o.reqsRejected),
+		reqsCanceled:   newReqsCanceled(subsys, ms, prefix, o.reqsCanceled),
+		canceledBy:     newCanceledByCause(subsys, ms, prefix, o.canceledBy),
+		authFailures:   newAuthFailures(subsys, ms, prefix, o.authFailures),
+		attempts:       newAttempts(subsys, ms, prefix, o.attempts),
+		deprecated:     newDeprecated(subsys, ms, prefix, o.deprecated),
+		trailersOnly:   newTrailersOnly(subsys, ms, prefix, o.trailersOnly),
+		latency:        newLatency(subsys, ms, prefix, codeLabel, latencyLabels, o.latency),
+		latencyMax:     newLatencyMax(subsys, ms, prefix, o.latencyMax),
+		latencyEWMA:    newLatencyEWMA(subsys, ms, prefix, o.latencyEWMA),
+		timeout:        newTimeout(subsys, ms, prefix, o.timeout),
+		noDeadline:     newNoDeadline(subsys, ms, prefix, o.noDeadline),
+		pickDelay:      newPickDelay(subsys, ms, prefix, o.pickDelay),
+		opDuration:     newOpDuration(subsys, ms, prefix, o.opDuration),
+		lastError:      newLastError(subsys, ms, prefix, o.lastError),
+		sentBytes:      newSentBytes(subsys, ms, prefix, o.sentBytes),
+		recvBytes:      newRecvBytes(subsys, ms, prefix, o.recvBytes),
+		reqSize:        newRPCSize(subsys, ms, prefix, "request", o.reqSize),
+		mdBytes:        newMetadataBytes(subsys, ms, prefix, o.mdBytes),
+		mdEntries:      newMetadataEntries(subsys, ms, prefix, o.mdEntries),
+		respSize:       newRPCSize(subsys, ms, prefix, "response", o.respSize),
+		reqMsgs:        newReqMsgs(subsys, ms, prefix, o.reqMsgs),
+		reqAttempts:    newReqAttempts(subsys, ms, prefix, o.reqAttempts),
+		retryAttempts:  newRetryAttempts(subsys, ms, prefix, o.retryAttempts),
+		transparent:    newTransparentRetries(subsys, ms, prefix, o.transparent),
+		upload:         newUpload(subsys, ms, prefix, o.upload),
+		msgsTotal:      newMsgsTotal(subsys, ms, prefix, o.msgsTotal),
+		sizeRatio:      newSizeRatio(subsys, ms, prefix, o.sizeRatio),
+		deadlineUtil:   newDeadlineUtil(subsys, ms, prefix, o.deadlineUtil),
+		msgAge:         newMsgAge(subsys, ms, prefix, o.msgAge),
+		stale:          newStale(subsys, ms, prefix, o.stale),
+		oversized:      newOversized(subsys, ms, prefix, o.oversized),
+		topK:           newTopK(subsys, ms, o.topK, o.topKey),
+		locality:       newLocality(subsys, ms, o.locality, o.latency.buckets),
+		breakerState:   newBreakerState(subsys, ms, o.breakerState),
+		healthStatus:   newHealthStatus(subsys, ms, o.healthStatus),
+		connFailures:   newConnFailures(subsys, ms, o.connFailures),
+		connAttempts:   newConnAttempts(subsys, ms, o.connAttempts),
+		backoffs:       newReconnectBackoff(subsys, ms, o.backoffs),
+		tcpConns:       newTCPConns(subsys, ms, o.tcpInfo, tcpPeers(o), o.logger),
+		keepalive:      newKeepalive(subsys, ms, o.keepaliveParams, o.keepalive),
+		rst:            newRSTStream(subsys, ms, o.rst),
+		goAway:         newGoAway(subsys, ms, o.goAway),
+		overhead:       newOverhead(subsys, ms, o.overhead),
+		compat:         newCompat(subsys, ms, o.compat),
+	}
+	h.cpuTime = newCPUTime(h, subsys, ms, prefix, o.cpuTime)
+	h.derived = newDerived(h, subsys, ms, prefix, o.derived)
+	h.methods.Store(&map[methodKey]*methodInfo{})
+	return h
 }
 
-func newConnsOpen(subsys string, opts metricOptions) prometheus.Gauge {
+// labelNames returns the prefix labels followed by the given names.
+func labelNames(prefix []string, names ...string) []string {
+	return append(prefix[:len(prefix):len(prefix)], names...)
+}
+
+func newConnsOpen(subsys string, ms *metricSet, opts metricOptions) prometheus.Gauge {
 	if opts.disable {
 		return noopGauge{}
 	}
-	return prometheus.NewGauge(
+	return ms.gauge(
 		prometheus.GaugeOpts{
-			Namespace: "grpc",
-			Subsystem: subsys,
-			Name:      "connections_open",
-			Help:      fmt.Sprintf("Number of gRPC %s connections open.", subsys),
+			Name: "connections_open",
+			Help: fmt.Sprintf("Number of gRPC %s connections open.", subsys),
 		},
 	)
 }
 
-func newConnsTotal(subsys string, opts metricOptions) prometheus.Counter {
+func newConnsTotal(subsys string, ms *metricSet, opts metricOptions) prometheus.Counter {
 	if opts.disable {
 		return noopCounter{}
 	}
-	return prometheus.NewCounter(
+	return ms.counter(
 		prometheus.CounterOpts{
-			Namespace: "grpc",
-			Subsystem: subsys,
-			Name:      "connections_total",
-			Help:      fmt.Sprintf("Total number of gRPC %s connections opened.", subsys),
+			Name: "connections_total",
+			Help: fmt.Sprintf("Total number of gRPC %s connections opened.", subsys),
+		},
+	)
+}
+
+func newConnsIdle(subsys string, ms *metricSet, opts metricOptions) prometheus.Gauge {
+	if opts.disable {
+		return noopGauge{}
+	}
+	return ms.gauge(
+		prometheus.GaugeOpts{
+			Name: "connections_idle",
+			Help: fmt.Sprintf("Number of gRPC %s connections open without active requests.", subsys),
+		},
+	)
+}
+
+func newConnsIdleTime(subsys string, ms *metricSet, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"connection_idle_seconds",
+		fmt.Sprintf("Duration of gRPC %s connections idle periods.", subsys),
+		nil,
+		opts,
+	)
+}
+
+func newReqsPending(subsys string, ms *metricSet, prefix []string, opts metricOptions) gaugeVec {
+	if opts.disable {
+		return noopGaugeVec{}
+	}
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "requests_pending",
+			Help: fmt.Sprintf("Number of gRPC %s requests pending.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newHandlersRunning(subsys string, ms *metricSet, prefix []string, opts metricOptions) gaugeVec {
+	if opts.disable || subsys != "server" {
+		return noopGaugeVec{}
+	}
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "handlers_running",
+			Help: fmt.Sprintf("Number of gRPC %s handlers running.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newStreamsOpen(subsys string, ms *metricSet, prefix []string, opts metricOptions) gaugeVec {
+	if opts.disable {
+		return noopGaugeVec{}
+	}
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streams_open",
+			Help: fmt.Sprintf("Number of gRPC %s streams open.", subsys),
 		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 	)
 }
 
-func newReqsPending(subsys string, opts metricOptions) gaugeVec {
+func newStreamMsgsOpen(subsys string, ms *metricSet, prefix []string, opts metricOptions) gaugeVec {
 	if opts.disable {
 		return noopGaugeVec{}
 	}
-	return prometheus.NewGaugeVec(
+	return ms.gaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "grpc",
-			Subsystem: subsys,
-			Name:      "requests_pending",
-			Help:      fmt.Sprintf("Number of gRPC %s requests pending.", subsys),
+			Name: "stream_messages_open",
+			Help: fmt.Sprintf("Number of messages sent and received by open gRPC %s streams.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newReqsPendingMax(subsys string, ms *metricSet, prefix []string, opts metricOptions) adder {
+	if opts.disable {
+		return noopAdder{}
+	}
+	ms.setAggMode("requests_pending_max", aggMax)
+	return maxAdderVec{newMaxVec(
+		ms.desc(
+			dto.MetricType_GAUGE,
+			"requests_pending_max",
+			fmt.Sprintf("Maximum number of gRPC %s requests pending since last collected.", subsys),
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		),
+		true,
+	)}
+}
+
+func newReqsTotal(subsys string, ms *metricSet, prefix []string, code string, extra []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	labels := append(labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", code), extra...)
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests completed.", subsys),
+		},
+		labels,
+	)
+}
+
+func newReqsRejected(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_rejected_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests rejected before being handled.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_code"),
+	)
+}
+
+func newReqsCanceled(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable || subsys != "server" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_client_canceled_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests canceled by their clients while being handled.", subsys),
 		},
-		[]string{"grpc_type", "grpc_service", "grpc_method"},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 	)
 }
 
-func newReqsTotal(subsys string, opts metricOptions) counterVec {
+func newAttempts(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable || subsys != "client" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "attempts_total",
+			Help: fmt.Sprintf("Total number of gRPC %s request attempts completed.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_code"),
+	)
+}
+
+func newDeprecated(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
 	if opts.disable {
 		return noopCounterVec{}
 	}
-	return prometheus.NewCounterVec(
+	return newCounterVec(
+		ms,
+		opts,
 		prometheus.CounterOpts{
-			Namespace: "grpc",
-			Subsystem: subsys,
-			Name:      "requests_total",
-			Help:      fmt.Sprintf("Total number of gRPC %s requests completed.", subsys),
+			Name: "deprecated_requests_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests of deprecated methods completed.", subsys),
 		},
-		[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 	)
 }
 
-func newLatency(subsys string, opts histogramOptions) observer {
+func newTrailersOnly(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_trailers_only_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests completed with a trailers-only response.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_code"),
+	)
+}
+
+func newLatency(subsys string, ms *metricSet, prefix []string, code string, extra []string, opts histogramOptions) observer {
 	if opts.disable {
 		return noopObserver{}
 	}
-	if len(opts.buckets) > 0 {
-		return &histogram{prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "latency_seconds",
-				Help:      fmt.Sprintf("Latency of gRPC %s requests.", subsys),
-				Buckets:   opts.buckets,
+	labels := append(labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", code), extra...)
+	help := fmt.Sprintf("Latency of gRPC %s requests.", subsys)
+	if len(opts.objectives) > 0 {
+		return &summary{ms.summaryVec(
+			prometheus.SummaryOpts{
+				Name:       "latency_seconds",
+				Help:       help,
+				Objectives: opts.objectives,
 			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"},
+			labels,
 		)}
 	}
-	return &counters{
-		sum: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "latency_seconds_sum",
-				Help:      fmt.Sprintf("Latency of gRPC %s requests sum.", subsys),
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"},
-		),
-		num: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "latency_seconds_count",
-				Help:      fmt.Sprintf("Latency of gRPC %s requests count.", subsys),
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"},
+	if len(opts.buckets) > 0 {
+		defer ms.setMethodBuckets("latency_seconds", opts.methodBuckets)
+		return newMethodHistograms(opts, func(buckets []float64) observer {
+			return &histogram{ms.histogramVec(
+				prometheus.HistogramOpts{
+					Name:    "latency_seconds",
+					Help:    help,
+					Buckets: buckets,
+				},
+				labels,
+			)}
+		})
+	}
+	return newHistogramObserver(ms, "latency_seconds", help, labels, opts)
+}
+
+func newTimeout(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"timeout_seconds",
+		fmt.Sprintf("Timeout of gRPC %s requests with deadlines.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newNoDeadline(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "requests_without_deadline_total",
+			Help: fmt.Sprintf("Total number of gRPC %s requests begun without deadlines.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newPickDelay(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable || subsys != "client" {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"pick_delay_seconds",
+		fmt.Sprintf("Delay of gRPC %s request attempts before their headers are sent, including balancer picks.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newLatencyMax(subsys string, ms *metricSet, prefix []string, opts metricOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	ms.setAggMode("latency_max_seconds", aggMax)
+	return newMaxVec(
+		ms.desc(
+			dto.MetricType_GAUGE,
+			"latency_max_seconds",
+			fmt.Sprintf("Maximum latency of gRPC %s requests.", subsys),
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 		),
+		opts.reset,
+	)
+}
+
+func newLastError(subsys string, ms *metricSet, prefix []string, opts metricOptions) gaugeVec {
+	if opts.disable {
+		return noopGaugeVec{}
 	}
+	ms.setAggMode("last_error_timestamp_seconds", aggMax)
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "last_error_timestamp_seconds",
+			Help: fmt.Sprintf("Unix time of the last gRPC %s request completed with each error code.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_code"),
+	)
 }
 
-func newSentBytes(subsys string, opts histogramOptions) observer {
+func newSentBytes(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
 	if opts.disable {
 		return noopObserver{}
 	}
@@ -164,215 +734,1314 @@ func newSentBytes(subsys string, opts histogramOptions) observer {
 	if subsys == "client" {
 		typ = "requests"
 	}
-	if len(opts.buckets) > 0 {
-		return &histogram{prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "sent_bytes",
-				Help:      fmt.Sprintf("Bytes sent in gRPC %s %s.", subsys, typ),
-				Buckets:   opts.buckets,
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
-		)}
+	return newHistogramObserver(
+		ms,
+		"sent_bytes",
+		fmt.Sprintf("Bytes sent in gRPC %s %s.", subsys, typ),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_frame"),
+		opts,
+	)
+}
+
+func newRecvBytes(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
 	}
-	return &counters{
-		sum: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "sent_bytes_sum",
-				Help:      fmt.Sprintf("Bytes sent in gRPC %s %s sum.", subsys, typ),
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
+	typ := "requests"
+	if subsys == "client" {
+		typ = "responses"
+	}
+	return newHistogramObserver(
+		ms,
+		"recv_bytes",
+		fmt.Sprintf("Bytes received in gRPC %s %s.", subsys, typ),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_frame"),
+		opts,
+	)
+}
+
+func newReqMsgs(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"request_messages",
+		fmt.Sprintf("Number of messages in gRPC %s client-streaming requests.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newReqAttempts(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable || subsys != "client" {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"request_attempts",
+		fmt.Sprintf("Number of attempts of gRPC %s requests.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newRetryAttempts(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable || subsys != "client" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "retry_attempts_total",
+			Help: fmt.Sprintf("Total number of gRPC %s request attempts retried.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newTransparentRetries(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable || subsys != "client" {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "transparent_retries_total",
+			Help: fmt.Sprintf("Total number of gRPC %s request attempts retried transparently.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+	)
+}
+
+func newRPCSize(subsys string, ms *metricSet, prefix []string, typ string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		typ+"_size_bytes",
+		fmt.Sprintf("Total bytes of gRPC %s %ss.", subsys, typ),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newSizeRatio(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"response_size_ratio",
+		fmt.Sprintf("Ratio of response bytes to request bytes of gRPC %s unary requests.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newDeadlineUtil(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"deadline_utilization_ratio",
+		fmt.Sprintf("Ratio of latency to the time allotted by the deadline of gRPC %s requests.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newUpload(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"upload_seconds",
+		fmt.Sprintf("Duration from the first to the last message of gRPC %s client-streaming requests.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
+		opts,
+	)
+}
+
+func newMsgsTotal(subsys string, ms *metricSet, prefix []string, opts metricOptions) counterVec {
+	if opts.disable {
+		return noopCounterVec{}
+	}
+	return newCounterVec(
+		ms,
+		opts,
+		prometheus.CounterOpts{
+			Name: "messages_total",
+			Help: fmt.Sprintf("Total number of gRPC %s messages by direction and compression.", subsys),
+		},
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_direction", "grpc_compressed"),
+	)
+}
+
+func newMsgAge(subsys string, ms *metricSet, prefix []string, opts metricOptions) *msgAgeCollector {
+	if opts.disable || len(opts.methods) == 0 {
+		return nil
+	}
+	ms.setAggMode("last_message_age_seconds", aggMax)
+	return &msgAgeCollector{
+		desc: ms.desc(
+			dto.MetricType_GAUGE,
+			"last_message_age_seconds",
+			fmt.Sprintf("Maximum seconds since the last message of open gRPC %s streams.", subsys),
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 		),
-		num: prometheus.NewCounterVec(
+		set: newStreamSet(opts.methods),
+	}
+}
+
+func newStale(subsys string, ms *metricSet, prefix []string, opts metricOptions) *staleCollector {
+	if opts.disable || len(opts.maxAge) == 0 {
+		return nil
+	}
+	methods := make(map[string]bool, len(opts.maxAge))
+	for name := range opts.maxAge {
+		methods[name] = true
+	}
+	return &staleCollector{
+		maxAge: opts.maxAge,
+		set:    newStreamSet(methods),
+		total: newCounterVec(
+			ms,
+			opts,
 			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "sent_bytes_count",
-				Help:      fmt.Sprintf("Bytes sent in gRPC %s %s count.", subsys, typ),
+				Name: "stale_streams_total",
+				Help: fmt.Sprintf("Total number of gRPC %s streams open longer than their maximum age.", subsys),
 			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method"),
 		),
 	}
 }
 
-func newRecvBytes(subsys string, opts histogramOptions) observer {
-	if opts.disable {
-		return noopObserver{}
-	}
-	typ := "requests"
-	if subsys == "client" {
-		typ = "responses"
+// initBit is set in methodInfo.inited once the metrics without codes are initialized.
+// The lower bits are set once the metrics with the corresponding codes are initialized.
+const initBit uint32 = 1 << 31
+
+// initServer initializes the metrics of the services of srv with the given codes.
+func (h *handler) initServer(instance string, srv *grpc.Server, o initOptions) error {
+	if srv == nil {
+		return errors.New("grpcprom: nil server")
+	}
+	infos := srv.GetServiceInfo()
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		errs = append(errs, h.init(instance, name, infos[name].Methods, o))
+	}
+	return errors.Join(errs...)
+}
+
+// initServiceDesc initializes the metrics of the methods of desc with the given codes.
+func (h *handler) initServiceDesc(instance string, desc *grpc.ServiceDesc, o initOptions) error {
+	if desc == nil {
+		return errors.New("grpcprom: nil service desc")
+	}
+	methods := make([]grpc.MethodInfo, 0, len(desc.Methods)+len(desc.Streams))
+	for _, m := range desc.Methods {
+		methods = append(methods, grpc.MethodInfo{Name: m.MethodName})
+	}
+	for _, s := range desc.Streams {
+		methods = append(methods, grpc.MethodInfo{
+			Name:           s.StreamName,
+			IsClientStream: s.ClientStreams,
+			IsServerStream: s.ServerStreams,
+		})
+	}
+	return h.init(instance, desc.ServiceName, methods, o)
+}
+
+// init initializes the metrics of the methods with the given options.
+// It may be called concurrently with requests and collection, and
+// metrics which are already initialized are skipped. It returns an error
+// if there are no methods, if a method was already initialized, or if
+// a metric can't be created.
+func (h *handler) init(instance, server string, methods []grpc.MethodInfo, o initOptions) error {
+	if len(methods) == 0 {
+		return fmt.Errorf("grpcprom: service %q has no methods", server)
+	}
+	h.initMu.Lock()
+	defer h.initMu.Unlock()
+	var errs []error
+	check := func(_ interface{}, err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, meth := range methods {
+		name := "/" + server + "/" + meth.Name
+		if h.infra != includeInfra && isInfraMethod(name) {
+			continue
+		}
+		if h.filter != nil && !h.filter(name) {
+			continue
+		}
+		typ := grpcType(meth.IsClientStream, meth.IsServerStream)
+		info := h.storeMethodInfo(instance, "", name, typ)
+		if info.inited&initBit != 0 {
+			errs = append(errs, fmt.Errorf("grpcprom: method %q already initialized", name))
+		} else {
+			info.inited |= initBit
+			check(nil, h.compat.init(info, o.codes))
+			check(h.reqsPending.GetMetricWithLabelValues(info.lvs...))
+			check(h.handlers.GetMetricWithLabelValues(info.lvs...))
+			if isStream(typ) {
+				check(h.streamsOpen.GetMetricWithLabelValues(info.lvs...))
+				check(h.streamMsgsOpen.GetMetricWithLabelValues(info.lvs...))
+			}
+			check(h.reqsCanceled.GetMetricWithLabelValues(info.lvs...))
+			for _, cause := range cancelCauses {
+				check(h.canceledBy.GetMetricWithLabelValues(append(info.lvs[:len(info.lvs):len(info.lvs)], cause)...))
+			}
+			if info.deprecated {
+				check(h.deprecated.GetMetricWithLabelValues(info.lvs...))
+			}
+			check(nil, h.reqsPendingMax.Init(info.lvs...))
+			check(nil, h.latencyMax.Init(info.lvs...))
+			check(nil, h.timeout.Init(info.lvs...))
+			check(h.noDeadline.GetMetricWithLabelValues(info.lvs...))
+			check(nil, h.pickDelay.Init(info.lvs...))
+			check(nil, h.reqAttempts.Init(info.lvs...))
+			check(h.retryAttempts.GetMetricWithLabelValues(info.lvs...))
+			check(h.transparent.GetMetricWithLabelValues(info.lvs...))
+			if meth.IsClientStream {
+				check(nil, h.reqMsgs.Init(info.lvs...))
+				check(nil, h.upload.Init(info.lvs...))
+			}
+			for _, lvs := range info.frameLvs {
+				check(nil, h.sentBytes.Init(lvs...))
+				check(nil, h.recvBytes.Init(lvs...))
+			}
+			check(nil, h.mdBytes.init(info.lvs))
+			check(nil, h.mdEntries.init(info.lvs))
+		}
+		for _, c := range o.codes {
+			if c < 31 {
+				if info.inited&(1<<c) != 0 {
+					continue
+				}
+				info.inited |= 1 << c
+			}
+			for _, lvs := range h.totalInitLabels(h.requestLabels(info.codeLabels(c), c)) {
+				check(h.reqsTotal.GetMetricWithLabelValues(lvs...))
+			}
+		}
+		for _, c := range o.latency() {
+			if c < 31 {
+				if info.latencyInited&(1<<c) != 0 {
+					continue
+				}
+				info.latencyInited |= 1 << c
+			}
+			lvs := h.requestLabels(info.codeLabels(c), c)
+			if h.labeled != nil {
+				lvs = append(lvs[:len(lvs):len(lvs)], h.labeled.initLabels()...)
+			}
+			check(nil, methodObserver(h.latency, info.name).Init(lvs...))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// totalInitLabels returns the label values with which to initialize the
+// requests_total metric for the method with a code: those of every deadline
+// class, if labeled, and an empty peer and extra labels, if labeled.
+func (h *handler) totalInitLabels(lvs []string) [][]string {
+	trailing := h.labeled.initLabels()
+	if !h.deadlineLabel {
+		if len(trailing) > 0 {
+			lvs = append(lvs[:len(lvs):len(lvs)], trailing...)
+		}
+		return [][]string{lvs}
+	}
+	all := make([][]string, 0, len(deadlineClassLabels))
+	for _, lv := range deadlineClassLabels {
+		v := append(lvs[:len(lvs):len(lvs)], lv)
+		all = append(all, append(v, trailing...))
+	}
+	return all
+}
+
+func (h *handler) unusedMethods() []string {
+	used := make(map[string]bool)
+	for key, info := range *h.methods.Load() {
+		used[key.method] = used[key.method] || info.done.Load() > 0
+	}
+	var names []string
+	for name, ok := range used {
+		if !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *handler) describe(ch chan<- *prometheus.Desc) {
+	h.connsOpen.Describe(ch)
+	h.connsTotal.Describe(ch)
+	h.connsIdle.Describe(ch)
+	h.connsIdleTime.Describe(ch)
+	h.reqsPending.Describe(ch)
+	h.handlers.Describe(ch)
+	h.streamsOpen.Describe(ch)
+	h.streamMsgsOpen.Describe(ch)
+	h.reqsPendingMax.Describe(ch)
+	h.reqsTotal.Describe(ch)
+	h.reqsRejected.Describe(ch)
+	h.reqsCanceled.Describe(ch)
+	h.canceledBy.Describe(ch)
+	h.authFailures.Describe(ch)
+	h.attempts.Describe(ch)
+	h.deprecated.Describe(ch)
+	h.trailersOnly.Describe(ch)
+	h.latency.Describe(ch)
+	h.latencyMax.Describe(ch)
+	h.latencyEWMA.Describe(ch)
+	h.timeout.Describe(ch)
+	h.noDeadline.Describe(ch)
+	h.pickDelay.Describe(ch)
+	h.opDuration.Describe(ch)
+	h.lastError.Describe(ch)
+	h.sentBytes.Describe(ch)
+	h.recvBytes.Describe(ch)
+	h.reqSize.Describe(ch)
+	h.mdBytes.Describe(ch)
+	h.mdEntries.Describe(ch)
+	h.respSize.Describe(ch)
+	h.reqMsgs.Describe(ch)
+	h.reqAttempts.Describe(ch)
+	h.retryAttempts.Describe(ch)
+	h.transparent.Describe(ch)
+	h.upload.Describe(ch)
+	h.msgsTotal.Describe(ch)
+	h.sizeRatio.Describe(ch)
+	h.deadlineUtil.Describe(ch)
+	h.msgAge.Describe(ch)
+	h.stale.Describe(ch)
+	h.oversized.Describe(ch)
+	h.topK.Describe(ch)
+	h.locality.Describe(ch)
+	h.breakerState.Describe(ch)
+	h.healthStatus.Describe(ch)
+	h.connFailures.Describe(ch)
+	h.connAttempts.Describe(ch)
+	h.backoffs.Describe(ch)
+	h.tcpConns.Describe(ch)
+	h.keepalive.Describe(ch)
+	h.rst.Describe(ch)
+	h.goAway.Describe(ch)
+	h.cpuTime.Describe(ch)
+	h.derived.Describe(ch)
+	h.overhead.Describe(ch)
+	h.compat.Describe(ch)
+}
+
+func (h *handler) collect(ch chan<- prometheus.Metric) {
+	h.connsOpen.Collect(ch)
+	h.connsTotal.Collect(ch)
+	h.connsIdle.Collect(ch)
+	h.connsIdleTime.Collect(ch)
+	h.reqsPending.Collect(ch)
+	h.handlers.Collect(ch)
+	h.streamsOpen.Collect(ch)
+	h.streamMsgsOpen.Collect(ch)
+	h.reqsPendingMax.Collect(ch)
+	h.reqsTotal.Collect(ch)
+	h.reqsRejected.Collect(ch)
+	h.reqsCanceled.Collect(ch)
+	h.canceledBy.Collect(ch)
+	h.authFailures.Collect(ch)
+	h.attempts.Collect(ch)
+	h.deprecated.Collect(ch)
+	h.trailersOnly.Collect(ch)
+	h.latency.Collect(ch)
+	h.latencyMax.Collect(ch)
+	h.latencyEWMA.Collect(ch)
+	h.timeout.Collect(ch)
+	h.noDeadline.Collect(ch)
+	h.pickDelay.Collect(ch)
+	h.opDuration.Collect(ch)
+	h.lastError.Collect(ch)
+	h.sentBytes.Collect(ch)
+	h.recvBytes.Collect(ch)
+	h.reqSize.Collect(ch)
+	h.mdBytes.Collect(ch)
+	h.mdEntries.Collect(ch)
+	h.respSize.Collect(ch)
+	h.reqMsgs.Collect(ch)
+	h.reqAttempts.Collect(ch)
+	h.retryAttempts.Collect(ch)
+	h.transparent.Collect(ch)
+	h.upload.Collect(ch)
+	h.msgsTotal.Collect(ch)
+	h.sizeRatio.Collect(ch)
+	h.deadlineUtil.Collect(ch)
+	h.msgAge.Collect(ch)
+	h.stale.Collect(ch)
+	h.oversized.Collect(ch)
+	h.topK.Collect(ch)
+	h.locality.Collect(ch)
+	h.breakerState.Collect(ch)
+	h.healthStatus.Collect(ch)
+	h.connFailures.Collect(ch)
+	h.connAttempts.Collect(ch)
+	h.backoffs.Collect(ch)
+	h.tcpConns.Collect(ch)
+	h.keepalive.Collect(ch)
+	h.rst.Collect(ch)
+	h.goAway.Collect(ch)
+	h.cpuTime.Collect(ch)
+	h.derived.Collect(ch)
+	h.overhead.Collect(ch)
+	h.compat.Collect(ch)
+}
+
+type connKey struct{ *handler }
+
+type connAddrs struct {
+	local  string
+	remote string
+}
+
+func newConnAddrs(local, remote net.Addr) connAddrs {
+	var addrs connAddrs
+	if local != nil {
+		addrs.local = local.String()
+	}
+	if remote != nil {
+		addrs.remote = remote.String()
+	}
+	return addrs
+}
+
+type connInfo struct {
+	addrs    connAddrs
+	tcpAddr  *net.TCPAddr // remote address, if TCP
+	instance string       // server label
+	peer     string       // peer label
+
+	mu        sync.Mutex
+	streams   int
+	closed    bool
+	idleSince time.Time
+}
+
+// TagConn implements the stats.Handler interface.
+func (h *handler) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
+	c := &connInfo{
+		addrs:     newConnAddrs(v.LocalAddr, v.RemoteAddr),
+		idleSince: time.Now(),
+	}
+	if h.serverLabel {
+		c.instance = listenerName(v.LocalAddr)
+	}
+	if h.peers != nil {
+		c.peer = h.peers.peer(v.RemoteAddr)
+	}
+	h.conns.Store(c.addrs, c)
+	if addr, ok := v.RemoteAddr.(*net.TCPAddr); ok {
+		c.tcpAddr = addr
+		h.connsByAddr.Store(addr, c)
+	}
+	return context.WithValue(ctx, connKey{h}, c)
+}
+
+// HandleConn implements the stats.Handler interface.
+func (h *handler) HandleConn(ctx context.Context, stat stats.ConnStats) {
+	if h.overhead != nil {
+		defer h.overhead.observe(connEvent(stat), time.Now())
+	}
+	c, _ := ctx.Value(connKey{h}).(*connInfo)
+	switch stat.(type) {
+	case *stats.ConnBegin:
+		h.connsOpen.Inc()
+		h.connsTotal.Inc()
+		if c != nil {
+			h.connsIdle.Inc()
+		}
+		h.hooks.connBegin(ctx)
+	case *stats.ConnEnd:
+		h.connsOpen.Dec()
+		if c != nil {
+			h.closeConn(c)
+		}
+		h.hooks.connEnd(ctx)
+	}
+}
+
+func (h *handler) closeConn(c *connInfo) {
+	h.conns.CompareAndDelete(c.addrs, c)
+	if c.tcpAddr != nil {
+		h.connsByAddr.CompareAndDelete(c.tcpAddr, c)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.streams == 0 {
+		h.connsIdle.Dec()
+		h.connsIdleTime.With().Observe(time.Since(c.idleSince).Seconds())
+	}
+}
+
+// lookupConn returns the connection between the given addresses, if any.
+// Transports report the same remote address to TagConn and HandleRPC,
+// so TCP connections are found by identity before formatting addresses.
+func (h *handler) lookupConn(local, remote net.Addr) *connInfo {
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		if x, ok := h.connsByAddr.Load(addr); ok {
+			return x.(*connInfo)
+		}
+	}
+	x, _ := h.conns.Load(newConnAddrs(local, remote))
+	c, _ := x.(*connInfo)
+	return c
+}
+
+// attachConn associates the RPC with the connection, if any.
+func (h *handler) attachConn(v *rpcInfo, c *connInfo) {
+	h.detachConn(v)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.streams == 0 {
+		h.connsIdle.Dec()
+		h.connsIdleTime.With().Observe(time.Since(c.idleSince).Seconds())
+	}
+	c.streams++
+	v.conn = c
+}
+
+// detachConn disassociates the RPC from its connection, if any.
+func (h *handler) detachConn(v *rpcInfo) {
+	c := v.conn
+	if c == nil {
+		return
 	}
-	if len(opts.buckets) > 0 {
-		return &histogram{prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "recv_bytes",
-				Help:      fmt.Sprintf("Bytes received in gRPC %s %s.", subsys, typ),
-				Buckets:   opts.buckets,
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
-		)}
+	v.conn = nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams--
+	if c.streams == 0 && !c.closed {
+		h.connsIdle.Inc()
+		c.idleSince = time.Now()
 	}
-	return &counters{
-		sum: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "recv_bytes_sum",
-				Help:      fmt.Sprintf("Bytes received in gRPC %s %s sum.", subsys, typ),
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
-		),
-		num: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: "grpc",
-				Subsystem: subsys,
-				Name:      "recv_bytes_count",
-				Help:      fmt.Sprintf("Bytes received in gRPC %s %s count.", subsys, typ),
-			},
-			[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
-		),
+}
+
+type rpcInfo struct {
+	*methodInfo
+	begin           time.Time
+	attemptBegin    time.Time // begin time of the current attempt
+	conn            *connInfo
+	pending         []string // requests_pending label values
+	pendingChildren *methodChildren
+	stream          bool // counted in streams_open in the current attempt
+	recvMsgs        int
+	sentMsgs        int
+	recvSize        atomic.Int64  // wire bytes
+	sentSize        atomic.Int64  // wire bytes
+	recvPayload     int           // wire bytes of messages in the current attempt
+	firstReqMsg     time.Time     // time of the first request message in the current attempt
+	lastReqMsg      time.Time     // time of the last request message in the current attempt
+	sentPayload     int           // wire bytes of messages in the current attempt
+	lastMsg         atomic.Int64  // unix nanos of the last message
+	stale           bool          // guarded by the staleCollector
+	locality        string        // backend locality of client requests
+	recvSizes       []frameSize   // deferred sizes, if only errors are recorded
+	sentSizes       []frameSize   // deferred sizes, if only errors are recorded
+	task            *trace.Task   // execution trace task of client streams
+	headers         bool          // response headers were sent or received
+	oversized       atomic.Bool   // a message was larger than the method's maximum size
+	attempts        int           // attempts begun
+	attemptEnded    bool          // the current attempt ended
+	call            bool          // the client call is tracked across attempts
+	finished        bool          // the client call finished
+	trailersOnly    bool          // response was trailers-only
+	deadline        int           // deadline class of the call
+	budget          time.Duration // time allotted by the deadline of the call, if any
+
+	// inferType reports whether the method type is inferred from the messages.
+	inferType bool
+}
+
+// reqMsg records the time of a request message.
+func (v *rpcInfo) reqMsg(t time.Time) {
+	if v.firstReqMsg.IsZero() {
+		v.firstReqMsg = t
 	}
+	v.lastReqMsg = t
 }
 
-func (h *handler) init(server string, methods []grpc.MethodInfo, codes []codes.Code) {
-	for _, meth := range methods {
-		typ := grpcType(meth.IsClientStream, meth.IsServerStream)
-		h.methods.Store("/"+server+"/"+meth.Name, methodInfo{
-			typ:    typ,
-			server: server,
-			method: meth.Name,
-		})
-		h.reqsPending.GetMetricWithLabelValues(typ, server, meth.Name)
-		for _, c := range codes {
-			code := c.String()
-			h.reqsTotal.GetMetricWithLabelValues(typ, server, meth.Name, code)
-			h.latency.Init(typ, server, meth.Name, code)
-		}
-		for _, f := range [...]string{header, payload, trailer} {
-			h.sentBytes.Init(typ, server, meth.Name, f)
-			h.recvBytes.Init(typ, server, meth.Name, f)
+// metadataSize returns the estimated size of the metadata in a header or
+// trailer, which is the uncompressed length of its keys and encoded values.
+func metadataSize(md metadata.MD) int {
+	n := 0
+	for k, vs := range md {
+		binary := strings.HasSuffix(k, "-bin")
+		for _, v := range vs {
+			n += len(k)
+			if binary {
+				n += base64.RawStdEncoding.EncodedLen(len(v))
+			} else {
+				n += len(v)
+			}
 		}
 	}
+	return n
 }
 
-func (h *handler) describe(ch chan<- *prometheus.Desc) {
-	h.connsOpen.Describe(ch)
-	h.connsTotal.Describe(ch)
-	h.reqsPending.Describe(ch)
-	h.reqsTotal.Describe(ch)
-	h.latency.Describe(ch)
-	h.sentBytes.Describe(ch)
-	h.recvBytes.Describe(ch)
-}
+// maxDeferredSizes is the maximum number of sizes deferred in each direction
+// of each request when only errors are recorded.
+const maxDeferredSizes = 64
 
-func (h *handler) collect(ch chan<- prometheus.Metric) {
-	h.connsOpen.Collect(ch)
-	h.connsTotal.Collect(ch)
-	h.reqsPending.Collect(ch)
-	h.reqsTotal.Collect(ch)
-	h.latency.Collect(ch)
-	h.sentBytes.Collect(ch)
-	h.recvBytes.Collect(ch)
+// A frameSize is a deferred observation of a frame's size.
+type frameSize struct {
+	sent  bool
+	frame int
+	size  int
 }
 
-// TagConn implements the stats.Handler interface.
-func (*handler) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
-	return ctx
+// observeSize observes the size of a frame sent or received in the request,
+// or defers it until the request ends if only errors are recorded. Streams
+// may send and receive concurrently, so sizes are deferred by direction.
+func (h *handler) observeSize(v *rpcInfo, sent bool, frame, size int) {
+	fs := frameSize{sent, frame, size}
+	switch {
+	case !h.errorsOnly:
+		h.recordSize(v.methodInfo, fs)
+	case sent:
+		if len(v.sentSizes) < maxDeferredSizes {
+			v.sentSizes = append(v.sentSizes, fs)
+		}
+	default:
+		if len(v.recvSizes) < maxDeferredSizes {
+			v.recvSizes = append(v.recvSizes, fs)
+		}
+	}
 }
 
-// HandleConn implements the stats.Handler interface.
-func (h *handler) HandleConn(ctx context.Context, stat stats.ConnStats) {
-	switch stat.(type) {
-	case *stats.ConnBegin:
-		h.connsOpen.Inc()
-		h.connsTotal.Inc()
-	case *stats.ConnEnd:
-		h.connsOpen.Dec()
-	}
+func (h *handler) recordSize(info *methodInfo, fs frameSize) {
+	h.sizeObserver(info, fs.sent, fs.frame).Observe(float64(fs.size))
 }
 
-type rpcInfo struct {
-	methodInfo
-	begin time.Time
+// methodKey identifies a method on a server instance for a caller.
+// The instance is empty unless servers are labeled,
+// and the caller is empty unless callers are labeled.
+type methodKey struct {
+	instance string
+	caller   string
+	method   string
 }
 
 type methodInfo struct {
+	name   string // full method name
 	typ    string
 	server string
 	method string
+	done   atomic.Uint64 // completed requests
+
+	// deprecated reports whether the method is marked deprecated in its proto
+	// descriptor. It's only looked up for stored methods.
+	deprecated bool
+	inited     uint32 // initialized code bits and initBit, guarded by handler.initMu
+
+	latencyInited uint32 // initialized latency code bits, guarded by handler.initMu
+
+	// Label values are built once so that observations don't allocate.
+	// They're preceded by the server label values, if any.
+	lvs      []string                            // typ, server, method
+	codeLvs  [codes.Unauthenticated + 1][]string // typ, server, method, code
+	frameLvs [numFrames][]string                 // typ, server, method, frame
+
+	// Child metrics are resolved on first use and indexed by code or frame,
+	// so that observations don't look up or copy the label values.
+	children     atomic.Pointer[methodChildren]
+	codeChildren [codes.Unauthenticated + 1]atomic.Pointer[codeChildren]
+	sizeChildren [2][numFrames]atomic.Pointer[prometheus.Observer] // recv, sent
+}
+
+func newMethodInfo(prefix []string, name, typ, server, method string) *methodInfo {
+	m := &methodInfo{
+		name:   name,
+		typ:    typ,
+		server: server,
+		method: method,
+	}
+	n := len(prefix)
+	buf := make([]string, 0, n+3+(n+4)*len(m.codeLvs)+(n+4)*len(m.frameLvs))
+	buf = append(append(buf, prefix...), typ, server, method)
+	m.lvs = buf[:len(buf):len(buf)]
+	for c := range m.codeLvs {
+		i := len(buf)
+		buf = append(append(buf, prefix...), typ, server, method, codes.Code(c).String())
+		m.codeLvs[c] = buf[i:len(buf):len(buf)]
+	}
+	for f, frame := range frames {
+		i := len(buf)
+		buf = append(append(buf, prefix...), typ, server, method, frame)
+		m.frameLvs[f] = buf[i:len(buf):len(buf)]
+	}
+	return m
+}
+
+// withType returns info for the same method with the given type.
+func (m *methodInfo) withType(typ string) *methodInfo {
+	return newMethodInfo(m.lvs[:len(m.lvs)-3], m.name, typ, m.server, m.method)
+}
+
+// codeLabels returns the label values for the given code.
+func (m *methodInfo) codeLabels(c codes.Code) []string {
+	if int(c) < len(m.codeLvs) {
+		return m.codeLvs[c]
+	}
+	return append(m.lvs[:len(m.lvs):len(m.lvs)], c.String())
 }
 
-func (h *handler) methodInfo(method, typ string) methodInfo {
-	x, _ := h.methods.Load(method)
-	if info, ok := x.(methodInfo); ok {
+// methodInfo returns info for the method, or nil if it's excluded.
+func (h *handler) methodInfo(instance, caller, method, typ string) *methodInfo {
+	if h.infra != includeInfra && isInfraMethod(method) {
+		if h.infra == excludeInfra {
+			return nil
+		}
+		method, typ = infraMethod, unknown
+	}
+	if info, ok := (*h.methods.Load())[methodKey{instance, caller, method}]; ok {
 		return info
 	}
-	srv, meth := splitFullMethodName(method)
-	info := methodInfo{
-		typ:    typ,
-		server: srv,
-		method: meth,
+	if typ == unknown && method != infraMethod {
+		srv, meth, lvs := h.splitMethod(method)
+		return newMethodInfo(h.labelPrefix(instance, caller, lvs), method, typ, srv, meth)
+	}
+	return h.storeMethodInfo(instance, caller, method, typ)
+}
+
+// infraMode determines how infrastructure services are recorded.
+type infraMode int
+
+const (
+	includeInfra infraMode = iota
+	excludeInfra
+	aggregateInfra
+)
+
+// infraMethod is the method name under which infrastructure services are aggregated.
+const infraMethod = "/Infra/Infra"
+
+// isInfraMethod reports whether the method belongs to an infrastructure service,
+// such as reflection, health checking, or channelz.
+func isInfraMethod(method string) bool {
+	return strings.HasPrefix(method, "/grpc.reflection.") ||
+		strings.HasPrefix(method, "/grpc.health.") ||
+		strings.HasPrefix(method, "/grpc.channelz.")
+}
+
+// storeMethodInfo stores and returns new info for the method.
+// If info with the same type is already stored, it's returned instead.
+func (h *handler) storeMethodInfo(instance, caller, method, typ string) *methodInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	methods := *h.methods.Load()
+	if info, ok := methods[methodKey{instance, caller, method}]; ok && info.typ == typ {
+		return info
 	}
-	if typ != unknown {
-		h.methods.Store(method, info)
+	instance = h.intern(instance)
+	caller = h.intern(caller)
+	method = h.intern(method)
+	srv, meth, lvs := h.splitMethod(method)
+	info := newMethodInfo(h.labelPrefix(instance, caller, lvs), method, typ, h.intern(srv), meth)
+	info.deprecated = isDeprecated(srv, meth)
+	next := make(map[methodKey]*methodInfo, len(methods)+1)
+	for k, v := range methods {
+		next[k] = v
 	}
+	next[methodKey{instance, caller, method}] = info
+	h.methods.Store(&next)
 	return info
 }
 
+// labelPrefix returns the label values preceding the method labels.
+func (h *handler) labelPrefix(instance, caller string, methodLvs []string) []string {
+	var prefix []string
+	if h.serverLabel {
+		prefix = append(prefix, instance)
+	}
+	if h.callers != nil {
+		prefix = append(prefix, caller)
+	}
+	return append(prefix, methodLvs...)
+}
+
+// instance returns the server or connection label value for the context.
+func (h *handler) instance(ctx context.Context) string {
+	if !h.serverLabel {
+		return ""
+	}
+	if name, ok := ctx.Value(connNameKey{h}).(string); ok {
+		return name
+	}
+	if c, ok := ctx.Value(connKey{h}).(*connInfo); ok {
+		return c.instance
+	}
+	return ""
+}
+
+// listenerName returns a server label value derived from the listener address.
+// TCP listeners are named by port, because the IP depends on the interface.
+func listenerName(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return ":" + strconv.Itoa(addr.Port)
+	default:
+		return addr.String()
+	}
+}
+
+// intern returns a canonical copy of s so that label values
+// and map keys share storage. It must be called with h.mu held.
+func (h *handler) intern(s string) string {
+	if v, ok := h.strs[s]; ok {
+		return v
+	}
+	h.strs[s] = s
+	return s
+}
+
 // TagRPC implements the stats.Handler interface.
 func (h *handler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
-	if _, ok := ctx.Value(h).(*rpcInfo); ok {
+	if _, ok := ctx.Value(h).(*rpcInfo); ok || h.skipped(ctx) {
+		return ctx
+	}
+	ctx, skip := h.skipRPC(ctx, v)
+	if skip {
 		return ctx
 	}
-	return context.WithValue(ctx, h, &rpcInfo{
-		methodInfo: h.methodInfo(v.FullMethodName, unknown),
-	})
+	info := h.methodInfo(h.instance(ctx), h.callers.caller(ctx), v.FullMethodName, unknown)
+	if info == nil {
+		return ctx
+	}
+	r := &rpcInfo{methodInfo: info}
+	return h.withOpTimer(context.WithValue(ctx, h, r), r)
+}
+
+// splitMethod returns the service and method labels of the full method name
+// and the values of the parser's labels, or the fallback labels and empty
+// values if it can't be parsed.
+func (h *handler) splitMethod(s string) (service, method string, lvs []string) {
+	if h.parser == nil || s == infraMethod {
+		if service, method, ok := splitFullMethodName(s); ok {
+			return service, method, nil
+		}
+		return h.fallback[0], h.fallback[1], nil
+	}
+	service, method, lvs = h.parser(s)
+	if service == "" || method == "" || len(lvs) != h.methodLabels || !validLabelValues(service, method, lvs) {
+		return h.fallback[0], h.fallback[1], make([]string, h.methodLabels)
+	}
+	return service, method, lvs
+}
+
+// validLabelValues returns true if the service, method, and label values are valid UTF-8.
+func validLabelValues(service, method string, lvs []string) bool {
+	if !utf8.ValidString(service) || !utf8.ValidString(method) {
+		return false
+	}
+	for _, v := range lvs {
+		if !utf8.ValidString(v) {
+			return false
+		}
+	}
+	return true
 }
 
-func splitFullMethodName(s string) (server, method string) {
-	s = strings.TrimPrefix(s, "/")
-	i := strings.Index(s, "/")
-	if i < 0 {
-		return "Unknown", "Unknown"
+// splitFullMethodName returns the service and method of the full method name
+// (e.g. "/pkg.Service/Method"), or false if it doesn't have exactly two segments
+// of valid UTF-8. Empty segments are ignored and percent-encoding is decoded
+// after splitting, so an escaped separator isn't a separator, and it's invalid.
+func splitFullMethodName(s string) (service, method string, ok bool) {
+	for s != "" {
+		var seg string
+		seg, s, _ = strings.Cut(s, "/")
+		if strings.Contains(seg, "%") {
+			var err error
+			if seg, err = url.PathUnescape(seg); err != nil || strings.Contains(seg, "/") {
+				return "", "", false
+			}
+		}
+		switch {
+		case seg == "":
+		case service == "":
+			service = seg
+		case method == "":
+			method = seg
+		default:
+			return "", "", false
+		}
 	}
-	return s[:i], s[i+1:]
+	if method == "" || !utf8.ValidString(service) || !utf8.ValidString(method) {
+		return "", "", false
+	}
+	return service, method, true
 }
 
 // HandleRPC implements the stats.Handler interface.
 func (h *handler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	if h.overhead != nil {
+		defer h.overhead.observe(rpcEvent(stat), time.Now())
+	}
 	v, ok := ctx.Value(h).(*rpcInfo)
 	if !ok {
 		return
 	}
 	switch s := stat.(type) {
 	case *stats.Begin:
-		v.begin = s.BeginTime
-		h.reqsPending.WithLabelValues(v.typ, v.server, v.method).Inc()
+		first := v.attempts == 0
+		v.attempts++
+		v.attemptEnded = false
+		v.attemptBegin = s.BeginTime
+		if first {
+			v.begin = s.BeginTime
+			v.deadline = deadlineClass(ctx, s.BeginTime)
+		}
+		// Transparent retries are attempts, even if the call isn't tracked.
+		if s.IsTransparentRetryAttempt {
+			h.methodChildren(v.methodInfo).transparent.Inc()
+		} else if s.Client && !first {
+			h.methodChildren(v.methodInfo).retries.Inc()
+		}
+		v.recvMsgs, v.sentMsgs = 0, 0
+		v.recvPayload, v.sentPayload = 0, 0
+		v.firstReqMsg, v.lastReqMsg = time.Time{}, time.Time{}
+		v.headers, v.trailersOnly = false, false
+		v.oversized.Store(false)
+		v.pending = v.lvs
+		v.pendingChildren = h.methodChildren(v.methodInfo)
+		v.pendingChildren.pending.Inc()
+		if first && h.compat != nil {
+			v.pendingChildren.compat.started.Inc()
+		}
+		v.pendingChildren.pendingMax.Add(1)
+		h.pendingCounts.add(v.pendingChildren.pendingCount, 1)
+		v.stream = isStream(v.typ)
+		if v.stream {
+			v.pendingChildren.streams.Inc()
+		}
+		if deadline, ok := ctx.Deadline(); ok && first {
+			v.budget = deadline.Sub(s.BeginTime)
+			v.pendingChildren.timeout.Observe(v.budget.Seconds())
+		} else if first {
+			v.pendingChildren.noDeadline.Inc()
+		}
+		v.lastMsg.Store(s.BeginTime.UnixNano())
+		h.msgAge.begin(v)
+		h.stale.begin(v)
+		h.hooks.rpcBegin(ctx, v, s.Client)
 	case *stats.End:
-		code := status.Code(s.Error).String()
-		h.latency.Observe(time.Since(v.begin).Seconds(), v.typ, v.server, v.method, code)
-		h.reqsTotal.WithLabelValues(v.typ, v.server, v.method, code).Inc()
-		h.reqsPending.WithLabelValues(v.typ, v.server, v.method).Dec()
+		if s.Client {
+			h.codeChildren(v.methodInfo, status.Code(s.Error)).attempts.Inc()
+		}
+		if v.call && !v.finished {
+			// The attempt is retried and the call is recorded by its last attempt.
+			h.endAttempt(v)
+			return
+		}
+		h.endCall(ctx, v, s.Error, s.EndTime, s.Client)
 	case *stats.InHeader:
-		h.recvBytes.Observe(float64(s.WireLength), v.typ, v.server, v.method, header)
+		v.recvSize.Add(int64(s.WireLength))
+		if s.Client {
+			v.headers = true
+		} else {
+			c, _ := ctx.Value(connKey{h}).(*connInfo)
+			h.attachConn(v, c)
+		}
+		h.observeSize(v, false, headerFrame, s.WireLength)
+		h.observeMetadata(v, false, false, s.Header)
 	case *stats.InPayload:
-		h.recvBytes.Observe(float64(s.WireLength), v.typ, v.server, v.method, payload)
+		v.recvMsgs++
+		if v.stream {
+			v.pendingChildren.streamMsgs.Inc()
+		}
+		v.recvPayload += s.WireLength
+		if !s.Client {
+			v.reqMsg(s.RecvTime)
+		}
+		v.recvSize.Add(int64(s.WireLength))
+		v.lastMsg.Store(s.RecvTime.UnixNano())
+		if h.uncompressed[0] {
+			h.observeSize(v, false, payloadFrame, s.Length)
+		} else {
+			h.observeSize(v, false, payloadFrame, s.WireLength)
+		}
+		h.oversized.observe(v, false, s.Length)
+		h.countMsg(v, false, s.CompressedLength != s.Length)
+		if h.compat != nil {
+			h.methodChildren(v.methodInfo).compat.msgRecv.Inc()
+		}
 	case *stats.InTrailer:
-		h.recvBytes.Observe(float64(s.WireLength), v.typ, v.server, v.method, trailer)
+		v.recvSize.Add(int64(s.WireLength))
+		if s.Client && !v.headers {
+			v.trailersOnly = true
+		}
+		h.observeSize(v, false, trailerFrame, s.WireLength)
+		h.observeMetadata(v, false, true, s.Trailer)
 	case *stats.OutHeader:
-		// TODO: WireLength doesn't exist ???
-		h.sentBytes.Observe(0, v.typ, v.server, v.method, header)
+		if s.Client {
+			h.attachConn(v, h.lookupConn(s.LocalAddr, s.RemoteAddr))
+			v.locality = h.locality.locate(s.RemoteAddr)
+			h.methodChildren(v.methodInfo).pickDelay.Observe(time.Since(v.attemptBegin).Seconds())
+		} else {
+			v.headers = true
+		}
+		// The wire length isn't reported, because the header is compressed later.
+		h.observeSize(v, true, headerFrame, len(s.FullMethod)+metadataSize(s.Header))
+		h.observeMetadata(v, true, false, s.Header)
 	case *stats.OutPayload:
-		h.sentBytes.Observe(float64(s.WireLength), v.typ, v.server, v.method, payload)
+		v.sentMsgs++
+		if v.stream {
+			v.pendingChildren.streamMsgs.Inc()
+		}
+		v.sentPayload += s.WireLength
+		if s.Client {
+			v.reqMsg(s.SentTime)
+		}
+		v.sentSize.Add(int64(s.WireLength))
+		v.lastMsg.Store(s.SentTime.UnixNano())
+		if h.uncompressed[1] {
+			h.observeSize(v, true, payloadFrame, s.Length)
+		} else {
+			h.observeSize(v, true, payloadFrame, s.WireLength)
+		}
+		h.oversized.observe(v, true, s.Length)
+		h.countMsg(v, true, s.CompressedLength != s.Length)
+		if h.compat != nil {
+			h.methodChildren(v.methodInfo).compat.msgSent.Inc()
+		}
 	case *stats.OutTrailer:
-		// TODO: WireLength is never set ???
-		h.sentBytes.Observe(0, v.typ, v.server, v.method, trailer)
+		if !s.Client && !v.headers {
+			v.trailersOnly = true
+		}
+		// The wire length isn't reported, because the trailer is compressed later.
+		h.observeSize(v, true, trailerFrame, metadataSize(s.Trailer))
+		h.observeMetadata(v, true, true, s.Trailer)
+	}
+}
+
+// countMsg counts a message sent or received in the RPC by its compression.
+// A message is considered compressed if its compressed length differs from
+// its length, because the compression flag isn't reported.
+func (h *handler) countMsg(v *rpcInfo, sent, compressed bool) {
+	if _, ok := h.msgsTotal.(noopCounterVec); ok {
+		return
+	}
+	dir, comp := 0, 0
+	if sent {
+		dir = 1
+	}
+	if compressed {
+		comp = 1
+	}
+	h.methodChildren(v.methodInfo).msgs[dir][comp].Inc()
+}
+
+// endCall records the end of the RPC.
+func (h *handler) endCall(ctx context.Context, v *rpcInfo, err error, endTime time.Time, client bool) {
+	info := v.methodInfo
+	if v.inferType && info.typ == unknown {
+		info = info.withType(grpcType(v.recvMsgs > 1, v.sentMsgs > 1))
+	}
+	code := status.Code(err)
+	var children *codeChildren
+	if h.labeled != nil {
+		var codeLv string
+		if h.codeMapper != nil {
+			codeLv = h.codeMapper(err)
+		}
+		children = h.labeledCodeChildren(ctx, info, code, codeLv)
+	} else {
+		children = h.codeChildren(info, code)
+	}
+	elapsed := time.Since(v.begin)
+	latency := elapsed.Seconds()
+	if !h.errorsOnly || code != codes.OK {
+		children.latency.Observe(latency)
+		h.methodChildren(info).latencyMax.Observe(latency)
+		h.methodChildren(info).latencyEWMA.Observe(latency)
+		for _, fs := range v.recvSizes {
+			h.recordSize(info, fs)
+		}
+		for _, fs := range v.sentSizes {
+			h.recordSize(info, fs)
+		}
+	}
+	v.recvSizes, v.sentSizes = v.recvSizes[:0], v.sentSizes[:0]
+	if code != codes.OK {
+		children.lastError.Set(float64(endTime.UnixNano()) / 1e9)
+	}
+	children.total[v.deadline].Inc()
+	if v.budget > 0 {
+		h.methodChildren(info).deadlineUtil.Observe(elapsed.Seconds() / v.budget.Seconds())
+	}
+	if h.compat != nil {
+		compat := h.methodChildren(info).compat
+		compat.handling.Observe(latency)
+		h.compat.handledCounter(compat, code).Inc()
+	}
+	if info.deprecated {
+		h.methodChildren(info).deprecated.Inc()
+	}
+	if code == codes.Canceled {
+		h.methodChildren(info).canceledBy[cancelCause(ctx, err)].Inc()
+	}
+	if client {
+		h.methodChildren(info).attempts.Observe(float64(v.attempts))
+	}
+	if v.trailersOnly {
+		children.trailersOnly.Inc()
+	}
+	if !client {
+		h.countAuthFailure(ctx, info, code)
+	}
+	if info.typ == clientStream || info.typ == bidiStream {
+		reqMsgs := v.sentMsgs
+		if !client {
+			reqMsgs = v.recvMsgs
+		}
+		h.methodChildren(info).reqMsgs.Observe(float64(reqMsgs))
+		if reqMsgs > 0 {
+			h.methodChildren(info).upload.Observe(v.lastReqMsg.Sub(v.firstReqMsg).Seconds())
+		}
+	}
+	reqSize, respSize := v.sentSize.Load(), v.recvSize.Load()
+	if !client {
+		reqSize, respSize = respSize, reqSize
+	}
+	h.methodChildren(info).reqSize.Observe(float64(reqSize))
+	h.methodChildren(info).respSize.Observe(float64(respSize))
+	if info.typ == unary {
+		req, resp := v.sentPayload, v.recvPayload
+		if !client {
+			req, resp = resp, req
+		}
+		if req > 0 {
+			h.methodChildren(info).sizeRatio.Observe(float64(resp) / float64(req))
+		}
+	}
+	info.done.Add(1)
+	h.msgAge.end(v)
+	h.stale.end(v)
+	h.topK.observe(ctx, v)
+	h.locality.observe(v, code, latency)
+	if h.subs.active() || h.anomalies != nil || h.accessLog != nil || len(h.hooks) > 0 {
+		o := Outcome{
+			Service: info.server,
+			Method:  info.method,
+			Code:    code,
+			Err:     err,
+			Latency: elapsed,
+		}
+		h.subs.publish(o)
+		h.anomalies.check(v, o)
+		if h.accessLog != nil {
+			h.accessLog(ctx, accessRecord{
+				Outcome: o,
+				typ:     info.typ,
+				client:  client,
+				sent:    int(v.sentSize.Load()),
+				recv:    int(v.recvSize.Load()),
+			})
+		}
+		if len(h.hooks) > 0 {
+			h.hooks.rpcEnd(ctx, RPCEnd{
+				Outcome:   o,
+				Type:      info.typ,
+				Client:    client,
+				Attempts:  v.attempts,
+				SentBytes: int(v.sentSize.Load()),
+				RecvBytes: int(v.recvSize.Load()),
+			})
+		}
+	}
+	h.endAttempt(v)
+	if v.task != nil {
+		v.task.End()
+		v.task = nil
+	}
+}
+
+// An accessRecord is the record of a completed RPC for an access log.
+type accessRecord struct {
+	Outcome
+	typ    string
+	client bool
+	sent   int // wire bytes
+	recv   int // wire bytes
+}
+
+// endAttempt records the end of the RPC's current attempt, if it hasn't ended.
+func (h *handler) endAttempt(v *rpcInfo) {
+	if v.attemptEnded {
+		return
+	}
+	v.attemptEnded = true
+	if v.pending != nil {
+		v.pendingChildren.pending.Dec()
+		v.pendingChildren.pendingMax.Add(-1)
+		h.pendingCounts.add(v.pendingChildren.pendingCount, -1)
+		if v.stream {
+			v.pendingChildren.streams.Dec()
+			v.pendingChildren.streamMsgs.Sub(float64(v.recvMsgs + v.sentMsgs))
+		}
+	}
+	h.detachConn(v)
+}
+
+// finishCall is called when the client call is finished,
+// before the end of its last attempt, if any.
+func (h *handler) finishCall(ctx context.Context, v *rpcInfo, err error) {
+	v.finished = true
+	if v.attemptEnded {
+		// The last attempt already ended, because the retry failed to begin.
+		h.endCall(ctx, v, err, time.Now(), true)
+	}
+}
+
+func (h *handler) tapHandle(next tap.ServerInHandle) tap.ServerInHandle {
+	if next == nil {
+		return nil
+	}
+	return func(ctx context.Context, info *tap.Info) (context.Context, error) {
+		ctx, err := next(ctx, info)
+		if err != nil {
+			code := codes.PermissionDenied
+			if s, ok := status.FromError(err); ok {
+				code = s.Code()
+			}
+			if m := h.methodInfo(h.instance(ctx), h.callers.caller(ctx), info.FullMethodName, unknown); m != nil {
+				h.reqsRejected.WithLabelValues(m.codeLabels(code)...).Inc()
+			}
+		}
+		return ctx, err
 	}
 }
 
@@ -384,8 +2053,12 @@ func (h *handler) unaryClientInterceptor(
 	invoker grpc.UnaryInvoker,
 	opts ...grpc.CallOption,
 ) error {
+	ctx, task := h.startTask(ctx, method)
+	if task != nil {
+		defer task.End()
+	}
 	ctx = h.context(ctx, method, unary)
-	return invoker(ctx, method, req, reply, cc, opts...)
+	return invoker(ctx, method, req, reply, cc, h.trackCall(ctx, opts)...)
 }
 
 func (h *handler) unaryServerInterceptor(
@@ -394,7 +2067,22 @@ func (h *handler) unaryServerInterceptor(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler,
 ) (resp interface{}, err error) {
+	ctx, task := h.startTask(ctx, info.FullMethod)
+	if task != nil {
+		defer task.End()
+	}
 	ctx = h.context(ctx, info.FullMethod, unary)
+	defer h.countCanceled(ctx)
+	defer h.handlerDone(h.handlerStarted(ctx))
+	if stop := h.cpuTime.start(ctx); stop != nil {
+		defer stop()
+	}
+	if h.pprofLabels {
+		h.doLabeled(ctx, func(ctx context.Context) {
+			resp, err = handler(ctx, req)
+		})
+		return resp, err
+	}
 	return handler(ctx, req)
 }
 
@@ -406,8 +2094,17 @@ func (h *handler) streamClientInterceptor(
 	streamer grpc.Streamer,
 	opts ...grpc.CallOption,
 ) (grpc.ClientStream, error) {
+	ctx, task := h.startTask(ctx, method)
 	ctx = h.context(ctx, method, grpcType(desc.ClientStreams, desc.ServerStreams))
-	return streamer(ctx, desc, cc, method, opts...)
+	if task != nil {
+		// The stream outlives the interceptor, so the task ends with the RPC.
+		if v, ok := ctx.Value(h).(*rpcInfo); ok {
+			v.task = task
+		} else {
+			task.End()
+		}
+	}
+	return streamer(ctx, desc, cc, method, h.trackCall(ctx, opts)...)
 }
 
 func (h *handler) streamServerInterceptor(
@@ -417,19 +2114,118 @@ func (h *handler) streamServerInterceptor(
 	handler grpc.StreamHandler,
 ) error {
 	typ := grpcType(info.IsClientStream, info.IsServerStream)
-	return handler(srv, &ctxServerStream{
-		ServerStream: ss,
-		ctx:          h.context(ss.Context(), info.FullMethod, typ),
-	})
+	if srv == nil {
+		// The stream is handled by an UnknownServiceHandler, such as a proxy,
+		// so the method is arbitrary and its type is inferred from its messages.
+		typ = unknown
+	}
+	ctx, task := h.startTask(ss.Context(), info.FullMethod)
+	if task != nil {
+		defer task.End()
+	}
+	ctx = h.context(ctx, info.FullMethod, typ)
+	defer h.countCanceled(ctx)
+	defer h.handlerDone(h.handlerStarted(ctx))
+	if stop := h.cpuTime.start(ctx); stop != nil {
+		defer stop()
+	}
+	if h.pprofLabels {
+		var err error
+		h.doLabeled(ctx, func(ctx context.Context) {
+			err = handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+		})
+		return err
+	}
+	return handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// countCanceled counts the server RPC if it was canceled by its client,
+// as opposed to its handler returning Canceled, before the handler returned.
+// The transport cancels the context when the client resets the stream or
+// the connection is closed, but only after the handler returns otherwise.
+func (h *handler) countCanceled(ctx context.Context) {
+	if ctx.Err() != context.Canceled {
+		return
+	}
+	if v, ok := ctx.Value(h).(*rpcInfo); ok && v.methodInfo != nil {
+		h.methodChildren(v.methodInfo).canceled.Inc()
+	}
+}
+
+// handlerStarted counts the server RPC's handler as running
+// and returns its gauge for handlerDone.
+func (h *handler) handlerStarted(ctx context.Context) prometheus.Gauge {
+	v, ok := ctx.Value(h).(*rpcInfo)
+	if !ok || v.methodInfo == nil {
+		return nil
+	}
+	g := h.methodChildren(v.methodInfo).handlers
+	g.Inc()
+	return g
+}
+
+// handlerDone counts the server RPC's handler as returned.
+func (h *handler) handlerDone(g prometheus.Gauge) {
+	if g != nil {
+		g.Dec()
+	}
+}
+
+// trackCall tracks the client call across its attempts, so that it's recorded
+// once by its last attempt, and returns its call options.
+func (h *handler) trackCall(ctx context.Context, opts []grpc.CallOption) []grpc.CallOption {
+	v, ok := ctx.Value(h).(*rpcInfo)
+	if !ok {
+		return opts
+	}
+	v.call = true
+	return append(opts[:len(opts):len(opts)], grpc.OnFinish(func(err error) { h.finishCall(ctx, v, err) }))
+}
+
+// startTask starts an execution trace task for the RPC, if enabled and tracing.
+func (h *handler) startTask(ctx context.Context, method string) (context.Context, *trace.Task) {
+	if !h.traceTasks || !trace.IsEnabled() {
+		return ctx, nil
+	}
+	return trace.NewTask(ctx, method)
+}
+
+// doLabeled calls fn with the context and the goroutine labeled for
+// profiling with the method of the RPC.
+func (h *handler) doLabeled(ctx context.Context, fn func(context.Context)) {
+	v, ok := ctx.Value(h).(*rpcInfo)
+	if !ok {
+		fn(ctx)
+		return
+	}
+	pprof.Do(ctx, pprof.Labels("grpc_service", v.server, "grpc_method", v.method), fn)
 }
 
 func (h *handler) context(ctx context.Context, method string, typ string) context.Context {
-	info := h.methodInfo(method, typ)
-	if v, ok := ctx.Value(h).(*rpcInfo); ok {
+	if h.skipped(ctx) {
+		return ctx
+	}
+	v, ok := ctx.Value(h).(*rpcInfo)
+	if !ok {
+		var skip bool
+		if ctx, skip = h.skipRPC(ctx, &stats.RPCTagInfo{FullMethodName: method}); skip {
+			return ctx
+		}
+	}
+	info := h.methodInfo(h.instance(ctx), h.callers.caller(ctx), method, typ)
+	if info == nil {
+		return ctx
+	}
+	if ok {
 		v.methodInfo = info
+		v.inferType = typ == unknown
 		return ctx
 	}
-	return context.WithValue(ctx, h, &rpcInfo{methodInfo: info})
+	v = &rpcInfo{
+		methodInfo: info,
+		inferType:  typ == unknown,
+	}
+	return h.withOpTimer(context.WithValue(ctx, h, v), v)
 }
 
 type ctxServerStream struct {
@@ -441,6 +2237,11 @@ func (ss *ctxServerStream) Context() context.Context {
 	return ss.ctx
 }
 
+// isStream reports whether the type is a streaming type.
+func isStream(typ string) bool {
+	return typ == clientStream || typ == serverStream || typ == bidiStream
+}
+
 func grpcType(isClientStream, isServerStream bool) string {
 	if isServerStream {
 		if isClientStream {
@@ -453,3 +2254,40 @@ func grpcType(isClientStream, isServerStream bool) string {
 	}
 	return unary
 }
+
+// namedHandler is a stats.Handler which labels server metrics with a name.
+type namedHandler struct {
+	*handler
+	name string
+}
+
+// TagConn implements the stats.Handler interface.
+func (h namedHandler) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
+	ctx = h.handler.TagConn(ctx, v)
+	if c, ok := ctx.Value(connKey{h.handler}).(*connInfo); ok {
+		c.instance = h.name
+	}
+	return ctx
+}
+
+// namedClientHandler is a stats.Handler which labels client metrics with a connection name.
+type namedClientHandler struct {
+	*handler
+	name string
+}
+
+// TagRPC implements the stats.Handler interface.
+func (h namedClientHandler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
+	r, ok := ctx.Value(h.handler).(*rpcInfo)
+	if !ok {
+		return h.handler.TagRPC(context.WithValue(ctx, connNameKey{h.handler}, h.name), v)
+	}
+	// The interceptor tagged the RPC before its connection was known.
+	if info := h.methodInfo(h.name, "", v.FullMethodName, r.typ); info != nil {
+		r.methodInfo = info
+	}
+	return ctx
+}
+
+// connNameKey is the context key of the connection name of a client RPC.
+type connNameKey struct{ h *handler }
@@ -0,0 +1,239 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+)
+
+// serverRPC returns a function which handles the stats of a unary server RPC.
+func serverRPC(opts ...Option) func() {
+	h := newMetrics("server", opts...)
+	h.init("", "pkg.Service", []grpc.MethodInfo{{Name: "Method"}}, initOptions{codes: AllCodes})
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	begin := &stats.Begin{BeginTime: time.Now()}
+	in := &stats.InPayload{WireLength: 128}
+	out := &stats.OutPayload{WireLength: 256}
+	end := &stats.End{EndTime: time.Now()}
+	return func() {
+		h.HandleRPC(ctx, begin)
+		h.HandleRPC(ctx, in)
+		h.HandleRPC(ctx, out)
+		h.HandleRPC(ctx, end)
+	}
+}
+
+// clientRPC returns a function which handles the stats of a unary client RPC.
+func clientRPC() func() {
+	h := newMetrics("client")
+	h.init("", "pkg.Service", []grpc.MethodInfo{{Name: "Method"}}, initOptions{codes: AllCodes})
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{LocalAddr: local, RemoteAddr: remote})
+	h.HandleConn(ctx, &stats.ConnBegin{Client: true})
+	ctx = h.context(context.Background(), "/pkg.Service/Method", unary)
+	begin := &stats.Begin{Client: true, BeginTime: time.Now()}
+	hdr := &stats.OutHeader{Client: true, LocalAddr: local, RemoteAddr: remote}
+	out := &stats.OutPayload{Client: true, WireLength: 128}
+	in := &stats.InPayload{Client: true, WireLength: 256}
+	end := &stats.End{Client: true, EndTime: time.Now()}
+	return func() {
+		h.HandleRPC(ctx, begin)
+		h.HandleRPC(ctx, hdr)
+		h.HandleRPC(ctx, out)
+		h.HandleRPC(ctx, in)
+		h.HandleRPC(ctx, end)
+	}
+}
+
+func TestHandleRPCAllocs(t *testing.T) {
+	if allocs := testing.AllocsPerRun(100, serverRPC()); allocs != 0 {
+		t.Errorf("server HandleRPC allocations = %v; want 0", allocs)
+	}
+	opts := []Option{
+		LatencyMaxSeconds(Enable()),
+		RequestsPendingMax(Enable()),
+		LastErrorTimestampSeconds(Enable()),
+	}
+	if allocs := testing.AllocsPerRun(100, serverRPC(opts...)); allocs != 0 {
+		t.Errorf("server HandleRPC allocations with all metrics = %v; want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, clientRPC()); allocs != 0 {
+		t.Errorf("client HandleRPC allocations = %v; want 0", allocs)
+	}
+}
+
+func BenchmarkHandleRPC(b *testing.B) {
+	rpc := serverRPC()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rpc()
+	}
+}
+
+func BenchmarkHandleRPCClient(b *testing.B) {
+	rpc := clientRPC()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rpc()
+	}
+}
+
+// BenchmarkHandleRPCDuringCollect reports the tail latency of handling RPCs
+// while metrics with many series are continuously collected by a slow reader.
+func BenchmarkHandleRPCDuringCollect(b *testing.B) {
+	h := newMetrics("server", LatencyMaxSeconds(Enable()), RequestsPendingMax(Enable()))
+	methods := make([]grpc.MethodInfo, 1000)
+	for i := range methods {
+		methods[i].Name = fmt.Sprintf("Method%d", i)
+	}
+	h.init("", "pkg.Service", methods, initOptions{codes: []codes.Code{codes.OK}})
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method0"})
+	begin := &stats.Begin{BeginTime: time.Now()}
+	end := &stats.End{EndTime: time.Now()}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ch := make(chan prometheus.Metric)
+			go func() {
+				h.collect(ch)
+				close(ch)
+			}()
+			for range ch {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	}()
+
+	durs := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := range durs {
+		start := time.Now()
+		h.HandleRPC(ctx, begin)
+		h.HandleRPC(ctx, end)
+		durs[i] = time.Since(start)
+	}
+	b.StopTimer()
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	b.ReportMetric(float64(durs[len(durs)*99/100]), "p99-ns")
+	b.ReportMetric(float64(durs[len(durs)-1]), "max-ns")
+}
+
+func BenchmarkCounterParallel(b *testing.B) {
+	opts := prometheus.CounterOpts{Name: "requests_total", Help: "Total number of requests."}
+	for _, bb := range []struct {
+		name string
+		vec  counterVec
+	}{
+		{"Shared", prometheus.NewCounterVec(opts, []string{"code"})},
+		{"PerCPU", newPerCPUCounterVec(opts, []string{"code"})},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			c := bb.vec.WithLabelValues("OK")
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.Inc()
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkTagRPC(b *testing.B) {
+	h := newMetrics("server")
+	h.init("", "pkg.Service", []grpc.MethodInfo{{Name: "Method"}}, initOptions{})
+	ctx := context.Background()
+	info := &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.TagRPC(ctx, info)
+	}
+}
+
+func BenchmarkInit(b *testing.B) {
+	methods := make([]grpc.MethodInfo, 1000)
+	for i := range methods {
+		methods[i].Name = fmt.Sprintf("Method%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := newMetrics("server")
+		h.init("", "pkg.Service", methods, initOptions{})
+	}
+}
+
+func TestSplitFullMethodName(t *testing.T) {
+	tests := []struct {
+		full, service, method string
+		ok                    bool
+	}{
+		{"/pkg.Service/Method", "pkg.Service", "Method", true},
+		{"pkg.Service/Method", "pkg.Service", "Method", true},
+		{"//pkg.Service//Method/", "pkg.Service", "Method", true},
+		{"/pkg.Service/Meth%6Fd", "pkg.Service", "Method", true},
+		{"/pkg.Service%2FMethod", "", "", false},
+		{"/pkg.Service/Meth%2Fod", "", "", false},
+		{"/pkg%2E%53ervice/Method", "pkg.Service", "Method", true},
+		{"/pkg.Service/Method%", "", "", false},
+		{"/pkg.Service/\xff", "", "", false},
+		{"/tenant/pkg.Service/Method", "", "", false},
+		{"/Method", "", "", false},
+		{"/", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		service, method, ok := splitFullMethodName(tt.full)
+		if service != tt.service || method != tt.method || ok != tt.ok {
+			t.Errorf("splitFullMethodName(%q): got: (%q, %q, %v); want: (%q, %q, %v)", tt.full, service, method, ok, tt.service, tt.method, tt.ok)
+		}
+	}
+}
+
+func FuzzSplitFullMethodName(f *testing.F) {
+	for _, s := range []string{"/pkg.Service/Method", "//a//b/", "/a/b/c", "/a%2Fb", "/%zz/b", "/\xff/b", ""} {
+		f.Add(s)
+	}
+	h := newMetrics("server")
+	f.Fuzz(func(t *testing.T, s string) {
+		// Label values must be valid, even for unparseable methods.
+		ctx := h.context(context.Background(), s, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+
+		service, method, ok := splitFullMethodName(s)
+		if !ok {
+			if service != "" || method != "" {
+				t.Fatalf("splitFullMethodName(%q): got labels (%q, %q) without ok", s, service, method)
+			}
+			return
+		}
+		for _, v := range []string{service, method} {
+			if v == "" || strings.Contains(v, "/") || !utf8.ValidString(v) {
+				t.Fatalf("splitFullMethodName(%q): invalid label %q", s, v)
+			}
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package grpcprom
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minHealthBackoff = time.Second
+	maxHealthBackoff = 30 * time.Second
+)
+
+// WatchHealth watches the serving status of the named service at the target
+// of cc with the grpc.health.v1.Health/Watch method and reports it in the
+// health_status metric until ctx is done. The empty service name is the
+// overall status of the server. While the watch is broken, the status is
+// reported as unknown and the watch is retried with backoff. It returns
+// when ctx is done or the server doesn't implement the health service.
+func (m *ClientMetrics) WatchHealth(ctx context.Context, cc *grpc.ClientConn, service string) error {
+	return m.handler.watchHealth(ctx, healthpb.NewHealthClient(cc), cc.Target(), service)
+}
+
+func (h *handler) watchHealth(ctx context.Context, client healthpb.HealthClient, target, service string) error {
+	g := h.healthStatus.WithLabelValues(target, service)
+	defer h.healthStatus.DeleteLabelValues(target, service)
+
+	backoff := minHealthBackoff
+	for {
+		err := watchHealth(ctx, client, service, func(s healthpb.HealthCheckResponse_ServingStatus) {
+			g.Set(float64(s))
+			backoff = minHealthBackoff
+		})
+		g.Set(float64(healthpb.HealthCheckResponse_UNKNOWN))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > maxHealthBackoff {
+			backoff = maxHealthBackoff
+		}
+	}
+}
+
+// watchHealth calls fn with each serving status of the service until the watch fails.
+func watchHealth(ctx context.Context, client healthpb.HealthClient, service string, fn func(healthpb.HealthCheckResponse_ServingStatus)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		fn(resp.GetStatus())
+	}
+}
+
+func newHealthStatus(subsys string, ms *metricSet, opts metricOptions) gaugeVec {
+	if opts.disable || subsys != "client" {
+		return noopGaugeVec{}
+	}
+	ms.setAggMode("health_status", aggSingle)
+	return ms.gaugeVec(
+		prometheus.GaugeOpts{
+			Name: "health_status",
+			Help: "Serving status of gRPC health-checked services (0: Unknown, 1: Serving, 2: NotServing, 3: ServiceUnknown).",
+		},
+		[]string{"grpc_target", "grpc_health_service"},
+	)
+}
@@ -0,0 +1,58 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestWatchHealth(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	check(t, err)
+	defer lis.Close()
+	srv := grpc.NewServer()
+	defer srv.Stop()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	check(t, err)
+	defer conn.Close()
+
+	m := NewClientMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.WatchHealth(ctx, conn, "pkg.Service") }()
+
+	g := m.handler.healthStatus.WithLabelValues(conn.Target(), "pkg.Service")
+	waitGauge := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(g) != float64(want); {
+			if time.Now().After(deadline) {
+				t.Fatalf("health_status = %v; want %v", testutil.ToFloat64(g), float64(want))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitGauge(healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+	hs.SetServingStatus("pkg.Service", healthpb.HealthCheckResponse_SERVING)
+	waitGauge(healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("pkg.Service", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitGauge(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("WatchHealth error = %v; want %v", err, context.Canceled)
+	}
+	if n := testutil.CollectAndCount(m, "grpc_client_health_status"); n != 0 {
+		t.Fatalf("health_status series = %d after return; want 0", n)
+	}
+}
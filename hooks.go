@@ -0,0 +1,106 @@
+package grpcprom
+
+import (
+	"context"
+	"time"
+)
+
+// An ObserverHook receives the measurements recorded by the metrics, such as
+// to mirror them into another system without another stats handler. Its
+// methods are called synchronously by the stats handler and must not block.
+// Embed NoopObserverHook to implement only some of them.
+type ObserverHook interface {
+	// OnRPCBegin is called when each attempt of an RPC begins.
+	OnRPCBegin(ctx context.Context, b RPCBegin)
+	// OnRPCEnd is called when an RPC ends, after its last attempt.
+	OnRPCEnd(ctx context.Context, e RPCEnd)
+	// OnConnBegin is called when a connection begins.
+	OnConnBegin(ctx context.Context)
+	// OnConnEnd is called when a connection ends.
+	OnConnEnd(ctx context.Context)
+}
+
+// RPCBegin is the beginning of an attempt of an RPC.
+type RPCBegin struct {
+	// Service is the name of the service.
+	Service string
+	// Method is the name of the method.
+	Method string
+	// Type is the type of the method (e.g. "Unary" or "BidiStream").
+	Type string
+	// Client reports whether the RPC is a client request.
+	Client bool
+	// Attempt is the number of the attempt, starting at one.
+	Attempt int
+	// Timeout is the time allotted by the deadline, if any.
+	Timeout time.Duration
+}
+
+// RPCEnd is the end of an RPC.
+type RPCEnd struct {
+	Outcome
+	// Type is the type of the method (e.g. "Unary" or "BidiStream").
+	Type string
+	// Client reports whether the RPC is a client request.
+	Client bool
+	// Attempts is the number of attempts of the RPC.
+	Attempts int
+	// SentBytes is the number of wire bytes sent.
+	SentBytes int
+	// RecvBytes is the number of wire bytes received.
+	RecvBytes int
+}
+
+// NoopObserverHook is an ObserverHook that does nothing,
+// which may be embedded to implement only some of its methods.
+type NoopObserverHook struct{}
+
+// OnRPCBegin does nothing.
+func (NoopObserverHook) OnRPCBegin(context.Context, RPCBegin) {}
+
+// OnRPCEnd does nothing.
+func (NoopObserverHook) OnRPCEnd(context.Context, RPCEnd) {}
+
+// OnConnBegin does nothing.
+func (NoopObserverHook) OnConnBegin(context.Context) {}
+
+// OnConnEnd does nothing.
+func (NoopObserverHook) OnConnEnd(context.Context) {}
+
+// observerHooks calls each of its hooks.
+type observerHooks []ObserverHook
+
+func (hs observerHooks) rpcBegin(ctx context.Context, v *rpcInfo, client bool) {
+	if len(hs) == 0 {
+		return
+	}
+	b := RPCBegin{
+		Service: v.server,
+		Method:  v.method,
+		Type:    v.typ,
+		Client:  client,
+		Attempt: v.attempts,
+		Timeout: v.budget,
+	}
+	for _, h := range hs {
+		h.OnRPCBegin(ctx, b)
+	}
+}
+
+func (hs observerHooks) rpcEnd(ctx context.Context, e RPCEnd) {
+	for _, h := range hs {
+		h.OnRPCEnd(ctx, e)
+	}
+}
+
+func (hs observerHooks) connBegin(ctx context.Context) {
+	for _, h := range hs {
+		h.OnConnBegin(ctx)
+	}
+}
+
+func (hs observerHooks) connEnd(ctx context.Context) {
+	for _, h := range hs {
+		h.OnConnEnd(ctx)
+	}
+}
@@ -0,0 +1,61 @@
+package grpcprom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+type testHook struct {
+	NoopObserverHook
+	begins []RPCBegin
+	ends   []RPCEnd
+	conns  int
+}
+
+func (h *testHook) OnRPCBegin(_ context.Context, b RPCBegin) { h.begins = append(h.begins, b) }
+func (h *testHook) OnRPCEnd(_ context.Context, e RPCEnd)     { h.ends = append(h.ends, e) }
+func (h *testHook) OnConnBegin(context.Context)              { h.conns++ }
+func (h *testHook) OnConnEnd(context.Context)                { h.conns-- }
+
+func TestObserverHooks(t *testing.T) {
+	hook := &testHook{}
+	m := NewServerMetrics(ObserverHooks(hook))
+	h := m.handler
+
+	ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{})
+	h.HandleConn(ctx, &stats.ConnBegin{})
+	if hook.conns != 1 {
+		t.Fatalf("conns after begin = %d; want 1", hook.conns)
+	}
+
+	begin := time.Now()
+	rctx, cancel := context.WithDeadline(ctx, begin.Add(time.Second))
+	defer cancel()
+	rctx = h.TagRPC(rctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(rctx, &stats.Begin{BeginTime: begin})
+	h.HandleRPC(rctx, &stats.InPayload{RecvTime: time.Now(), Length: 10, WireLength: 15})
+	h.HandleRPC(rctx, &stats.End{EndTime: time.Now(), Error: status.Error(codes.NotFound, "not found")})
+
+	if len(hook.begins) != 1 {
+		t.Fatalf("begins = %d; want 1", len(hook.begins))
+	}
+	if b := hook.begins[0]; b.Service != "pkg.Service" || b.Method != "Method" || b.Client || b.Attempt != 1 || b.Timeout != time.Second {
+		t.Errorf("unexpected begin: %+v", b)
+	}
+	if len(hook.ends) != 1 {
+		t.Fatalf("ends = %d; want 1", len(hook.ends))
+	}
+	if e := hook.ends[0]; e.Service != "pkg.Service" || e.Method != "Method" || e.Code != codes.NotFound || e.Attempts != 1 || e.RecvBytes != 15 {
+		t.Errorf("unexpected end: %+v", e)
+	}
+
+	h.HandleConn(ctx, &stats.ConnEnd{})
+	if hook.conns != 0 {
+		t.Fatalf("conns after end = %d; want 0", hook.conns)
+	}
+}
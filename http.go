@@ -0,0 +1,56 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc/stats"
+)
+
+// httpConns reports the connections of an http.Server to a stats.Handler,
+// because gRPC doesn't when it's served by grpc.Server.ServeHTTP.
+type httpConns struct {
+	sh   stats.Handler
+	ctxs sync.Map // net.Conn => context.Context
+}
+
+func (h *handler) instrumentHTTPServer(srv *http.Server) {
+	c := &httpConns{sh: h}
+	connContext, connState := srv.ConnContext, srv.ConnState
+	srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, conn)
+		}
+		return c.tag(ctx, conn)
+	}
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		c.handle(conn, state)
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+}
+
+func (c *httpConns) tag(ctx context.Context, conn net.Conn) context.Context {
+	ctx = c.sh.TagConn(ctx, &stats.ConnTagInfo{
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+	})
+	c.ctxs.Store(conn, ctx)
+	return ctx
+}
+
+func (c *httpConns) handle(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		if ctx, ok := c.ctxs.Load(conn); ok {
+			c.sh.HandleConn(ctx.(context.Context), &stats.ConnBegin{})
+		}
+	case http.StateHijacked, http.StateClosed:
+		if ctx, ok := c.ctxs.LoadAndDelete(conn); ok {
+			c.sh.HandleConn(ctx.(context.Context), &stats.ConnEnd{})
+		}
+	}
+}
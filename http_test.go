@@ -0,0 +1,31 @@
+package grpcprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHTTPServer(t *testing.T) {
+	m := NewServerMetrics()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.InstrumentHTTPServer(srv.Config)
+	srv.Start()
+
+	resp, err := http.Get(srv.URL)
+	check(t, err)
+	resp.Body.Close()
+	checkGauge(t, "connections_open", m.handler.connsOpen, 1)
+	checkGauge(t, "connections_total", m.handler.connsTotal, 1)
+
+	srv.Close()
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(m.handler.connsOpen) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package grpcprom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/keepalive"
+)
+
+// Reasons for which connections are closed by keepalive enforcement.
+const (
+	keepaliveTooManyPings = iota + 1
+	keepalivePingTimeout
+	keepaliveMaxIdle
+	keepaliveMaxAge
+)
+
+var keepaliveReasons = [...]string{
+	keepaliveTooManyPings: "too_many_pings",
+	keepalivePingTimeout:  "ping_timeout",
+	keepaliveMaxIdle:      "max_idle",
+	keepaliveMaxAge:       "max_age",
+}
+
+var (
+	keepalivePing = make([]byte, 8) // data of server keepalive pings
+	tooManyPings  = []byte("too_many_pings")
+)
+
+// keepaliveConns counts server connections closed by keepalive enforcement
+// by inspecting the HTTP/2 frames written to connections from a Listener.
+// A GOAWAY for too many pings is definitive. A connection closed by the
+// server without reading anything since its last keepalive ping timed out.
+// A graceful GOAWAY is attributed to the maximum connection age or idle time
+// of the server's keepalive parameters, if either has elapsed.
+// A nil keepaliveConns does nothing.
+type keepaliveConns struct {
+	params keepalive.ServerParameters
+	total  [len(keepaliveReasons)]prometheus.Counter
+	vec    *prometheus.CounterVec
+}
+
+func newKeepalive(subsys string, ms *metricSet, params keepalive.ServerParameters, opts metricOptions) *keepaliveConns {
+	if opts.disable || subsys != "server" {
+		return nil
+	}
+	k := &keepaliveConns{
+		params: params,
+		vec: ms.counterVec(
+			prometheus.CounterOpts{
+				Name: "connections_keepalive_closed_total",
+				Help: "Total number of gRPC server connections closed by keepalive enforcement.",
+			},
+			[]string{"grpc_reason"},
+		),
+	}
+	for i, reason := range keepaliveReasons {
+		if reason != "" {
+			k.total[i] = k.vec.WithLabelValues(reason)
+		}
+	}
+	return k
+}
+
+func (k *keepaliveConns) listener(lis net.Listener) net.Listener {
+	if k == nil {
+		return lis
+	}
+	return &keepaliveListener{Listener: lis, k: k}
+}
+
+func (k *keepaliveConns) Describe(ch chan<- *prometheus.Desc) {
+	if k != nil {
+		k.vec.Describe(ch)
+	}
+}
+
+func (k *keepaliveConns) Collect(ch chan<- prometheus.Metric) {
+	if k != nil {
+		k.vec.Collect(ch)
+	}
+}
+
+type keepaliveListener struct {
+	net.Listener
+	k *keepaliveConns
+}
+
+func (lis *keepaliveListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	c := &keepaliveConn{Conn: conn, k: lis.k, start: now}
+	c.frames = frameScanner{keep: keepKeepaliveFrame, frame: c.frame}
+	c.lastRead.Store(now)
+	c.lastActive.Store(now)
+	return c, nil
+}
+
+type keepaliveConn struct {
+	net.Conn
+	k     *keepaliveConns
+	start int64 // unix nanos
+
+	lastRead   atomic.Int64 // unix nanos
+	lastActive atomic.Int64 // unix nanos of the last HEADERS or DATA written
+	lastPing   atomic.Int64 // unix nanos of the last keepalive PING written
+	peerClosed atomic.Bool
+	reason     atomic.Int32
+	once       sync.Once
+
+	frames frameScanner // guarded by the single writer
+	now    int64        // unix nanos of the current write, guarded by the single writer
+}
+
+func (c *keepaliveConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	if err != nil {
+		c.peerClosed.Store(true)
+	}
+	return n, err
+}
+
+func (c *keepaliveConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.now = time.Now().UnixNano()
+	c.frames.scan(b[:n])
+	return n, err
+}
+
+func (c *keepaliveConn) Close() error {
+	c.once.Do(func() {
+		reason := c.reason.Load()
+		if reason == 0 && !c.peerClosed.Load() && c.lastPing.Load() > c.lastRead.Load() {
+			reason = keepalivePingTimeout
+		}
+		if reason != 0 {
+			c.k.total[reason].Inc()
+		}
+	})
+	return c.Conn.Close()
+}
+
+func keepKeepaliveFrame(typ byte) bool {
+	return typ == framePing || typ == frameGoAway
+}
+
+// frame handles a complete frame written to the connection.
+func (c *keepaliveConn) frame(typ, flags byte, payload []byte) {
+	now := c.now
+	switch typ {
+	case frameData, frameHeaders:
+		c.lastActive.Store(now)
+	case framePing:
+		if flags&flagAck == 0 && bytes.Equal(payload, keepalivePing) {
+			c.lastPing.Store(now)
+		}
+	case frameGoAway:
+		if len(payload) < 8 {
+			return
+		}
+		lastStreamID := binary.BigEndian.Uint32(payload[:4]) & math.MaxInt32
+		code := binary.BigEndian.Uint32(payload[4:8])
+		switch {
+		case code == errCodeEnhanceYourCalm && bytes.Equal(payload[8:], tooManyPings):
+			c.reason.CompareAndSwap(0, keepaliveTooManyPings)
+		case code == errCodeNo && lastStreamID == math.MaxInt32:
+			// The first GOAWAY of a graceful close.
+			p := c.k.params
+			if age := time.Duration(now - c.start); p.MaxConnectionAge > 0 && age >= p.MaxConnectionAge*9/10 {
+				c.reason.CompareAndSwap(0, keepaliveMaxAge)
+			} else if idle := time.Duration(now - c.lastActive.Load()); p.MaxConnectionIdle > 0 && idle >= p.MaxConnectionIdle {
+				c.reason.CompareAndSwap(0, keepaliveMaxIdle)
+			}
+		}
+	}
+}
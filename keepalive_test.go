@@ -0,0 +1,144 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+func TestKeepaliveMaxIdle(t *testing.T) {
+	params := keepalive.ServerParameters{MaxConnectionIdle: 50 * time.Millisecond}
+	m := NewServerMetrics(KeepaliveParams(params), ConnectionsKeepaliveClosedTotal(Enable()))
+	lis, err := net.Listen("tcp", "localhost:0")
+	check(t, err)
+	srv := grpc.NewServer(grpc.KeepaliveParams(params))
+	defer srv.Stop()
+	go srv.Serve(m.Listener(lis))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	check(t, err)
+	defer conn.Close()
+
+	total := m.handler.keepalive.total[keepaliveMaxIdle]
+	for testutil.ToFloat64(total) != 1 {
+		if ctx.Err() != nil {
+			t.Fatal("connection not closed for max idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepaliveFrames(t *testing.T) {
+	k := newKeepalive("server", newMetricSet(defaultNamespace, "server"), keepalive.ServerParameters{}, metricOptions{})
+	tests := []struct {
+		name  string
+		raw   []byte // written before the frames
+		write func(*http2.Framer)
+		read  bool
+		want  int
+	}{
+		{
+			name: "too_many_pings",
+			write: func(fr *http2.Framer) {
+				fr.WriteSettings()
+				fr.WriteGoAway(1, http2.ErrCodeEnhanceYourCalm, []byte("too_many_pings"))
+			},
+			want: keepaliveTooManyPings,
+		},
+		{
+			name: "ping_timeout",
+			write: func(fr *http2.Framer) {
+				fr.WriteSettings()
+				fr.WritePing(false, [8]byte{})
+			},
+			want: keepalivePingTimeout,
+		},
+		{
+			name: "ping_acked",
+			write: func(fr *http2.Framer) {
+				fr.WriteSettings()
+				fr.WritePing(false, [8]byte{})
+			},
+			read: true,
+		},
+		{
+			name: "stopped",
+			write: func(fr *http2.Framer) {
+				fr.WriteSettings()
+				fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+			},
+		},
+		{
+			// The start of a TLS handshake record precedes frames
+			// which would otherwise be found.
+			name: "encrypted",
+			raw:  []byte{0x16, 0x03, 0x03, 0x00, 0x7a},
+			write: func(fr *http2.Framer) {
+				fr.WriteGoAway(1, http2.ErrCodeEnhanceYourCalm, []byte("too_many_pings"))
+				fr.WritePing(false, [8]byte{})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			go func() {
+				var b [1024]byte
+				for {
+					if _, err := client.Read(b[:]); err != nil {
+						return
+					}
+				}
+			}()
+			lis := k.listener(&pipeListener{conn: server})
+			conn, err := lis.Accept()
+			check(t, err)
+			var before [len(keepaliveReasons)]float64
+			for i, c := range k.total {
+				if c != nil {
+					before[i] = testutil.ToFloat64(c)
+				}
+			}
+			_, err = conn.Write(tt.raw)
+			check(t, err)
+			tt.write(http2.NewFramer(conn, nil))
+			if tt.read {
+				time.Sleep(time.Millisecond)
+				conn.(*keepaliveConn).lastRead.Store(time.Now().UnixNano())
+			}
+			conn.Close()
+			for i, c := range k.total {
+				if c == nil {
+					continue
+				}
+				want := before[i]
+				if i == tt.want {
+					want++
+				}
+				if got := testutil.ToFloat64(c); got != want {
+					t.Errorf("connections_keepalive_closed_total{grpc_reason=%q} = %v; want %v", keepaliveReasons[i], got, want)
+				}
+			}
+		})
+	}
+}
+
+type pipeListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (lis *pipeListener) Accept() (net.Conn, error) { return lis.conn, nil }
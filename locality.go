@@ -0,0 +1,88 @@
+package grpcprom
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// A LocalityFunc returns the locality, such as the zone, of the backend
+// with the given address. It's called for every client request and should
+// return quickly, for example from a map of the endpoints and localities
+// discovered by the xDS balancer or resolver.
+type LocalityFunc func(addr net.Addr) string
+
+// localityCollector tracks requests and latency by backend locality.
+// A nil localityCollector does nothing.
+type localityCollector struct {
+	fn      LocalityFunc
+	total   *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+}
+
+func newLocality(subsys string, ms *metricSet, fn LocalityFunc, buckets []float64) *localityCollector {
+	if fn == nil {
+		return nil
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultClientLatencyBuckets
+	}
+	return &localityCollector{
+		fn: fn,
+		total: ms.counterVec(
+			prometheus.CounterOpts{
+				Name: "locality_requests_total",
+				Help: fmt.Sprintf("Total number of gRPC %s requests completed by backend locality.", subsys),
+			},
+			[]string{"grpc_locality", "grpc_code"},
+		),
+		latency: ms.histogramVec(
+			prometheus.HistogramOpts{
+				Name:    "locality_latency_seconds",
+				Help:    fmt.Sprintf("Latency of gRPC %s requests by backend locality.", subsys),
+				Buckets: buckets,
+			},
+			[]string{"grpc_locality"},
+		),
+	}
+}
+
+// locate returns the locality of addr.
+func (c *localityCollector) locate(addr net.Addr) string {
+	if c == nil || addr == nil {
+		return ""
+	}
+	if l := c.fn(addr); l != "" {
+		return l
+	}
+	return unknown
+}
+
+func (c *localityCollector) observe(v *rpcInfo, code codes.Code, latency float64) {
+	if c == nil {
+		return
+	}
+	locality := v.locality
+	if locality == "" {
+		// The request ended before it was sent to a backend.
+		locality = unknown
+	}
+	c.total.WithLabelValues(locality, code.String()).Inc()
+	c.latency.WithLabelValues(locality).Observe(latency)
+}
+
+func (c *localityCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		c.total.Describe(ch)
+		c.latency.Describe(ch)
+	}
+}
+
+func (c *localityCollector) Collect(ch chan<- prometheus.Metric) {
+	if c != nil {
+		c.total.Collect(ch)
+		c.latency.Collect(ch)
+	}
+}
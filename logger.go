@@ -0,0 +1,14 @@
+package grpcprom
+
+// A Logger logs warnings about problems which the metrics can't report
+// otherwise, such as label values beyond their limits. It's implemented
+// by *slog.Logger. Each warning is logged once, rather than for each RPC.
+type Logger interface {
+	Warn(msg string, args ...any)
+}
+
+// noopLogger discards warnings, so that the metrics don't write to the
+// global logger unless a Logger is given.
+type noopLogger struct{}
+
+func (noopLogger) Warn(string, ...any) {}
@@ -0,0 +1,47 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Warn(msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func TestLogger(t *testing.T) {
+	log := &testLogger{}
+	m := NewServerMetrics(
+		WithLogger(log),
+		Caller(CallerFromMetadata("x-caller"), 1),
+		ExtraLabels([]string{"tenant"}, func(context.Context, string) []string { return nil }),
+	)
+	h := m.handler
+	for _, caller := range []string{"a", "b", "c"} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-caller", caller))
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	if len(log.msgs) != 2 {
+		t.Fatalf("unexpected warnings: %q", log.msgs)
+	}
+	for i, want := range []string{"extra labels", "caller limit"} {
+		if !strings.Contains(log.msgs[i], want) {
+			t.Errorf("warning %d: got: %q; want: %q", i, log.msgs[i], want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package grpcprom
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataFrames are the grpc_frame label values of metadata, by index.
+var metadataFrames = [2]string{header, trailer}
+
+// metadataObserver observes the size or number of entries of application
+// metadata in headers and trailers. A nil metadataObserver does nothing.
+type metadataObserver struct {
+	observer
+	keys    map[string]bool // nil => all unreserved keys
+	entries bool
+}
+
+func newMetadataBytes(subsys string, ms *metricSet, prefix []string, opts histogramOptions) *metadataObserver {
+	if opts.disable {
+		return nil
+	}
+	return &metadataObserver{
+		observer: newMetadataHistogram(subsys, ms, prefix, "metadata_bytes", "Bytes of application metadata", opts),
+		keys:     opts.mdKeys,
+	}
+}
+
+func newMetadataEntries(subsys string, ms *metricSet, prefix []string, opts histogramOptions) *metadataObserver {
+	if opts.disable {
+		return nil
+	}
+	return &metadataObserver{
+		observer: newMetadataHistogram(subsys, ms, prefix, "metadata_entries", "Number of application metadata entries", opts),
+		keys:     opts.mdKeys,
+		entries:  true,
+	}
+}
+
+func newMetadataHistogram(subsys string, ms *metricSet, prefix []string, name, help string, opts histogramOptions) observer {
+	labels := labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_direction", "grpc_frame")
+	return newHistogramObserver(ms, name, fmt.Sprintf("%s in gRPC %s headers and trailers.", help, subsys), labels, opts)
+}
+
+// children returns the child observers of the method's label values
+// by direction (recv, sent) and frame (header, trailer).
+func (o *metadataObserver) children(lvs []string) (c [2][2]prometheus.Observer) {
+	for dir, dirLv := range [2]string{"recv", "sent"} {
+		for f, frame := range metadataFrames {
+			if o == nil {
+				c[dir][f] = noopChildObserver
+				continue
+			}
+			c[dir][f] = o.With(append(lvs[:len(lvs):len(lvs)], dirLv, frame)...)
+		}
+	}
+	return c
+}
+
+// init initializes the child observers of the method's label values.
+func (o *metadataObserver) init(lvs []string) error {
+	if o == nil {
+		return nil
+	}
+	for _, dirLv := range [2]string{"recv", "sent"} {
+		for _, frame := range metadataFrames {
+			if err := o.Init(append(lvs[:len(lvs):len(lvs)], dirLv, frame)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// observe observes the application metadata with the child observer.
+func (o *metadataObserver) observe(c prometheus.Observer, md metadata.MD) {
+	if o == nil {
+		return
+	}
+	size, entries := appMetadataSize(md, o.keys)
+	if o.entries {
+		c.Observe(float64(entries))
+	} else {
+		c.Observe(float64(size))
+	}
+}
+
+func (o *metadataObserver) Describe(ch chan<- *prometheus.Desc) {
+	if o != nil {
+		o.observer.Describe(ch)
+	}
+}
+
+func (o *metadataObserver) Collect(ch chan<- prometheus.Metric) {
+	if o != nil {
+		o.observer.Collect(ch)
+	}
+}
+
+// reservedMetadata reports whether the metadata key is set by gRPC or HTTP/2
+// rather than by the application.
+func reservedMetadata(k string) bool {
+	switch k {
+	case "content-type", "user-agent", "te":
+		return true
+	}
+	return strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-")
+}
+
+// appMetadataSize returns the estimated size and number of entries of the
+// application metadata, which is restricted to the given keys, if any.
+// Like metadataSize, the size is the length of its keys and encoded values.
+func appMetadataSize(md metadata.MD, keys map[string]bool) (size, entries int) {
+	for k, vs := range md {
+		if keys != nil {
+			if !keys[k] {
+				continue
+			}
+		} else if reservedMetadata(k) {
+			continue
+		}
+		binary := strings.HasSuffix(k, "-bin")
+		for _, v := range vs {
+			size += len(k)
+			if binary {
+				size += base64.RawStdEncoding.EncodedLen(len(v))
+			} else {
+				size += len(v)
+			}
+			entries++
+		}
+	}
+	return size, entries
+}
+
+// observeMetadata observes the application metadata of a header or trailer.
+func (h *handler) observeMetadata(v *rpcInfo, sent, trailer bool, md metadata.MD) {
+	if h.mdBytes == nil && h.mdEntries == nil {
+		return
+	}
+	dir, f := 0, 0
+	if sent {
+		dir = 1
+	}
+	if trailer {
+		f = 1
+	}
+	m := h.methodChildren(v.methodInfo)
+	h.mdBytes.observe(m.mdBytes[dir][f], md)
+	h.mdEntries.observe(m.mdEntries[dir][f], md)
+}
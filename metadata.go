@@ -0,0 +1,148 @@
+package grpcprom
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricMetadata is the metadata of a metric, such as for generating
+// documentation or registering schemas.
+type MetricMetadata struct {
+	// Name is the fully-qualified name of the metric.
+	Name string
+	// Type is the type of the metric.
+	Type dto.MetricType
+	// Help is the help text of the metric.
+	Help string
+	// Labels are the names of the metric's labels.
+	Labels []string
+	// Buckets are the upper bounds of the buckets of a histogram.
+	Buckets []float64
+	// MethodBuckets are the upper bounds of the buckets of a histogram
+	// by the full names of methods for which they're overridden.
+	MethodBuckets map[string][]float64
+}
+
+// A metricSet creates the metrics of a handler and records their metadata
+// as they're created, so that it's taken from the same options.
+type metricSet struct {
+	namespace string
+	subsystem string
+	mds       []MetricMetadata
+	index     map[string]int     // short name => index of metadata
+	modes     map[string]aggMode // short name => aggregation mode, if not by type
+}
+
+func newMetricSet(namespace, subsystem string) *metricSet {
+	return &metricSet{
+		namespace: namespace,
+		subsystem: subsystem,
+		index:     make(map[string]int),
+		modes:     make(map[string]aggMode),
+	}
+}
+
+// add records the metadata of the named metric and returns the namespace and
+// subsystem of its fully-qualified name. Metrics sharing a name, such as
+// histograms with buckets overridden for methods, are recorded once.
+func (s *metricSet) add(typ dto.MetricType, name, help string, labels []string, buckets []float64) (namespace, subsystem string) {
+	if _, ok := s.index[name]; !ok {
+		s.index[name] = len(s.mds)
+		s.mds = append(s.mds, MetricMetadata{
+			Name:    prometheus.BuildFQName(s.namespace, s.subsystem, name),
+			Type:    typ,
+			Help:    help,
+			Labels:  append([]string(nil), labels...),
+			Buckets: append([]float64(nil), buckets...),
+		})
+	}
+	return s.namespace, s.subsystem
+}
+
+// setMethodBuckets records the buckets of the named histogram
+// which are overridden for methods.
+func (s *metricSet) setMethodBuckets(name string, buckets map[string][]float64) {
+	if i, ok := s.index[name]; ok && len(buckets) > 0 {
+		s.mds[i].MethodBuckets = buckets
+	}
+}
+
+// setAggMode sets the way series of the named metric are combined by an
+// Aggregator, which is otherwise by their type.
+func (s *metricSet) setAggMode(name string, mode aggMode) {
+	s.modes[name] = mode
+}
+
+// aggModes returns the way series are combined by fully-qualified name.
+func (s *metricSet) aggModes() map[string]aggMode {
+	modes := make(map[string]aggMode, len(s.mds))
+	for name, i := range s.index {
+		mode, ok := s.modes[name]
+		if !ok {
+			mode = aggModeOfType(s.mds[i].Type)
+		}
+		modes[s.mds[i].Name] = mode
+	}
+	return modes
+}
+
+func (s *metricSet) desc(typ dto.MetricType, name, help string, labels []string) *prometheus.Desc {
+	namespace, subsystem := s.add(typ, name, help, labels, nil)
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+func (s *metricSet) counter(opts prometheus.CounterOpts) prometheus.Counter {
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_COUNTER, opts.Name, opts.Help, nil, nil)
+	return prometheus.NewCounter(opts)
+}
+
+func (s *metricSet) gauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_GAUGE, opts.Name, opts.Help, nil, nil)
+	return prometheus.NewGauge(opts)
+}
+
+func (s *metricSet) counterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_COUNTER, opts.Name, opts.Help, labels, nil)
+	return prometheus.NewCounterVec(opts, labels)
+}
+
+func (s *metricSet) gaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_GAUGE, opts.Name, opts.Help, labels, nil)
+	return prometheus.NewGaugeVec(opts, labels)
+}
+
+func (s *metricSet) histogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_HISTOGRAM, opts.Name, opts.Help, labels, buckets)
+	return prometheus.NewHistogramVec(opts, labels)
+}
+
+func (s *metricSet) summaryVec(opts prometheus.SummaryOpts, labels []string) *prometheus.SummaryVec {
+	opts.Namespace, opts.Subsystem = s.add(dto.MetricType_SUMMARY, opts.Name, opts.Help, labels, nil)
+	return prometheus.NewSummaryVec(opts, labels)
+}
+
+// metadata returns the metadata of the metrics created by the handler,
+// sorted by name.
+func (h *handler) metadata() []MetricMetadata {
+	mds := make([]MetricMetadata, len(h.metrics.mds))
+	for i, md := range h.metrics.mds {
+		md.Labels = append([]string(nil), md.Labels...)
+		md.Buckets = append([]float64(nil), md.Buckets...)
+		if md.MethodBuckets != nil {
+			buckets := make(map[string][]float64, len(md.MethodBuckets))
+			for method, v := range md.MethodBuckets {
+				buckets[method] = append([]float64(nil), v...)
+			}
+			md.MethodBuckets = buckets
+		}
+		mds[i] = md
+	}
+	sort.Slice(mds, func(i, j int) bool { return mds[i].Name < mds[j].Name })
+	return mds
+}
@@ -0,0 +1,46 @@
+package grpcprom
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// methodHistograms is a histogram with buckets overridden for some methods.
+// The histograms share their descriptors, so only the default histogram is
+// described, and each series is collected from the histogram of its method.
+type methodHistograms struct {
+	observer
+	methods map[string]observer // full method name => histogram
+}
+
+// newMethodHistograms returns a histogram with the default buckets, which
+// is wrapped with histograms of the overridden buckets of methods, if any.
+func newMethodHistograms(opts histogramOptions, newHistogram func(buckets []float64) observer) observer {
+	def := newHistogram(opts.buckets)
+	if len(opts.methodBuckets) == 0 {
+		return def
+	}
+	m := &methodHistograms{
+		observer: def,
+		methods:  make(map[string]observer, len(opts.methodBuckets)),
+	}
+	for name, buckets := range opts.methodBuckets {
+		m.methods[name] = newHistogram(buckets)
+	}
+	return m
+}
+
+func (m *methodHistograms) Collect(ch chan<- prometheus.Metric) {
+	m.observer.Collect(ch)
+	for _, o := range m.methods {
+		o.Collect(ch)
+	}
+}
+
+// methodObserver returns the observer of the full method name,
+// which has its overridden buckets, if any.
+func methodObserver(o observer, name string) observer {
+	if m, ok := o.(*methodHistograms); ok {
+		if o, ok := m.methods[name]; ok {
+			return o
+		}
+	}
+	return o
+}
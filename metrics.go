@@ -4,29 +4,130 @@
 //
 //  grpc_client_connections_open [gauge] Number of gRPC client connections open.
 //  grpc_client_connections_total [counter] Total number of gRPC client connections opened.
+//  grpc_client_connections_idle [gauge] Number of gRPC client connections open without active requests.
+//  grpc_client_connection_idle_seconds [histogram] Duration of gRPC client connections idle periods.
 //  grpc_client_requests_pending{grpc_type,grpc_service,grpc_method} [gauge] Number of gRPC client requests pending.
+//  grpc_client_requests_pending_max{grpc_type,grpc_service,grpc_method} [gauge] Maximum number of gRPC client requests pending since last collected.
+//  grpc_client_streams_open{grpc_type,grpc_service,grpc_method} [gauge] Number of gRPC client streams open.
+//  grpc_client_stream_messages_open{grpc_type,grpc_service,grpc_method} [gauge] Number of messages sent and received by open gRPC client streams.
 //  grpc_client_requests_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC client requests completed.
+//  grpc_client_attempts_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC client request attempts completed.
+//  grpc_client_retry_attempts_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC client request attempts retried.
+//  grpc_client_transparent_retries_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC client request attempts retried transparently.
+//  grpc_client_request_attempts{grpc_type,grpc_service,grpc_method} [histogram] Number of attempts of gRPC client requests.
+//  grpc_client_deprecated_requests_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC client requests of deprecated methods completed.
+//  grpc_client_requests_canceled_total{grpc_type,grpc_service,grpc_method,grpc_cause} [counter] Total number of gRPC client requests completed with the Canceled code by cause.
+//  grpc_client_requests_trailers_only_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC client requests completed with a trailers-only response.
 //  grpc_client_latency_seconds{grpc_type,grpc_service,grpc_method,grpc_code} [histogram] Latency of gRPC client requests.
+//  grpc_client_latency_max_seconds{grpc_type,grpc_service,grpc_method} [gauge] Maximum latency of gRPC client requests.
+//  grpc_client_latency_ewma_seconds{grpc_type,grpc_service,grpc_method} [gauge] Exponentially-weighted moving average latency of gRPC client requests.
+//  grpc_client_timeout_seconds{grpc_type,grpc_service,grpc_method} [histogram] Timeout of gRPC client requests with deadlines.
+//  grpc_client_requests_without_deadline_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC client requests begun without deadlines.
+//  grpc_client_deadline_utilization_ratio{grpc_type,grpc_service,grpc_method} [histogram] Ratio of latency to the time allotted by the deadline of gRPC client requests.
+//  grpc_client_pick_delay_seconds{grpc_type,grpc_service,grpc_method} [histogram] Delay of gRPC client request attempts before their headers are sent, including balancer picks.
+//  grpc_client_last_error_timestamp_seconds{grpc_type,grpc_service,grpc_method,grpc_code} [gauge] Unix time of the last gRPC client request completed with each error code.
 //  grpc_client_recv_bytes{grpc_type,grpc_service,grpc_method,grpc_frame} [histogram] Bytes received in gRPC client responses.
 //  grpc_client_sent_bytes{grpc_type,grpc_service,grpc_method,grpc_frame} [histogram] Bytes sent in gRPC client requests.
+//  grpc_client_metadata_bytes{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_frame} [histogram] Bytes of application metadata in gRPC client headers and trailers.
+//  grpc_client_metadata_entries{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_frame} [histogram] Number of application metadata entries in gRPC client headers and trailers.
+//  grpc_client_request_size_bytes{grpc_type,grpc_service,grpc_method} [histogram] Total bytes of gRPC client requests.
+//  grpc_client_response_size_bytes{grpc_type,grpc_service,grpc_method} [histogram] Total bytes of gRPC client responses.
+//  grpc_client_request_messages{grpc_type,grpc_service,grpc_method} [histogram] Number of messages in gRPC client client-streaming requests.
+//  grpc_client_upload_seconds{grpc_type,grpc_service,grpc_method} [histogram] Duration from the first to the last message of gRPC client client-streaming requests.
+//  grpc_client_messages_total{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_compressed} [counter] Total number of gRPC client messages by direction and compression.
+//  grpc_client_response_size_ratio{grpc_type,grpc_service,grpc_method} [histogram] Ratio of response bytes to request bytes of gRPC client unary requests.
+//  grpc_client_last_message_age_seconds{grpc_type,grpc_service,grpc_method} [gauge] Maximum seconds since the last message of open gRPC client streams.
+//  grpc_client_stale_streams_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC client streams open longer than their maximum age.
+//  grpc_client_oversized_messages_total{grpc_type,grpc_service,grpc_method,grpc_direction} [counter] Total number of gRPC client messages larger than the maximum size of their method.
+//  grpc_client_top_requests{grpc_key} [gauge] Estimated number of gRPC client requests completed by the top keys.
+//  grpc_client_top_bytes{grpc_key} [gauge] Estimated number of bytes sent and received in gRPC client requests by the top keys.
+//  grpc_client_locality_requests_total{grpc_locality,grpc_code} [counter] Total number of gRPC client requests completed by backend locality.
+//  grpc_client_locality_latency_seconds{grpc_locality} [histogram] Latency of gRPC client requests by backend locality.
+//  grpc_client_circuit_breaker_state{grpc_breaker} [gauge] State of gRPC client circuit breakers (0: Closed, 1: HalfOpen, 2: Open).
+//  grpc_client_health_status{grpc_target,grpc_health_service} [gauge] Serving status of gRPC health-checked services (0: Unknown, 1: Serving, 2: NotServing, 3: ServiceUnknown).
+//  grpc_client_connection_attempts_total{grpc_target} [counter] Total number of gRPC client connections dialed.
+//  grpc_client_connection_failures_total{grpc_target,grpc_reason} [counter] Total number of gRPC client connections which failed to be established.
+//  grpc_client_reconnect_backoff_seconds{grpc_target} [histogram] Duration of gRPC client backoffs between failed connection attempts.
+//  grpc_client_http2_rst_stream_total{grpc_direction,grpc_http2_error} [counter] Total number of HTTP/2 RST_STREAM frames of gRPC client connections.
+//  grpc_client_goaway_received_total{grpc_http2_error} [counter] Total number of gRPC client connections which received an HTTP/2 GOAWAY frame.
+//  grpc_client_stats_handler_overhead_seconds{grpc_event} [histogram] Time spent handling gRPC client stats events by the metrics.
+//  grpc_client_tcp_rtt_seconds{grpc_peer} [gauge] Maximum smoothed round-trip time of gRPC client TCP connections.
+//  grpc_client_tcp_retransmits{grpc_peer} [gauge] Number of segments retransmitted by open gRPC client TCP connections.
 //
 //  grpc_server_connections_open [gauge] Number of gRPC server connections open.
 //  grpc_server_connections_total [counter] Total number of gRPC server connections opened.
+//  grpc_server_connections_keepalive_closed_total{grpc_reason} [counter] Total number of gRPC server connections closed by keepalive enforcement.
+//  grpc_server_connections_idle [gauge] Number of gRPC server connections open without active requests.
+//  grpc_server_connection_idle_seconds [histogram] Duration of gRPC server connections idle periods.
 //  grpc_server_requests_pending{grpc_type,grpc_service,grpc_method} [gauge] Number of gRPC server requests pending.
+//  grpc_server_requests_pending_max{grpc_type,grpc_service,grpc_method} [gauge] Maximum number of gRPC server requests pending since last collected.
+//  grpc_server_handlers_running{grpc_type,grpc_service,grpc_method} [gauge] Number of gRPC server handlers running.
+//  grpc_server_streams_open{grpc_type,grpc_service,grpc_method} [gauge] Number of gRPC server streams open.
+//  grpc_server_stream_messages_open{grpc_type,grpc_service,grpc_method} [gauge] Number of messages sent and received by open gRPC server streams.
 //  grpc_server_requests_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC server requests completed.
+//  grpc_server_deprecated_requests_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC server requests of deprecated methods completed.
+//  grpc_server_requests_trailers_only_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC server requests completed with a trailers-only response.
+//  grpc_server_requests_rejected_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter] Total number of gRPC server requests rejected before being handled.
+//  grpc_server_requests_canceled_total{grpc_type,grpc_service,grpc_method,grpc_cause} [counter] Total number of gRPC server requests completed with the Canceled code by cause.
+//  grpc_server_requests_client_canceled_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC server requests canceled by their clients while being handled.
+//  grpc_server_auth_failures_total{grpc_type,grpc_service,grpc_method,grpc_code,grpc_auth_scheme} [counter] Total number of gRPC server requests completed with Unauthenticated or PermissionDenied by auth scheme presented.
 //  grpc_server_latency_seconds{grpc_type,grpc_service,grpc_method,grpc_code} [histogram] Latency of gRPC server requests.
+//  grpc_server_operation_duration_seconds{grpc_type,grpc_service,grpc_method,grpc_operation} [histogram] Duration of operations timed in gRPC server handlers.
+//  grpc_server_latency_max_seconds{grpc_type,grpc_service,grpc_method} [gauge] Maximum latency of gRPC server requests.
+//  grpc_server_latency_ewma_seconds{grpc_type,grpc_service,grpc_method} [gauge] Exponentially-weighted moving average latency of gRPC server requests.
+//  grpc_server_timeout_seconds{grpc_type,grpc_service,grpc_method} [histogram] Timeout of gRPC server requests with deadlines.
+//  grpc_server_requests_without_deadline_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC server requests begun without deadlines.
+//  grpc_server_deadline_utilization_ratio{grpc_type,grpc_service,grpc_method} [histogram] Ratio of latency to the time allotted by the deadline of gRPC server requests.
+//  grpc_server_last_error_timestamp_seconds{grpc_type,grpc_service,grpc_method,grpc_code} [gauge] Unix time of the last gRPC server request completed with each error code.
 //  grpc_server_recv_bytes{grpc_type,grpc_service,grpc_method,grpc_frame} [histogram] Bytes received in gRPC server requests.
 //  grpc_server_sent_bytes{grpc_type,grpc_service,grpc_method,grpc_frame} [histogram] Bytes sent in gRPC server responses.
+//  grpc_server_metadata_bytes{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_frame} [histogram] Bytes of application metadata in gRPC server headers and trailers.
+//  grpc_server_metadata_entries{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_frame} [histogram] Number of application metadata entries in gRPC server headers and trailers.
+//  grpc_server_request_size_bytes{grpc_type,grpc_service,grpc_method} [histogram] Total bytes of gRPC server requests.
+//  grpc_server_response_size_bytes{grpc_type,grpc_service,grpc_method} [histogram] Total bytes of gRPC server responses.
+//  grpc_server_request_messages{grpc_type,grpc_service,grpc_method} [histogram] Number of messages in gRPC server client-streaming requests.
+//  grpc_server_upload_seconds{grpc_type,grpc_service,grpc_method} [histogram] Duration from the first to the last message of gRPC server client-streaming requests.
+//  grpc_server_messages_total{grpc_type,grpc_service,grpc_method,grpc_direction,grpc_compressed} [counter] Total number of gRPC server messages by direction and compression.
+//  grpc_server_response_size_ratio{grpc_type,grpc_service,grpc_method} [histogram] Ratio of response bytes to request bytes of gRPC server unary requests.
+//  grpc_server_last_message_age_seconds{grpc_type,grpc_service,grpc_method} [gauge] Maximum seconds since the last message of open gRPC server streams.
+//  grpc_server_stale_streams_total{grpc_type,grpc_service,grpc_method} [counter] Total number of gRPC server streams open longer than their maximum age.
+//  grpc_server_oversized_messages_total{grpc_type,grpc_service,grpc_method,grpc_direction} [counter] Total number of gRPC server messages larger than the maximum size of their method.
+//  grpc_server_top_requests{grpc_key} [gauge] Estimated number of gRPC server requests completed by the top keys.
+//  grpc_server_top_bytes{grpc_key} [gauge] Estimated number of bytes sent and received in gRPC server requests by the top keys.
+//  grpc_server_circuit_breaker_state{grpc_breaker} [gauge] State of gRPC server circuit breakers (0: Closed, 1: HalfOpen, 2: Open).
+//  grpc_server_http2_rst_stream_total{grpc_direction,grpc_http2_error} [counter] Total number of HTTP/2 RST_STREAM frames of gRPC server connections.
+//  grpc_server_goaway_sent_total{grpc_http2_error} [counter] Total number of gRPC server connections drained by sending an HTTP/2 GOAWAY frame.
+//  grpc_server_stats_handler_overhead_seconds{grpc_event} [histogram] Time spent handling gRPC server stats events by the metrics.
+//  grpc_server_tcp_rtt_seconds{grpc_peer} [gauge] Maximum smoothed round-trip time of gRPC server TCP connections.
+//  grpc_server_tcp_retransmits{grpc_peer} [gauge] Number of segments retransmitted by open gRPC server TCP connections.
+//  grpc_server_handler_cpu_seconds_total{grpc_type,grpc_service,grpc_method} [counter] Total CPU time consumed by gRPC server handler goroutines.
+//
+// With the GoGRPCPrometheusMetrics option, the metrics of go-grpc-prometheus
+// are also provided (e.g. grpc_server_started_total, grpc_server_handled_total,
+// grpc_server_msg_received_total, grpc_server_msg_sent_total, and
+// grpc_server_handling_seconds).
 package grpcprom
 
 import (
+	"context"
 	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 // AllCodes is a slice of all gRPC codes.
@@ -50,6 +151,28 @@ var AllCodes = []codes.Code{
 	codes.Unauthenticated,
 }
 
+// Metrics is the interface implemented by both ClientMetrics and ServerMetrics,
+// so that they may be wired generically.
+type Metrics interface {
+	prometheus.Collector
+
+	// StatsHandler returns a stats.Handler for the metrics.
+	StatsHandler() stats.Handler
+	// Interceptors returns the unary and stream interceptors for the metrics.
+	// Their types differ between clients and servers: they're a
+	// grpc.UnaryClientInterceptor and grpc.StreamClientInterceptor for
+	// ClientMetrics and a grpc.UnaryServerInterceptor and
+	// grpc.StreamServerInterceptor for ServerMetrics.
+	Interceptors() (unary, stream any)
+	// Init initializes the metrics for srv with the given codes.
+	Init(srv *grpc.Server, codes ...codes.Code)
+}
+
+var (
+	_ Metrics = (*ClientMetrics)(nil)
+	_ Metrics = (*ServerMetrics)(nil)
+)
+
 // ClientMetrics is a collection of gRPC client metrics.
 type ClientMetrics struct {
 	handler *handler
@@ -57,9 +180,32 @@ type ClientMetrics struct {
 
 // NewClientMetrics returns new ClientMetrics with the given options.
 func NewClientMetrics(options ...Option) *ClientMetrics {
-	return &ClientMetrics{
+	m := &ClientMetrics{
 		handler: newMetrics("client", options...),
 	}
+	m.handler.mustRegister(m, "client")
+	return m
+}
+
+// NewClientMetricsWithError is like NewClientMetrics, but it returns an error
+// if the options are invalid or conflict with each other, such as buckets that
+// aren't increasing or buckets of a disabled metric, or if the metrics can't be
+// registered with the registerer given by WithRegisterer.
+func NewClientMetricsWithError(options ...Option) (*ClientMetrics, error) {
+	h, err := newMetricsWithError("client", options...)
+	if err != nil {
+		return nil, err
+	}
+	m := &ClientMetrics{handler: h}
+	if err := checkMetrics(m, "client"); err != nil {
+		return nil, err
+	}
+	if h.registerer != nil {
+		if err := register(h.registerer, m, "client"); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 // Describe sends the super-set of all possible descriptors of metrics
@@ -74,6 +220,23 @@ func (m *ClientMetrics) Collect(ch chan<- prometheus.Metric) {
 	m.handler.collect(ch)
 }
 
+// Metadata returns the metadata of every metric that may be collected,
+// as configured by the options, sorted by name.
+func (m *ClientMetrics) Metadata() []MetricMetadata {
+	return m.handler.metadata()
+}
+
+func (m *ClientMetrics) aggModes() map[string]aggMode {
+	return m.handler.metrics.aggModes()
+}
+
+// Register registers the metrics with r. Unlike r.Register, its error
+// explains which metric collides with those already registered and how
+// to avoid the collision.
+func (m *ClientMetrics) Register(r prometheus.Registerer) error {
+	return register(r, m, "client")
+}
+
 // StatsHandler returns a gRPC stats handler.
 func (m *ClientMetrics) StatsHandler() stats.Handler {
 	return m.handler
@@ -89,11 +252,111 @@ func (m *ClientMetrics) UnaryInterceptor() grpc.UnaryClientInterceptor {
 	return m.handler.unaryClientInterceptor
 }
 
+// Interceptors returns the gRPC client unary and stream interceptors,
+// which are a grpc.UnaryClientInterceptor and grpc.StreamClientInterceptor.
+func (m *ClientMetrics) Interceptors() (unary, stream any) {
+	return m.UnaryInterceptor(), m.StreamInterceptor()
+}
+
+// Dialer returns a dialer for grpc.WithContextDialer which wraps dial, or the default
+// TCP dialer if it's nil, tracks the TCP info and HTTP/2 stream resets of its connections,
+// and counts its failures. Connections are only wrapped to inspect their frames if those
+// metrics are enabled, which hides the *net.TCPConn from gRPC so that it can't set
+// TCP_USER_TIMEOUT.
+func (m *ClientMetrics) Dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	h := m.handler
+	return h.failuresDialer(h.rst.dialer(h.goAway.dialer(h.tcpConns.dialer(dial))))
+}
+
+// TransportCredentials returns transport credentials for grpc.WithTransportCredentials
+// which wrap creds and count their failed handshakes as TLS connection failures.
+func (m *ClientMetrics) TransportCredentials(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	if _, ok := m.handler.connFailures.(noopCounterVec); ok && m.handler.backoffs == nil {
+		return creds
+	}
+	return &failuresCreds{creds, m.handler}
+}
+
+// NamedDialOption returns a DialOption that installs a gRPC stats handler
+// which labels request metrics with the given connection name. It's used
+// instead of StatsHandler with the ConnLabel option to tell ClientConns apart.
+func (m *ClientMetrics) NamedDialOption(name string) grpc.DialOption {
+	return grpc.WithStatsHandler(namedClientHandler{m.handler, name})
+}
+
 // Init initializes the metrics for srv with the given codes.
+// It may be called again, such as after registering more services,
+// while requests are handled and metrics are collected.
 func (m *ClientMetrics) Init(srv *grpc.Server, codes ...codes.Code) {
-	for srvName, info := range srv.GetServiceInfo() {
-		m.handler.init(srvName, info.Methods, codes)
-	}
+	m.handler.initServer("", srv, initOptions{codes: codes})
+}
+
+// InitE is like Init, but it returns an error if srv is nil, if it has a
+// service without methods, if a method was already initialized, or if a
+// metric can't be created.
+func (m *ClientMetrics) InitE(srv *grpc.Server, codes ...codes.Code) error {
+	return m.handler.initServer("", srv, initOptions{codes: codes})
+}
+
+// InitWith is like InitE, but the codes and other choices
+// are given by the options.
+func (m *ClientMetrics) InitWith(srv *grpc.Server, opts ...InitOption) error {
+	return m.handler.initServer("", srv, newInitOptions(opts))
+}
+
+// InitMethods initializes the metrics for the methods of the named service
+// with the given codes, for callers which know their methods without
+// a grpc.Server, such as code generators and service registries.
+// Its errors are the same as InitE.
+func (m *ClientMetrics) InitMethods(service string, methods []grpc.MethodInfo, codes ...codes.Code) error {
+	return m.handler.init("", service, methods, initOptions{codes: codes})
+}
+
+// InitServiceDesc initializes the metrics for the methods of desc, such as
+// a generated pb.Foo_ServiceDesc, with the given codes. It returns an error
+// if desc is nil, and otherwise its errors are the same as InitE.
+func (m *ClientMetrics) InitServiceDesc(desc *grpc.ServiceDesc, codes ...codes.Code) error {
+	return m.handler.initServiceDesc("", desc, initOptions{codes: codes})
+}
+
+// InitFiles initializes the metrics for the methods of every service
+// described by files, or protoregistry.GlobalFiles if it's nil, with the
+// given codes. Its errors are the same as InitE.
+func (m *ClientMetrics) InitFiles(files *protoregistry.Files, codes ...codes.Code) error {
+	return m.handler.initFiles("", files, initOptions{codes: codes})
+}
+
+// InitServiceDescriptors initializes the metrics for the methods of the
+// services with the given codes. Its errors are the same as InitE.
+func (m *ClientMetrics) InitServiceDescriptors(services []protoreflect.ServiceDescriptor, codes ...codes.Code) error {
+	return m.handler.initServiceDescriptors("", services, initOptions{codes: codes})
+}
+
+// UnusedMethods returns the sorted full names of known methods
+// which have not completed any requests.
+func (m *ClientMetrics) UnusedMethods() []string {
+	return m.handler.unusedMethods()
+}
+
+// LatencyEWMA returns the exponentially-weighted moving average latency
+// of the full method name (e.g. "/pkg.Service/Method"), such as to feed
+// a custom load balancer, or false if it hasn't been observed or the
+// latency_ewma_seconds metric is disabled.
+func (m *ClientMetrics) LatencyEWMA(method string) (time.Duration, bool) {
+	return m.handler.latencyEWMA.duration(method)
+}
+
+// Subscribe calls fn with the outcome of each completed RPC, such as to feed
+// a circuit breaker, until unsubscribe is called. It's called synchronously
+// and must not block.
+func (m *ClientMetrics) Subscribe(fn func(Outcome)) (unsubscribe func()) {
+	return m.handler.subs.subscribe(fn)
+}
+
+// SetBreakerState reports the state of the named circuit breaker
+// in the circuit_breaker_state metric.
+func (m *ClientMetrics) SetBreakerState(name string, state BreakerState) {
+	m.handler.breakerState.WithLabelValues(name).Set(float64(state))
 }
 
 // ServerMetrics is a collection of gRPC server metrics.
@@ -103,9 +366,32 @@ type ServerMetrics struct {
 
 // NewServerMetrics returns new ServerMetrics with the given options.
 func NewServerMetrics(options ...Option) *ServerMetrics {
-	return &ServerMetrics{
+	m := &ServerMetrics{
 		handler: newMetrics("server", options...),
 	}
+	m.handler.mustRegister(m, "server")
+	return m
+}
+
+// NewServerMetricsWithError is like NewServerMetrics, but it returns an error
+// if the options are invalid or conflict with each other, such as buckets that
+// aren't increasing or buckets of a disabled metric, or if the metrics can't be
+// registered with the registerer given by WithRegisterer.
+func NewServerMetricsWithError(options ...Option) (*ServerMetrics, error) {
+	h, err := newMetricsWithError("server", options...)
+	if err != nil {
+		return nil, err
+	}
+	m := &ServerMetrics{handler: h}
+	if err := checkMetrics(m, "server"); err != nil {
+		return nil, err
+	}
+	if h.registerer != nil {
+		if err := register(h.registerer, m, "server"); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 // Describe sends the super-set of all possible descriptors of metrics
@@ -121,10 +407,120 @@ func (m *ServerMetrics) Collect(ch chan<- prometheus.Metric) {
 }
 
 // Init initializes the metrics for srv with the given codes.
+// It may be called again, such as after registering more services,
+// while requests are handled and metrics are collected.
 func (m *ServerMetrics) Init(srv *grpc.Server, codes ...codes.Code) {
-	for srvName, info := range srv.GetServiceInfo() {
-		m.handler.init(srvName, info.Methods, codes)
-	}
+	m.handler.initServer("", srv, initOptions{codes: codes})
+}
+
+// InitE is like Init, but it returns an error if srv is nil, if it has a
+// service without methods, if a method was already initialized, or if a
+// metric can't be created.
+func (m *ServerMetrics) InitE(srv *grpc.Server, codes ...codes.Code) error {
+	return m.handler.initServer("", srv, initOptions{codes: codes})
+}
+
+// InitWith is like InitE, but the codes and other choices
+// are given by the options.
+func (m *ServerMetrics) InitWith(srv *grpc.Server, opts ...InitOption) error {
+	return m.handler.initServer("", srv, newInitOptions(opts))
+}
+
+// InitMethods initializes the metrics for the methods of the named service
+// with the given codes, for callers which know their methods without
+// a grpc.Server, such as code generators and service registries.
+// Its errors are the same as InitE.
+func (m *ServerMetrics) InitMethods(service string, methods []grpc.MethodInfo, codes ...codes.Code) error {
+	return m.handler.init("", service, methods, initOptions{codes: codes})
+}
+
+// InitServiceDesc initializes the metrics for the methods of desc, such as
+// a generated pb.Foo_ServiceDesc, with the given codes. It returns an error
+// if desc is nil, and otherwise its errors are the same as InitE.
+func (m *ServerMetrics) InitServiceDesc(desc *grpc.ServiceDesc, codes ...codes.Code) error {
+	return m.handler.initServiceDesc("", desc, initOptions{codes: codes})
+}
+
+// InitFiles initializes the metrics for the methods of every service
+// described by files, or protoregistry.GlobalFiles if it's nil, with the
+// given codes. Its errors are the same as InitE.
+func (m *ServerMetrics) InitFiles(files *protoregistry.Files, codes ...codes.Code) error {
+	return m.handler.initFiles("", files, initOptions{codes: codes})
+}
+
+// InitServiceDescriptors initializes the metrics for the methods of the
+// services with the given codes. Its errors are the same as InitE.
+func (m *ServerMetrics) InitServiceDescriptors(services []protoreflect.ServiceDescriptor, codes ...codes.Code) error {
+	return m.handler.initServiceDescriptors("", services, initOptions{codes: codes})
+}
+
+// UnusedMethods returns the sorted full names of known methods
+// which have not completed any requests.
+func (m *ServerMetrics) UnusedMethods() []string {
+	return m.handler.unusedMethods()
+}
+
+// LatencyEWMA returns the exponentially-weighted moving average latency
+// of the full method name (e.g. "/pkg.Service/Method"), such as to feed
+// a custom load balancer, or false if it hasn't been observed or the
+// latency_ewma_seconds metric is disabled.
+func (m *ServerMetrics) LatencyEWMA(method string) (time.Duration, bool) {
+	return m.handler.latencyEWMA.duration(method)
+}
+
+// PendingRequests returns the number of pending requests of the service and
+// method (e.g. "pkg.Service" and "Method"), such as to shed load, without
+// collecting metrics and regardless of whether requests_pending is enabled.
+func (m *ServerMetrics) PendingRequests(service, method string) float64 {
+	return m.handler.pendingCounts.pending("/" + service + "/" + method)
+}
+
+// PendingRequestsTotal returns the number of pending requests of all methods.
+func (m *ServerMetrics) PendingRequestsTotal() float64 {
+	return float64(m.handler.pendingCounts.total.Load())
+}
+
+// Subscribe calls fn with the outcome of each completed RPC, such as to feed
+// a circuit breaker, until unsubscribe is called. It's called synchronously
+// and must not block.
+func (m *ServerMetrics) Subscribe(fn func(Outcome)) (unsubscribe func()) {
+	return m.handler.subs.subscribe(fn)
+}
+
+// SetBreakerState reports the state of the named circuit breaker
+// in the circuit_breaker_state metric.
+func (m *ServerMetrics) SetBreakerState(name string, state BreakerState) {
+	m.handler.breakerState.WithLabelValues(name).Set(float64(state))
+}
+
+// InitNamed initializes the metrics for srv with the given name and codes.
+// It's used with the ServerLabel option and the NamedStatsHandler.
+func (m *ServerMetrics) InitNamed(name string, srv *grpc.Server, codes ...codes.Code) {
+	m.handler.initServer(name, srv, initOptions{codes: codes})
+}
+
+// NamedStatsHandler returns a gRPC stats handler which labels metrics with
+// the given server name. It's used with the ServerLabel option to share
+// ServerMetrics between multiple servers.
+func (m *ServerMetrics) NamedStatsHandler(name string) stats.Handler {
+	return namedHandler{m.handler, name}
+}
+
+// Metadata returns the metadata of every metric that may be collected,
+// as configured by the options, sorted by name.
+func (m *ServerMetrics) Metadata() []MetricMetadata {
+	return m.handler.metadata()
+}
+
+func (m *ServerMetrics) aggModes() map[string]aggMode {
+	return m.handler.metrics.aggModes()
+}
+
+// Register registers the metrics with r. Unlike r.Register, its error
+// explains which metric collides with those already registered and how
+// to avoid the collision.
+func (m *ServerMetrics) Register(r prometheus.Registerer) error {
+	return register(r, m, "server")
 }
 
 // StatsHandler returns a gRPC stats handler.
@@ -142,23 +538,60 @@ func (m *ServerMetrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
 	return m.handler.unaryServerInterceptor
 }
 
+// Interceptors returns the gRPC server unary and stream interceptors,
+// which are a grpc.UnaryServerInterceptor and grpc.StreamServerInterceptor.
+func (m *ServerMetrics) Interceptors() (unary, stream any) {
+	return m.UnaryInterceptor(), m.StreamInterceptor()
+}
+
+// Listener returns a listener which wraps lis and tracks the TCP info
+// of its connections, the reasons they're closed by keepalive enforcement,
+// and their HTTP/2 stream resets. Connections are only wrapped to inspect
+// their frames if those metrics are enabled, which hides the *net.TCPConn
+// from gRPC so that it can't set TCP_USER_TIMEOUT.
+func (m *ServerMetrics) Listener(lis net.Listener) net.Listener {
+	h := m.handler
+	return h.rst.listener(h.goAway.listener(h.keepalive.listener(h.tcpConns.listener(lis))))
+}
+
+// InstrumentHTTPServer instruments the connections of srv, which serves gRPC
+// with grpc.Server.ServeHTTP, because gRPC doesn't report its connections
+// in that case. All of the server's connections are counted, including
+// those not used for gRPC. It must be called before srv starts serving.
+func (m *ServerMetrics) InstrumentHTTPServer(srv *http.Server) {
+	m.handler.instrumentHTTPServer(srv)
+}
+
+// TapHandle returns a gRPC server tap handle which wraps next and counts
+// the requests it rejects, which never reach the stats handler or interceptors.
+// Streams refused by the transport, such as beyond MaxConcurrentStreams,
+// aren't seen by tap handles.
+func (m *ServerMetrics) TapHandle(next tap.ServerInHandle) tap.ServerInHandle {
+	return m.handler.tapHandle(next)
+}
+
 var (
 	errNoop  = errors.New("noop metric")
 	noopDesc = prometheus.NewInvalidDesc(errNoop)
 )
 
+// An observer is a vector of observed values, such as a histogram.
+// Its children are resolved once and cached by the handler, so that
+// observations don't look up or copy label values.
 type observer interface {
 	prometheus.Collector
-	Init(lvs ...string)
-	Observe(value float64, lvs ...string)
+	Init(lvs ...string) error
+	With(lvs ...string) prometheus.Observer
 }
 
+var noopChildObserver = prometheus.ObserverFunc(func(float64) {})
+
 type noopObserver struct{}
 
-func (noopObserver) Describe(chan<- *prometheus.Desc)     {}
-func (noopObserver) Collect(chan<- prometheus.Metric)     {}
-func (noopObserver) Init(lvs ...string)                   {}
-func (noopObserver) Observe(value float64, lvs ...string) {}
+func (noopObserver) Describe(chan<- *prometheus.Desc)       {}
+func (noopObserver) Collect(chan<- prometheus.Metric)       {}
+func (noopObserver) Init(lvs ...string) error               { return nil }
+func (noopObserver) With(lvs ...string) prometheus.Observer { return noopChildObserver }
 
 type histogram struct {
 	m *prometheus.HistogramVec
@@ -166,13 +599,30 @@ type histogram struct {
 
 func (h *histogram) Collect(ch chan<- prometheus.Metric) { h.m.Collect(ch) }
 func (h *histogram) Describe(ch chan<- *prometheus.Desc) { h.m.Describe(ch) }
-func (h *histogram) Observe(v float64, lvs ...string)    { h.m.WithLabelValues(lvs...).Observe(v) }
-func (h *histogram) Init(lvs ...string)                  { h.m.GetMetricWithLabelValues(lvs...) }
+
+func (h *histogram) Init(lvs ...string) error {
+	_, err := h.m.GetMetricWithLabelValues(lvs...)
+	return err
+}
+func (h *histogram) With(lvs ...string) prometheus.Observer { return h.m.WithLabelValues(lvs...) }
+
+type summary struct {
+	m *prometheus.SummaryVec
+}
+
+func (s *summary) Collect(ch chan<- prometheus.Metric) { s.m.Collect(ch) }
+func (s *summary) Describe(ch chan<- *prometheus.Desc) { s.m.Describe(ch) }
+
+func (s *summary) Init(lvs ...string) error {
+	_, err := s.m.GetMetricWithLabelValues(lvs...)
+	return err
+}
+func (s *summary) With(lvs ...string) prometheus.Observer { return s.m.WithLabelValues(lvs...) }
 
 // counters is a histogram without the buckets... sum and count only.
 type counters struct {
-	sum *prometheus.CounterVec
-	num *prometheus.CounterVec
+	sum counterVec
+	num counterVec
 }
 
 func (m *counters) Collect(ch chan<- prometheus.Metric) {
@@ -185,15 +635,204 @@ func (m *counters) Describe(ch chan<- *prometheus.Desc) {
 	m.num.Describe(ch)
 }
 
-func (m *counters) Observe(v float64, lvs ...string) {
+func (m *counters) Init(lvs ...string) error {
+	if _, err := m.sum.GetMetricWithLabelValues(lvs...); err != nil {
+		return err
+	}
+	_, err := m.num.GetMetricWithLabelValues(lvs...)
+	return err
+}
+
+func (m *counters) With(lvs ...string) prometheus.Observer {
+	return &counterObserver{
+		sum: m.sum.WithLabelValues(lvs...),
+		num: m.num.WithLabelValues(lvs...),
+	}
+}
+
+// counterObserver is a child of counters.
+type counterObserver struct {
+	sum prometheus.Counter
+	num prometheus.Counter
+}
+
+func (o *counterObserver) Observe(v float64) {
 	// TODO: make atomic
-	m.sum.WithLabelValues(lvs...).Add(v)
-	m.num.WithLabelValues(lvs...).Inc()
+	o.sum.Add(v)
+	o.num.Inc()
+}
+
+// An adder is a vector of values which are changed by adding to them.
+type adder interface {
+	prometheus.Collector
+	Init(lvs ...string) error
+	With(lvs ...string) addend
+}
+
+// An addend is a child of an adder.
+type addend interface {
+	Add(delta float64)
+}
+
+type noopAdder struct{}
+
+func (noopAdder) Describe(chan<- *prometheus.Desc) {}
+func (noopAdder) Collect(chan<- prometheus.Metric) {}
+func (noopAdder) Init(lvs ...string) error         { return nil }
+func (noopAdder) With(lvs ...string) addend        { return noopGauge{} }
+
+// maxVec is a vector of gauges reporting the maximum of their observed values.
+type maxVec struct {
+	desc  *prometheus.Desc
+	reset bool // reset maximums to current values when collected
+
+	mu     sync.Mutex
+	values map[uint64][]*maxValue // hash of label values => values
+}
+
+type maxValue struct {
+	lvs []string
+	cur atomic.Uint64 // float64 bits
+	max atomic.Uint64 // float64 bits
+}
+
+// add adds delta to the current value and returns the sum.
+func (v *maxValue) add(delta float64) float64 {
+	for {
+		old := v.cur.Load()
+		sum := math.Float64frombits(old) + delta
+		if v.cur.CompareAndSwap(old, math.Float64bits(sum)) {
+			return sum
+		}
+	}
 }
 
-func (m *counters) Init(lvs ...string) {
-	m.sum.GetMetricWithLabelValues(lvs...)
-	m.num.GetMetricWithLabelValues(lvs...)
+// raise raises the maximum to value, if it's greater.
+func (v *maxValue) raise(value float64) {
+	for {
+		old := v.max.Load()
+		if value <= math.Float64frombits(old) || v.max.CompareAndSwap(old, math.Float64bits(value)) {
+			return
+		}
+	}
+}
+
+func newMaxVec(desc *prometheus.Desc, reset bool) *maxVec {
+	return &maxVec{
+		desc:   desc,
+		reset:  reset,
+		values: make(map[uint64][]*maxValue),
+	}
+}
+
+// get returns the value with the label values. It must be called with m.mu held.
+func (m *maxVec) get(lvs []string) *maxValue {
+	h := hashLabelValues(lvs)
+	for _, v := range m.values[h] {
+		if equalLabelValues(v.lvs, lvs) {
+			return v
+		}
+	}
+	v := &maxValue{lvs: append([]string(nil), lvs...)}
+	m.values[h] = append(m.values[h], v)
+	return v
+}
+
+func (m *maxVec) Describe(ch chan<- *prometheus.Desc) { ch <- m.desc }
+
+// Collect sends a snapshot of the values, so that observations
+// aren't blocked while the metrics are sent.
+func (m *maxVec) Collect(ch chan<- prometheus.Metric) {
+	type sample struct {
+		lvs []string
+		max float64
+	}
+	m.mu.Lock()
+	samples := make([]sample, 0, len(m.values))
+	for _, vs := range m.values {
+		for _, v := range vs {
+			max := v.max.Load()
+			if m.reset {
+				cur := v.cur.Load()
+				max = v.max.Swap(cur)
+				// The current value may have been raised since it was loaded.
+				v.raise(math.Float64frombits(v.cur.Load()))
+			}
+			samples = append(samples, sample{v.lvs, math.Float64frombits(max)})
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range samples {
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, s.max, s.lvs...)
+	}
+}
+
+func (m *maxVec) Init(lvs ...string) error {
+	m.mu.Lock()
+	m.get(lvs)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *maxVec) child(lvs []string) *maxChild {
+	m.mu.Lock()
+	v := m.get(lvs)
+	m.mu.Unlock()
+	return &maxChild{v: v}
+}
+
+func (m *maxVec) With(lvs ...string) prometheus.Observer { return m.child(lvs) }
+
+// maxAdderVec is a maxVec of current values, which are changed by adding to them.
+type maxAdderVec struct {
+	*maxVec
+}
+
+func (m maxAdderVec) With(lvs ...string) addend { return m.child(lvs) }
+
+// maxChild is a child of a maxVec.
+type maxChild struct {
+	v *maxValue
+}
+
+// Observe raises the maximum without locking the vector.
+func (c *maxChild) Observe(value float64) {
+	c.v.raise(value)
+}
+
+// Add adds to the current value and raises the maximum without locking the vector.
+func (c *maxChild) Add(delta float64) {
+	c.v.raise(c.v.add(delta))
+}
+
+// hashLabelValues returns the FNV-1a hash of the label values.
+func hashLabelValues(lvs []string) uint64 {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	h := uint64(offset)
+	for _, lv := range lvs {
+		for i := 0; i < len(lv); i++ {
+			h ^= uint64(lv[i])
+			h *= prime
+		}
+		h ^= 0xff // separator
+		h *= prime
+	}
+	return h
+}
+
+func equalLabelValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 type noopCounter struct{}
@@ -222,6 +861,51 @@ func (noopGauge) Add(float64)                      {}
 func (noopGauge) Sub(float64)                      {}
 func (noopGauge) SetToCurrentTime()                {}
 
+// newCounterVec returns a counter vector of the set, which is sharded by processor if selected by the options.
+func newCounterVec(ms *metricSet, opts metricOptions, co prometheus.CounterOpts, labelNames []string) counterVec {
+	if opts.perCPU {
+		co.Namespace, co.Subsystem = ms.add(dto.MetricType_COUNTER, co.Name, co.Help, labelNames, nil)
+		return newPerCPUCounterVec(co, labelNames)
+	}
+	return ms.counterVec(co, labelNames)
+}
+
+// newHistogramObserver returns a histogram vector of the set with the buckets
+// of the options or, if there are none, counters of its sum and count.
+func newHistogramObserver(ms *metricSet, name, help string, labelNames []string, opts histogramOptions) observer {
+	if len(opts.buckets) > 0 {
+		return &histogram{ms.histogramVec(
+			prometheus.HistogramOpts{
+				Name:    name,
+				Help:    help,
+				Buckets: opts.buckets,
+			},
+			labelNames,
+		)}
+	}
+	help = strings.TrimSuffix(help, ".")
+	return &counters{
+		sum: newCounterVec(
+			ms,
+			opts.metricOptions,
+			prometheus.CounterOpts{
+				Name: name + "_sum",
+				Help: help + " sum.",
+			},
+			labelNames,
+		),
+		num: newCounterVec(
+			ms,
+			opts.metricOptions,
+			prometheus.CounterOpts{
+				Name: name + "_count",
+				Help: help + " count.",
+			},
+			labelNames,
+		),
+	}
+}
+
 type counterVec interface {
 	prometheus.Collector
 	GetMetricWithLabelValues(lvs ...string) (prometheus.Counter, error)
@@ -244,6 +928,7 @@ type gaugeVec interface {
 	prometheus.Collector
 	GetMetricWithLabelValues(lvs ...string) (prometheus.Gauge, error)
 	WithLabelValues(lvs ...string) prometheus.Gauge
+	DeleteLabelValues(lvs ...string) bool
 }
 
 type noopGaugeVec struct {
@@ -257,3 +942,5 @@ func (v noopGaugeVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Gauge,
 func (v noopGaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
 	return v
 }
+
+func (noopGaugeVec) DeleteLabelValues(lvs ...string) bool { return false }
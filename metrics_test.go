@@ -2,18 +2,39 @@ package grpcprom
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
 
 	pb "google.golang.org/grpc/interop/grpc_testing"
 )
@@ -122,6 +143,19 @@ func (*testServiceServer) StreamingOutputCall(req *pb.StreamingOutputCallRequest
 	return nil
 }
 
+// flakyServiceServer fails the first request of each method with Unavailable.
+type flakyServiceServer struct {
+	pb.UnimplementedTestServiceServer
+	calls atomic.Int32
+}
+
+func (s *flakyServiceServer) UnaryCall(ctx context.Context, req *pb.SimpleRequest) (*pb.SimpleResponse, error) {
+	if s.calls.Add(1) == 1 {
+		return nil, status.Error(codes.Unavailable, "flaky")
+	}
+	return &pb.SimpleResponse{Payload: req.Payload}, nil
+}
+
 func genPayload(size int) *pb.Payload {
 	if size < 0 {
 		size = 32
@@ -130,3 +164,2080 @@ func genPayload(size int) *pb.Payload {
 	rand.Read(body)
 	return &pb.Payload{Body: body}
 }
+
+func TestUnusedMethods(t *testing.T) {
+	m := NewServerMetrics()
+	m.handler.init("", "pkg.Service", []grpc.MethodInfo{{Name: "Used"}, {Name: "Unused"}}, initOptions{})
+
+	ctx := m.handler.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Used"})
+	m.handler.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	if got, want := m.UnusedMethods(), []string{"/pkg.Service/Unused", "/pkg.Service/Used"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("UnusedMethods() = %v; want %v", got, want)
+	}
+	m.handler.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	if got, want := m.UnusedMethods(), []string{"/pkg.Service/Unused"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("UnusedMethods() = %v; want %v", got, want)
+	}
+}
+
+func TestConnectionsIdle(t *testing.T) {
+	h := NewServerMetrics().handler
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+	connCtx := h.TagConn(context.Background(), &stats.ConnTagInfo{LocalAddr: local, RemoteAddr: remote})
+	h.HandleConn(connCtx, &stats.ConnBegin{})
+	checkGauge(t, "connections_idle", h.connsIdle, 1)
+
+	ctx := h.TagRPC(connCtx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.InHeader{LocalAddr: local, RemoteAddr: remote})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	checkGauge(t, "connections_idle", h.connsIdle, 0)
+
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	checkGauge(t, "connections_idle", h.connsIdle, 1)
+
+	h.HandleConn(connCtx, &stats.ConnEnd{})
+	checkGauge(t, "connections_idle", h.connsIdle, 0)
+}
+
+func checkGauge(t *testing.T, name string, c prometheus.Collector, want float64) {
+	t.Helper()
+	if got := testutil.ToFloat64(c); got != want {
+		t.Fatalf("%s = %v; want %v", name, got, want)
+	}
+}
+
+func TestServerLabel(t *testing.T) {
+	m := NewServerMetrics(ServerLabel())
+	for _, name := range []string{"public", "admin"} {
+		h := m.NamedStatsHandler(name)
+		connCtx := h.TagConn(context.Background(), &stats.ConnTagInfo{})
+		ctx := h.TagRPC(connCtx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	}
+	want := `
+# HELP grpc_server_requests_pending Number of gRPC server requests pending.
+# TYPE grpc_server_requests_pending gauge
+grpc_server_requests_pending{grpc_method="Method",grpc_server="admin",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+grpc_server_requests_pending{grpc_method="Method",grpc_server="public",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_pending"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownServiceHandler(t *testing.T) {
+	m := NewServerMetrics()
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Backend/Watch"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	info := &grpc.StreamServerInfo{FullMethod: "/pkg.Backend/Watch", IsClientStream: true, IsServerStream: true}
+	err := h.streamServerInterceptor(nil, &ctxServerStream{ctx: ctx}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		h.HandleRPC(ss.Context(), &stats.InPayload{})
+		for i := 0; i < 3; i++ {
+			h.HandleRPC(ss.Context(), &stats.OutPayload{})
+		}
+		return nil
+	})
+	check(t, err)
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+
+	if got := m.UnusedMethods(); len(got) != 0 {
+		t.Fatalf("UnusedMethods() = %v; want none", got)
+	}
+	want := `
+# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+# TYPE grpc_server_requests_total counter
+grpc_server_requests_total{grpc_code="OK",grpc_method="Watch",grpc_service="pkg.Backend",grpc_type="ServerStream"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastMessageAge(t *testing.T) {
+	m := NewServerMetrics(LastMessageAgeSeconds(Methods("/pkg.Service/Watch")))
+	h := m.handler
+	for _, name := range []string{"/pkg.Service/Watch", "/pkg.Service/Get"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: name})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now().Add(-time.Minute)})
+	}
+	if n := testutil.CollectAndCount(m, "grpc_server_last_message_age_seconds"); n != 1 {
+		t.Fatalf("last_message_age_seconds series = %d; want 1", n)
+	}
+	if age := testutil.ToFloat64(h.msgAge); age < 60 {
+		t.Fatalf("last_message_age_seconds = %v; want >= 60", age)
+	}
+}
+
+func TestStaleStreams(t *testing.T) {
+	m := NewServerMetrics(StaleStreamsTotal(MaxAge(time.Minute, "/pkg.Service/Watch")))
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Watch"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now().Add(-time.Hour)})
+	for i := 0; i < 2; i++ {
+		if got := testutil.ToFloat64(h.stale); got != 1 {
+			t.Fatalf("stale_streams_total = %v; want 1", got)
+		}
+	}
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	if got := testutil.ToFloat64(h.stale); got != 1 {
+		t.Fatalf("stale_streams_total = %v; want 1", got)
+	}
+}
+
+func TestOversizedMessages(t *testing.T) {
+	m := NewServerMetrics(OversizedMessagesTotal(MaxSize(1024), MaxSize(1<<20, "/pkg.Service/Upload")))
+	h := m.handler
+	for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Upload"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: method})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.InPayload{Length: 2048, RecvTime: time.Now()})
+		h.HandleRPC(ctx, &stats.OutPayload{Length: 1024, SentTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_oversized_messages_total Total number of gRPC server messages larger than the maximum size of their method.
+		# TYPE grpc_server_oversized_messages_total counter
+		grpc_server_oversized_messages_total{grpc_direction="recv",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_oversized_messages_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := NewServerMetrics()
+	check(t, m.Register(r))
+	if err := m.Register(r); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("registering twice: unexpected error: %v", err)
+	}
+	if err := NewServerMetrics().Register(r); err == nil || !strings.Contains(err.Error(), "ServerLabel") {
+		t.Fatalf("registering another instance: unexpected error: %v", err)
+	}
+	check(t, NewServerMetrics(Namespace("acme")).Register(r))
+
+	NewClientMetrics(WithRegisterer(r))
+	func() {
+		defer func() {
+			if err, _ := recover().(error); err == nil || !strings.Contains(err.Error(), "already registered") {
+				t.Fatalf("registering another instance with WithRegisterer: unexpected panic: %v", err)
+			}
+		}()
+		NewClientMetrics(WithRegisterer(r))
+	}()
+
+	r = prometheus.NewRegistry()
+	check(t, r.Register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "grpc_server_connections_total",
+		Help: "Something else.",
+	})))
+	if err := NewServerMetrics().Register(r); err == nil || !strings.Contains(err.Error(), "grpc_server_connections_total") {
+		t.Fatalf("registering a colliding metric: unexpected error: %v", err)
+	}
+}
+
+func TestTrailersOnly(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		var m Metrics = NewServerMetrics()
+		if client {
+			m = NewClientMetrics()
+		}
+		h := m.StatsHandler().(*handler)
+		for _, trailersOnly := range []bool{false, true} {
+			ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+			h.HandleRPC(ctx, &stats.Begin{Client: client, BeginTime: time.Now()})
+			if !trailersOnly {
+				if client {
+					h.HandleRPC(ctx, &stats.InHeader{Client: true})
+				} else {
+					h.HandleRPC(ctx, &stats.OutHeader{})
+				}
+			}
+			if client {
+				h.HandleRPC(ctx, &stats.InTrailer{Client: true})
+			} else {
+				h.HandleRPC(ctx, &stats.OutTrailer{})
+			}
+			h.HandleRPC(ctx, &stats.End{Client: client, EndTime: time.Now(), Error: status.Error(codes.PermissionDenied, "denied")})
+		}
+		name := "grpc_server_requests_trailers_only_total"
+		if client {
+			name = "grpc_client_requests_trailers_only_total"
+		}
+		if got := testutil.ToFloat64(h.trailersOnly); got != 1 {
+			t.Fatalf("%s = %v; want 1", name, got)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	m := NewClientMetrics(TimeoutSeconds(Enable(), NoBuckets()))
+	h := m.handler
+	for _, timeout := range []time.Duration{0, time.Second, time.Minute} {
+		ctx := context.Background()
+		begin := time.Now()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, begin.Add(timeout))
+			defer cancel()
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: begin})
+		h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_client_timeout_seconds_count Timeout of gRPC client requests with deadlines count.
+		# TYPE grpc_client_timeout_seconds_count counter
+		grpc_client_timeout_seconds_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 2
+		# HELP grpc_client_timeout_seconds_sum Timeout of gRPC client requests with deadlines sum.
+		# TYPE grpc_client_timeout_seconds_sum counter
+		grpc_client_timeout_seconds_sum{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 61
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_timeout_seconds_count", "grpc_client_timeout_seconds_sum"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	m := NewServerMetrics(TimeoutSeconds(Enable(), NoBuckets()), RequestsWithoutDeadlineTotal(Enable()))
+	h := m.handler
+	for _, timeout := range []time.Duration{0, 0, time.Second} {
+		ctx := context.Background()
+		begin := time.Now()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, begin.Add(timeout))
+			defer cancel()
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_without_deadline_total Total number of gRPC server requests begun without deadlines.
+		# TYPE grpc_server_requests_without_deadline_total counter
+		grpc_server_requests_without_deadline_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 2
+		# HELP grpc_server_timeout_seconds_count Timeout of gRPC server requests with deadlines count.
+		# TYPE grpc_server_timeout_seconds_count counter
+		grpc_server_timeout_seconds_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+	`
+	names := []string{"grpc_server_requests_without_deadline_total", "grpc_server_timeout_seconds_count"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlineUtilization(t *testing.T) {
+	m := NewServerMetrics(DeadlineUtilizationRatio(Enable(), NoBuckets()))
+	h := m.handler
+	for _, timeout := range []time.Duration{0, time.Second} {
+		ctx := context.Background()
+		begin := time.Now().Add(-500 * time.Millisecond)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, begin.Add(timeout))
+			defer cancel()
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	c := h.deadlineUtil.(*counters)
+	if n := testutil.ToFloat64(c.num.WithLabelValues(unknown, "pkg.Service", "Method")); n != 1 {
+		t.Fatalf("deadline_utilization_ratio_count = %v; want 1", n)
+	}
+	if sum := testutil.ToFloat64(c.sum.WithLabelValues(unknown, "pkg.Service", "Method")); sum < 0.5 || sum > 0.9 {
+		t.Fatalf("deadline_utilization_ratio_sum = %v; want about 0.5", sum)
+	}
+}
+
+func TestLatencyEWMA(t *testing.T) {
+	m := NewServerMetrics(LatencyEWMASeconds(Enable(), HalfLife(time.Second)))
+	h := m.handler
+	now := time.Now()
+	h.latencyEWMA.now = func() time.Time { return now }
+	rpc := func(latency time.Duration) {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now().Add(-latency)})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	if _, ok := m.LatencyEWMA("/pkg.Service/Method"); ok {
+		t.Fatal("unexpected average before observations")
+	}
+	rpc(4 * time.Second)
+	now = now.Add(time.Second)
+	rpc(2 * time.Second)
+	got, ok := m.LatencyEWMA("/pkg.Service/Method")
+	if !ok {
+		t.Fatal("missing average")
+	}
+	// Half of the first observation has decayed: (4+2)/2 = 3.
+	if got < 3*time.Second || got > 3*time.Second+10*time.Millisecond {
+		t.Errorf("LatencyEWMA() = %v; want ~3s", got)
+	}
+	if n := testutil.CollectAndCount(m, "grpc_server_latency_ewma_seconds"); n != 1 {
+		t.Errorf("latency_ewma_seconds series = %d; want 1", n)
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	m := NewServerMetrics()
+	h := m.handler
+	for _, tt := range []struct {
+		auth string
+		code codes.Code
+	}{
+		{"Bearer token", codes.Unauthenticated},
+		{"bearer token", codes.Unauthenticated},
+		{"Basic creds", codes.PermissionDenied},
+		{"Negotiate creds", codes.PermissionDenied},
+		{"", codes.Unauthenticated},
+		{"Bearer token", codes.OK},
+	} {
+		ctx := context.Background()
+		if tt.auth != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tt.auth))
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(tt.code, "")})
+	}
+	want := `
+		# HELP grpc_server_auth_failures_total Total number of gRPC server requests completed with Unauthenticated or PermissionDenied by auth scheme presented.
+		# TYPE grpc_server_auth_failures_total counter
+		grpc_server_auth_failures_total{grpc_auth_scheme="basic",grpc_code="PermissionDenied",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+		grpc_server_auth_failures_total{grpc_auth_scheme="bearer",grpc_code="Unauthenticated",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 2
+		grpc_server_auth_failures_total{grpc_auth_scheme="none",grpc_code="Unauthenticated",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+		grpc_server_auth_failures_total{grpc_auth_scheme="other",grpc_code="PermissionDenied",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_auth_failures_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnLabel(t *testing.T) {
+	m := NewClientMetrics(ConnLabel())
+	rpc := func(sh stats.Handler, intercepted bool) {
+		ctx := context.Background()
+		if intercepted {
+			ctx = m.handler.context(ctx, "/pkg.Service/Method", unary)
+		}
+		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		sh.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+		sh.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	}
+	rpc(namedClientHandler{m.handler, "primary"}, true)
+	rpc(namedClientHandler{m.handler, "primary"}, false)
+	rpc(namedClientHandler{m.handler, "secondary"}, true)
+	rpc(m.StatsHandler(), true)
+
+	want := `
+		# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+		# TYPE grpc_client_requests_total counter
+		grpc_client_requests_total{grpc_code="OK",grpc_conn="",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_client_requests_total{grpc_code="OK",grpc_conn="primary",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_client_requests_total{grpc_code="OK",grpc_conn="secondary",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResponseSizeRatio(t *testing.T) {
+	m := NewServerMetrics(ResponseSizeRatio(Enable(), NoBuckets()))
+	h := m.handler
+	for _, sizes := range [][2]int{{100, 1000}, {100, 50}, {0, 10}} {
+		ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		if sizes[0] > 0 {
+			h.HandleRPC(ctx, &stats.InPayload{WireLength: sizes[0], RecvTime: time.Now()})
+		}
+		h.HandleRPC(ctx, &stats.OutPayload{WireLength: sizes[1], SentTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_response_size_ratio_count Ratio of response bytes to request bytes of gRPC server unary requests count.
+		# TYPE grpc_server_response_size_ratio_count counter
+		grpc_server_response_size_ratio_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		# HELP grpc_server_response_size_ratio_sum Ratio of response bytes to request bytes of gRPC server unary requests sum.
+		# TYPE grpc_server_response_size_ratio_sum counter
+		grpc_server_response_size_ratio_sum{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 10.5
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_response_size_ratio_count", "grpc_server_response_size_ratio_sum"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadSeconds(t *testing.T) {
+	m := NewServerMetrics(UploadSeconds(Enable(), NoBuckets()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", clientStream)
+	begin := time.Now()
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+	for i := 1; i <= 3; i++ {
+		h.HandleRPC(ctx, &stats.InPayload{RecvTime: begin.Add(time.Duration(i) * time.Second)})
+	}
+	h.HandleRPC(ctx, &stats.OutPayload{SentTime: begin.Add(10 * time.Second)})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	want := `
+		# HELP grpc_server_upload_seconds_count Duration from the first to the last message of gRPC server client-streaming requests count.
+		# TYPE grpc_server_upload_seconds_count counter
+		grpc_server_upload_seconds_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="ClientStream"} 1
+		# HELP grpc_server_upload_seconds_sum Duration from the first to the last message of gRPC server client-streaming requests sum.
+		# TYPE grpc_server_upload_seconds_sum counter
+		grpc_server_upload_seconds_sum{grpc_method="Method",grpc_service="pkg.Service",grpc_type="ClientStream"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_upload_seconds_count", "grpc_server_upload_seconds_sum"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessagesTotal(t *testing.T) {
+	m := NewClientMetrics(MessagesTotal(Enable()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", bidiStream)
+	h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{Client: true, Length: 100, CompressedLength: 40, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{Client: true, Length: 100, CompressedLength: 40, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{Client: true, Length: 100, CompressedLength: 100, RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	want := `
+		# HELP grpc_client_messages_total Total number of gRPC client messages by direction and compression.
+		# TYPE grpc_client_messages_total counter
+		grpc_client_messages_total{grpc_compressed="false",grpc_direction="recv",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 1
+		grpc_client_messages_total{grpc_compressed="false",grpc_direction="sent",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 0
+		grpc_client_messages_total{grpc_compressed="true",grpc_direction="recv",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 0
+		grpc_client_messages_total{grpc_compressed="true",grpc_direction="sent",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_messages_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDerived(t *testing.T) {
+	m := NewServerMetrics(Derived(DerivedMetric{
+		Name: "error_ratio",
+		Help: "Ratio of gRPC server requests completed with errors.",
+		Value: func(s *MethodStats) (float64, bool) {
+			total := s.Total()
+			if total == 0 {
+				return 0, false
+			}
+			return (total - s.Requests[codes.OK]) / total, true
+		},
+	}))
+	h := m.handler
+	for _, tt := range []struct {
+		method string
+		code   codes.Code
+	}{
+		{"/pkg.Service/Method", codes.OK},
+		{"/pkg.Service/Method", codes.OK},
+		{"/pkg.Service/Method", codes.Internal},
+		{"/pkg.Service/Method", codes.NotFound},
+		{"/pkg.Service/Other", codes.OK},
+	} {
+		ctx := h.context(context.Background(), tt.method, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(tt.code, "")})
+	}
+	ctx := h.context(context.Background(), "/pkg.Service/Idle", unary)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+
+	want := `
+		# HELP grpc_server_error_ratio Ratio of gRPC server requests completed with errors.
+		# TYPE grpc_server_error_ratio gauge
+		grpc_server_error_ratio{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 0.5
+		grpc_server_error_ratio{grpc_method="Other",grpc_service="pkg.Service",grpc_type="Unary"} 0
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_error_ratio"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsHandlerOverhead(t *testing.T) {
+	m := NewServerMetrics(StatsHandlerOverheadSeconds(Enable(), NoBuckets()))
+	h := m.handler
+	ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{})
+	h.HandleConn(ctx, &stats.ConnBegin{})
+	ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	for event, want := range map[int]float64{
+		eventConnBegin: 1,
+		eventBegin:     1,
+		eventInPayload: 2,
+		eventEnd:       1,
+		eventOutHeader: 0,
+	} {
+		c := h.overhead.vec.(*counters).num.WithLabelValues(eventNames[event])
+		if got := testutil.ToFloat64(c); got != want {
+			t.Errorf("stats_handler_overhead_seconds_count{grpc_event=%q} = %v; want %v", eventNames[event], got, want)
+		}
+	}
+}
+
+func TestStartTimer(t *testing.T) {
+	StartTimer(context.Background(), "untracked").ObserveDuration()
+
+	m := NewServerMetrics(OperationDurationSeconds(Enable(), NoBuckets()))
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	for i := 0; i < 2; i++ {
+		StartTimer(ctx, "db_query").ObserveDuration()
+	}
+	StartTimer(ctx, "render").ObserveDuration()
+	detached := Detach(ctx)
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	StartTimer(detached, "background").ObserveDuration()
+
+	want := `
+		# HELP grpc_server_operation_duration_seconds_count Duration of operations timed in gRPC server handlers count.
+		# TYPE grpc_server_operation_duration_seconds_count counter
+		grpc_server_operation_duration_seconds_count{grpc_method="Method",grpc_operation="background",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+		grpc_server_operation_duration_seconds_count{grpc_method="Method",grpc_operation="db_query",grpc_service="pkg.Service",grpc_type="Unknown"} 2
+		grpc_server_operation_duration_seconds_count{grpc_method="Method",grpc_operation="render",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_operation_duration_seconds_count"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeprecatedRequests(t *testing.T) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("grpcprom/deprecated_test.proto"),
+		Package: proto.String("grpcprom.test"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/empty.proto",
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Deprecated"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{
+					Name:       proto.String("Old"),
+					InputType:  proto.String(".google.protobuf.Empty"),
+					OutputType: proto.String(".google.protobuf.Empty"),
+					Options:    &descriptorpb.MethodOptions{Deprecated: proto.Bool(true)},
+				},
+				{
+					Name:       proto.String("New"),
+					InputType:  proto.String(".google.protobuf.Empty"),
+					OutputType: proto.String(".google.protobuf.Empty"),
+				},
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	check(t, err)
+	if _, err := protoregistry.GlobalFiles.FindFileByPath(fd.Path()); err != nil {
+		check(t, protoregistry.GlobalFiles.RegisterFile(fd))
+	}
+
+	m := NewServerMetrics()
+	check(t, m.InitMethods("grpcprom.test.Deprecated", []grpc.MethodInfo{{Name: "Old"}, {Name: "New"}}, codes.OK))
+	h := m.handler
+	for _, name := range []string{"/grpcprom.test.Deprecated/Old", "/grpcprom.test.Deprecated/New", "/grpcprom.test.Deprecated/Old"} {
+		ctx := h.context(context.Background(), name, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_deprecated_requests_total Total number of gRPC server requests of deprecated methods completed.
+		# TYPE grpc_server_deprecated_requests_total counter
+		grpc_server_deprecated_requests_total{grpc_method="Old",grpc_service="grpcprom.test.Deprecated",grpc_type="Unary"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_deprecated_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	m := NewServerMetrics(Caller(CallerFromMetadata("x-caller"), 2))
+	h := m.handler
+	for _, caller := range []string{"a", "b", "c", "", "a"} {
+		ctx := context.Background()
+		if caller != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-caller", caller))
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_caller="Other",grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+		grpc_server_requests_total{grpc_caller="Unknown",grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+		grpc_server_requests_total{grpc_caller="a",grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 2
+		grpc_server_requests_total{grpc_caller="b",grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	check(t, err)
+	defer lis.Close()
+	srv := grpc.NewServer()
+	defer srv.Stop()
+	pb.RegisterTestServiceServer(srv, &flakyServiceServer{})
+	go srv.Serve(lis)
+
+	m := NewClientMetrics(RetryAttemptsTotal(Enable()), RequestAttempts(Enable(), NoBuckets()))
+	conn, err := grpc.Dial(
+		lis.Addr().String(),
+		grpc.WithStatsHandler(m.StatsHandler()),
+		grpc.WithUnaryInterceptor(m.UnaryInterceptor()),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"methodConfig": [{
+			"name": [{"service": "grpc.testing.TestService"}],
+			"retryPolicy": {
+				"maxAttempts": 2,
+				"initialBackoff": "0.001s",
+				"maxBackoff": "0.001s",
+				"backoffMultiplier": 1,
+				"retryableStatusCodes": ["UNAVAILABLE"]
+			}
+		}]}`),
+	)
+	check(t, err)
+	defer conn.Close()
+	_, err = pb.NewTestServiceClient(conn).UnaryCall(context.Background(), &pb.SimpleRequest{})
+	check(t, err)
+
+	want := `
+		# HELP grpc_client_attempts_total Total number of gRPC client request attempts completed.
+		# TYPE grpc_client_attempts_total counter
+		grpc_client_attempts_total{grpc_code="OK",grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 1
+		grpc_client_attempts_total{grpc_code="Unavailable",grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 1
+		# HELP grpc_client_request_attempts_count Number of attempts of gRPC client requests count.
+		# TYPE grpc_client_request_attempts_count counter
+		grpc_client_request_attempts_count{grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 1
+		# HELP grpc_client_request_attempts_sum Number of attempts of gRPC client requests sum.
+		# TYPE grpc_client_request_attempts_sum counter
+		grpc_client_request_attempts_sum{grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 2
+		# HELP grpc_client_requests_pending Number of gRPC client requests pending.
+		# TYPE grpc_client_requests_pending gauge
+		grpc_client_requests_pending{grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 0
+		# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+		# TYPE grpc_client_requests_total counter
+		grpc_client_requests_total{grpc_code="OK",grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 1
+		grpc_client_requests_total{grpc_code="Unavailable",grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 0
+		# HELP grpc_client_retry_attempts_total Total number of gRPC client request attempts retried.
+		# TYPE grpc_client_retry_attempts_total counter
+		grpc_client_retry_attempts_total{grpc_method="UnaryCall",grpc_service="grpc.testing.TestService",grpc_type="Unary"} 1
+	`
+	names := []string{
+		"grpc_client_attempts_total",
+		"grpc_client_request_attempts_count",
+		"grpc_client_request_attempts_sum",
+		"grpc_client_requests_pending",
+		"grpc_client_requests_total",
+		"grpc_client_retry_attempts_total",
+	}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransparentRetries(t *testing.T) {
+	m := NewClientMetrics(RetryAttemptsTotal(Enable()), TransparentRetriesTotal(Enable()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	for _, transparent := range []bool{false, true, false} {
+		h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now(), IsTransparentRetryAttempt: transparent})
+		h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_client_retry_attempts_total Total number of gRPC client request attempts retried.
+		# TYPE grpc_client_retry_attempts_total counter
+		grpc_client_retry_attempts_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		# HELP grpc_client_transparent_retries_total Total number of gRPC client request attempts retried transparently.
+		# TYPE grpc_client_transparent_retries_total counter
+		grpc_client_transparent_retries_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	names := []string{"grpc_client_retry_attempts_total", "grpc_client_transparent_retries_total"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPickDelaySeconds(t *testing.T) {
+	m := NewClientMetrics(PickDelaySeconds(Enable(), NoBuckets()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now().Add(-time.Second)})
+	h.HandleRPC(ctx, &stats.OutHeader{Client: true, FullMethod: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	if n := testutil.ToFloat64(h.pickDelay.(*counters).num.WithLabelValues(unary, "pkg.Service", "Method")); n != 1 {
+		t.Fatalf("pick_delay_seconds_count = %v; want 1", n)
+	}
+	if sum := testutil.ToFloat64(h.pickDelay.(*counters).sum.WithLabelValues(unary, "pkg.Service", "Method")); sum < 1 {
+		t.Fatalf("pick_delay_seconds_sum = %v; want >= 1", sum)
+	}
+}
+
+func TestAnomalyHook(t *testing.T) {
+	var got []Anomaly
+	m := NewServerMetrics(
+		OversizedMessagesTotal(MaxSize(1024)),
+		AnomalyHook(AnomalyRule{
+			MinLatency: time.Minute,
+			Codes:      []codes.Code{codes.Internal},
+			Oversized:  true,
+			Rate:       1e-9,
+			Burst:      3,
+		}, func(a Anomaly) { got = append(got, a) }),
+	)
+	h := m.handler
+	rpc := func(begin time.Time, size int, err error) {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+		h.HandleRPC(ctx, &stats.InPayload{Length: size, WireLength: size, RecvTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: err})
+	}
+	rpc(time.Now(), 10, nil)
+	rpc(time.Now(), 10, status.Error(codes.Internal, "internal"))
+	rpc(time.Now(), 2048, nil)
+	rpc(time.Now().Add(-time.Hour), 10, nil)
+	rpc(time.Now(), 10, status.Error(codes.Internal, "dropped"))
+	if len(got) != 3 {
+		t.Fatalf("anomalies = %d; want 3", len(got))
+	}
+	if a := got[0]; !a.Failed || a.Slow || a.Oversized || a.Code != codes.Internal {
+		t.Errorf("unexpected failed anomaly: %+v", a)
+	}
+	if a := got[1]; a.Failed || a.Slow || !a.Oversized || a.RecvBytes != 2048 {
+		t.Errorf("unexpected oversized anomaly: %+v", a)
+	}
+	if a := got[2]; a.Failed || !a.Slow || a.Oversized {
+		t.Errorf("unexpected slow anomaly: %+v", a)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	m := NewServerMetrics()
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	if _, ok := m.Progress(ctx); ok {
+		t.Fatal("unexpected progress before begin")
+	}
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now().Add(-time.Second)})
+	h.HandleRPC(ctx, &stats.InPayload{WireLength: 10, RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{WireLength: 20, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{WireLength: 30, SentTime: time.Now()})
+	p, ok := m.Progress(ctx)
+	if !ok {
+		t.Fatal("missing progress")
+	}
+	if p.Elapsed < time.Second || p.SentBytes != 50 || p.RecvBytes != 10 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if _, ok := m.Progress(context.Background()); ok {
+		t.Error("unexpected progress of untracked context")
+	}
+}
+
+func TestLatencyMax(t *testing.T) {
+	m := NewServerMetrics(LatencyMaxSeconds(Enable(), ResetOnCollect()))
+	h := m.handler
+	for _, d := range []time.Duration{time.Second, time.Minute, time.Millisecond} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now().Add(-d)})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	if got := testutil.ToFloat64(h.latencyMax); got < 60 || got > 61 {
+		t.Fatalf("latency_max_seconds = %v; want 60", got)
+	}
+	if got := testutil.ToFloat64(h.latencyMax); got != 0 {
+		t.Fatalf("latency_max_seconds = %v after reset; want 0", got)
+	}
+}
+
+func TestRequestsPendingMax(t *testing.T) {
+	m := NewServerMetrics(RequestsPendingMax(Enable()))
+	h := m.handler
+	var ctxs []context.Context
+	for i := 0; i < 3; i++ {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		ctxs = append(ctxs, ctx)
+	}
+	for _, ctx := range ctxs[1:] {
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	checkGauge(t, "requests_pending_max", h.reqsPendingMax, 3)
+	checkGauge(t, "requests_pending_max", h.reqsPendingMax, 1)
+}
+
+func TestSubscribe(t *testing.T) {
+	m := NewClientMetrics()
+	h := m.handler
+	var got []Outcome
+	unsubscribe := m.Subscribe(func(o Outcome) { got = append(got, o) })
+	for i := 0; i < 2; i++ {
+		ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(codes.Unavailable, "down")})
+		unsubscribe()
+	}
+	if len(got) != 1 {
+		t.Fatalf("outcomes = %d; want 1", len(got))
+	}
+	if o := got[0]; o.Service != "pkg.Service" || o.Method != "Method" || o.Code != codes.Unavailable {
+		t.Fatalf("outcome = %+v", o)
+	}
+}
+
+func TestTapHandle(t *testing.T) {
+	m := NewServerMetrics()
+	handle := m.TapHandle(func(ctx context.Context, info *tap.Info) (context.Context, error) {
+		return ctx, status.Error(codes.ResourceExhausted, "rate limited")
+	})
+	if _, err := handle(context.Background(), &tap.Info{FullMethodName: "/pkg.Service/Method"}); err == nil {
+		t.Fatal("expected error")
+	}
+	want := `
+# HELP grpc_server_requests_rejected_total Total number of gRPC server requests rejected before being handled.
+# TYPE grpc_server_requests_rejected_total counter
+grpc_server_requests_rejected_total{grpc_code="ResourceExhausted",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unknown"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_rejected_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocality(t *testing.T) {
+	zones := map[string]string{"10.0.0.1:443": "us-east1-b"}
+	m := NewClientMetrics(Locality(func(addr net.Addr) string { return zones[addr.String()] }))
+	h := m.handler
+	for _, addr := range []string{"10.0.0.1:443", "10.0.0.2:443"} {
+		remote, err := net.ResolveTCPAddr("tcp", addr)
+		check(t, err)
+		ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.OutHeader{Client: true, RemoteAddr: remote})
+		h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	}
+	want := `
+# HELP grpc_client_locality_requests_total Total number of gRPC client requests completed by backend locality.
+# TYPE grpc_client_locality_requests_total counter
+grpc_client_locality_requests_total{grpc_code="OK",grpc_locality="Unknown"} 1
+grpc_client_locality_requests_total{grpc_code="OK",grpc_locality="us-east1-b"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_locality_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInfraServices(t *testing.T) {
+	methods := []string{
+		"/grpc.health.v1.Health/Check",
+		"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+		"/pkg.Service/Method",
+	}
+	for _, tt := range []struct {
+		opt  Option
+		want string
+	}{
+		{
+			opt: ExcludeInfraServices(),
+			want: `
+# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+# TYPE grpc_server_requests_total counter
+grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+`,
+		},
+		{
+			opt: AggregateInfraServices(),
+			want: `
+# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+# TYPE grpc_server_requests_total counter
+grpc_server_requests_total{grpc_code="OK",grpc_method="Infra",grpc_service="Infra",grpc_type="Unknown"} 2
+grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+`,
+		},
+	} {
+		m := NewServerMetrics(tt.opt)
+		h := m.handler
+		for _, name := range methods {
+			ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: name})
+			h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+			ctx = h.context(ctx, name, unary)
+			h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+		}
+		if err := testutil.CollectAndCompare(m, strings.NewReader(tt.want), "grpc_server_requests_total"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErrorsOnly(t *testing.T) {
+	m := NewServerMetrics(ErrorsOnly(), LatencySeconds(NoBuckets()), RecvBytes(NoBuckets()))
+	h := m.handler
+	for _, err := range []error{nil, status.Error(codes.Internal, "oops")} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		ctx = h.context(ctx, "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.InPayload{WireLength: 100, RecvTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: err})
+	}
+	want := `
+# HELP grpc_server_latency_seconds_count Latency of gRPC server requests count.
+# TYPE grpc_server_latency_seconds_count counter
+grpc_server_latency_seconds_count{grpc_code="Internal",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+# HELP grpc_server_recv_bytes_sum Bytes received in gRPC server requests sum.
+# TYPE grpc_server_recv_bytes_sum counter
+grpc_server_recv_bytes_sum{grpc_frame="Payload",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 100
+# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+# TYPE grpc_server_requests_total counter
+grpc_server_requests_total{grpc_code="Internal",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+`
+	names := []string{"grpc_server_latency_seconds_count", "grpc_server_recv_bytes_sum", "grpc_server_requests_total"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorsOnlyConcurrentStream(t *testing.T) {
+	m := NewServerMetrics(
+		ErrorsOnly(),
+		RecvBytes(NoBuckets()),
+		SentBytes(NoBuckets()),
+		OversizedMessagesTotal(MaxSize(5)),
+	)
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	ctx = h.context(ctx, "/pkg.Service/Method", bidiStream)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+
+	// Streams receive and send messages in separate goroutines.
+	var wg sync.WaitGroup
+	for _, sent := range []bool{false, true} {
+		sent := sent
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if sent {
+					h.HandleRPC(ctx, &stats.OutPayload{Length: 10, WireLength: 10, SentTime: time.Now()})
+				} else {
+					h.HandleRPC(ctx, &stats.InPayload{Length: 10, WireLength: 10, RecvTime: time.Now()})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(codes.Internal, "oops")})
+
+	want := `
+# HELP grpc_server_oversized_messages_total Total number of gRPC server messages larger than the maximum size of their method.
+# TYPE grpc_server_oversized_messages_total counter
+grpc_server_oversized_messages_total{grpc_direction="recv",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 10
+grpc_server_oversized_messages_total{grpc_direction="sent",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 10
+# HELP grpc_server_recv_bytes_sum Bytes received in gRPC server requests sum.
+# TYPE grpc_server_recv_bytes_sum counter
+grpc_server_recv_bytes_sum{grpc_frame="Payload",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 100
+# HELP grpc_server_sent_bytes_sum Bytes sent in gRPC server responses sum.
+# TYPE grpc_server_sent_bytes_sum counter
+grpc_server_sent_bytes_sum{grpc_frame="Payload",grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 100
+`
+	names := []string{"grpc_server_oversized_messages_total", "grpc_server_recv_bytes_sum", "grpc_server_sent_bytes_sum"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotInit(t *testing.T) {
+	m := NewServerMetrics()
+	h := m.handler
+	call := func() {
+		ctx := h.context(context.Background(), "/grpc.testing.TestService/UnaryCall", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	call()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, fn := range []func(){call, func() { testutil.CollectAndCount(m) }} {
+		fn := fn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					fn()
+				}
+			}
+		}()
+	}
+	var methods int
+	for i := 0; i < 10; i++ {
+		srv := grpc.NewServer()
+		pb.RegisterTestServiceServer(srv, &testServiceServer{})
+		m.Init(srv, codes.OK, codes.Internal)
+		methods = len(srv.GetServiceInfo()["grpc.testing.TestService"].Methods)
+	}
+	close(done)
+	wg.Wait()
+
+	if n := testutil.CollectAndCount(m, "grpc_server_requests_total"); n != 2*methods {
+		t.Fatalf("requests_total series = %d; want %d", n, 2*methods)
+	}
+	for _, name := range m.UnusedMethods() {
+		if name == "/grpc.testing.TestService/UnaryCall" {
+			t.Fatalf("unused methods include %s", name)
+		}
+	}
+}
+
+func TestCollectNonBlocking(t *testing.T) {
+	m := NewServerMetrics(LatencyMaxSeconds(Enable()), RequestsPendingMax(Enable()), TopK(10, MethodKey))
+	h := m.handler
+	rpc := func(name string) {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: name})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	rpc("/pkg.Service/A")
+	rpc("/pkg.Service/B")
+	for _, c := range []prometheus.Collector{h.reqsPendingMax, h.latencyMax, h.topK} {
+		// Stall the collection after the first metric.
+		ch := make(chan prometheus.Metric)
+		go func() {
+			c.Collect(ch)
+			close(ch)
+		}()
+		<-ch
+		done := make(chan struct{})
+		go func() {
+			rpc("/pkg.Service/A")
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%T blocked requests while collecting", c)
+		}
+		for range ch {
+		}
+	}
+}
+
+func TestPerCPU(t *testing.T) {
+	m := NewServerMetrics(RequestsTotal(PerCPU()), RecvBytes(NoBuckets(), PerCPU()))
+	h := m.handler
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+				ctx = h.context(ctx, "/pkg.Service/Method", unary)
+				h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+				h.HandleRPC(ctx, &stats.InPayload{WireLength: 10, RecvTime: time.Now()})
+				h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+			}
+		}()
+	}
+	wg.Wait()
+	want := `
+# HELP grpc_server_recv_bytes_sum Bytes received in gRPC server requests sum.
+# TYPE grpc_server_recv_bytes_sum counter
+grpc_server_recv_bytes_sum{grpc_frame="Payload",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 4000
+# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+# TYPE grpc_server_requests_total counter
+grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 400
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_recv_bytes_sum", "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitE(t *testing.T) {
+	m := NewServerMetrics()
+	if err := m.InitE(nil); err == nil {
+		t.Fatal("expected error for nil server")
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterTestServiceServer(srv, &testServiceServer{})
+	check(t, m.InitE(srv, codes.OK))
+	if err := m.InitE(srv, codes.OK); err == nil || !strings.Contains(err.Error(), "already initialized") {
+		t.Fatalf("unexpected error for duplicate initialization: %v", err)
+	}
+
+	srv = grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "pkg.Empty",
+		HandlerType: (*interface{})(nil),
+	}, struct{}{})
+	if err := m.InitE(srv); err == nil || !strings.Contains(err.Error(), "no methods") {
+		t.Fatalf("unexpected error for service without methods: %v", err)
+	}
+}
+
+func TestInitWith(t *testing.T) {
+	m := NewServerMetrics()
+	srv := grpc.NewServer()
+	pb.RegisterTestServiceServer(srv, &testServiceServer{})
+	check(t, m.InitWith(srv, WithCodes(AllCodes...), WithLatencyCodes(codes.OK)))
+	methods := len(srv.GetServiceInfo()["grpc.testing.TestService"].Methods)
+	if got, want := testutil.CollectAndCount(m, "grpc_server_requests_total"), methods*len(AllCodes); got != want {
+		t.Fatalf("requests_total series = %d; want %d", got, want)
+	}
+	if got, want := testutil.CollectAndCount(m, "grpc_server_latency_seconds"), methods; got != want {
+		t.Fatalf("latency_seconds series = %d; want %d", got, want)
+	}
+}
+
+func TestInitMethods(t *testing.T) {
+	m := NewClientMetrics()
+	methods := []grpc.MethodInfo{{Name: "Get"}, {Name: "Watch", IsServerStream: true}}
+	check(t, m.InitMethods("pkg.Service", methods, codes.OK))
+	want := `
+# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+# TYPE grpc_client_requests_total counter
+grpc_client_requests_total{grpc_code="OK",grpc_method="Get",grpc_service="pkg.Service",grpc_type="Unary"} 0
+grpc_client_requests_total{grpc_code="OK",grpc_method="Watch",grpc_service="pkg.Service",grpc_type="ServerStream"} 0
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitServiceDesc(t *testing.T) {
+	m := NewClientMetrics()
+	desc := &grpc.ServiceDesc{
+		ServiceName: "pkg.Service",
+		Methods:     []grpc.MethodDesc{{MethodName: "Get"}},
+		Streams:     []grpc.StreamDesc{{StreamName: "Watch", ServerStreams: true}},
+	}
+	check(t, m.InitServiceDesc(desc, codes.OK))
+	if err := m.InitServiceDesc(nil); err == nil {
+		t.Fatal("expected error for nil desc")
+	}
+	want := `
+# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+# TYPE grpc_client_requests_total counter
+grpc_client_requests_total{grpc_code="OK",grpc_method="Get",grpc_service="pkg.Service",grpc_type="Unary"} 0
+grpc_client_requests_total{grpc_code="OK",grpc_method="Watch",grpc_service="pkg.Service",grpc_type="ServerStream"} 0
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitFiles(t *testing.T) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("grpcprom/init_files_test.proto"),
+		Package:    proto.String("pkg"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/empty.proto"},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{Name: proto.String("Empty")},
+			{
+				Name: proto.String("Service"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("Get"),
+						InputType:  proto.String(".google.protobuf.Empty"),
+						OutputType: proto.String(".google.protobuf.Empty"),
+					},
+					{
+						Name:            proto.String("Watch"),
+						InputType:       proto.String(".google.protobuf.Empty"),
+						OutputType:      proto.String(".google.protobuf.Empty"),
+						ServerStreaming: proto.Bool(true),
+					},
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	check(t, err)
+	files := new(protoregistry.Files)
+	check(t, files.RegisterFile(fd))
+
+	m := NewClientMetrics()
+	check(t, m.InitFiles(files, codes.OK))
+	want := `
+# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+# TYPE grpc_client_requests_total counter
+grpc_client_requests_total{grpc_code="OK",grpc_method="Get",grpc_service="pkg.Service",grpc_type="Unary"} 0
+grpc_client_requests_total{grpc_code="OK",grpc_method="Watch",grpc_service="pkg.Service",grpc_type="ServerStream"} 0
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	m = NewClientMetrics()
+	check(t, m.InitServiceDescriptors([]protoreflect.ServiceDescriptor{fd.Services().ByName("Service")}, codes.OK))
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	m := NewServerMetrics(PprofLabels())
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	_, err := m.UnaryInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		for key, want := range map[string]string{"grpc_service": "pkg.Service", "grpc_method": "Method"} {
+			if got, _ := pprof.Label(ctx, key); got != want {
+				t.Errorf("pprof label %s = %q; want %q", key, got, want)
+			}
+		}
+		return nil, nil
+	})
+	check(t, err)
+}
+
+func TestRequestsClientCanceled(t *testing.T) {
+	m := NewServerMetrics()
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	for _, clientCanceled := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := m.UnaryInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			if clientCanceled {
+				cancel()
+			}
+			return nil, status.Error(codes.Canceled, "canceled")
+		})
+		cancel()
+		if status.Code(err) != codes.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	want := `
+		# HELP grpc_server_requests_client_canceled_total Total number of gRPC server requests canceled by their clients while being handled.
+		# TYPE grpc_server_requests_client_canceled_total counter
+		grpc_server_requests_client_canceled_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_client_canceled_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlersRunning(t *testing.T) {
+	m := NewServerMetrics(HandlersRunning(Enable()))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	want := func(n int) string {
+		return fmt.Sprintf(`
+			# HELP grpc_server_handlers_running Number of gRPC server handlers running.
+			# TYPE grpc_server_handlers_running gauge
+			grpc_server_handlers_running{grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} %d
+		`, n)
+	}
+	_, err := m.UnaryInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, testutil.CollectAndCompare(m, strings.NewReader(want(1)), "grpc_server_handlers_running")
+	})
+	check(t, err)
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want(0)), "grpc_server_handlers_running"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamsOpen(t *testing.T) {
+	m := NewServerMetrics(StreamsOpen(Enable()), StreamMessagesOpen(Enable()))
+	h := m.handler
+	want := func(streams, msgs int) string {
+		return fmt.Sprintf(`
+			# HELP grpc_server_stream_messages_open Number of messages sent and received by open gRPC server streams.
+			# TYPE grpc_server_stream_messages_open gauge
+			grpc_server_stream_messages_open{grpc_method="Watch",grpc_service="pkg.Service",grpc_type="ServerStream"} %d
+			# HELP grpc_server_streams_open Number of gRPC server streams open.
+			# TYPE grpc_server_streams_open gauge
+			grpc_server_streams_open{grpc_method="Watch",grpc_service="pkg.Service",grpc_type="ServerStream"} %d
+		`, msgs, streams)
+	}
+	unaryCtx := h.context(context.Background(), "/pkg.Service/Get", unary)
+	h.HandleRPC(unaryCtx, &stats.Begin{BeginTime: time.Now()})
+	ctx := h.context(context.Background(), "/pkg.Service/Watch", serverStream)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now()})
+	names := []string{"grpc_server_streams_open", "grpc_server_stream_messages_open"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want(1, 3)), names...); err != nil {
+		t.Fatal(err)
+	}
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	h.HandleRPC(unaryCtx, &stats.End{EndTime: time.Now()})
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want(0, 0)), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerCPUSeconds(t *testing.T) {
+	if !threadCPUTimeSupported {
+		t.Skip("thread CPU time isn't supported")
+	}
+	m := NewServerMetrics(HandlerCPUSeconds(Enable()))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	_, err := m.UnaryInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		for start, _ := threadCPUTime(); ; {
+			if now, _ := threadCPUTime(); now-start > time.Millisecond {
+				return nil, nil
+			}
+		}
+	})
+	check(t, err)
+	if got := testutil.ToFloat64(m.handler.cpuTime.total); got < 0.001 {
+		t.Fatalf("handler_cpu_seconds_total = %v; want at least 0.001", got)
+	}
+}
+
+// finishCall calls the OnFinish callbacks of the call options,
+// as gRPC does before the end of the last attempt of a call.
+func finishCall(opts []grpc.CallOption) {
+	for _, opt := range opts {
+		if o, ok := opt.(grpc.OnFinishCallOption); ok {
+			o.OnFinish(nil)
+		}
+	}
+}
+
+func TestTraceTasks(t *testing.T) {
+	check(t, trace.Start(io.Discard))
+	defer trace.Stop()
+
+	m := NewClientMetrics(TraceTasks())
+	h := m.handler
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	_, err := m.StreamInterceptor()(context.Background(), desc, nil, "/pkg.Service/Watch",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			v := ctx.Value(h).(*rpcInfo)
+			if v.task == nil {
+				t.Fatal("stream has no trace task")
+			}
+			h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+			finishCall(opts)
+			h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+			if v.task != nil {
+				t.Fatal("trace task not ended with the stream")
+			}
+			return nil, nil
+		})
+	check(t, err)
+}
+
+func TestRPCSizeBytes(t *testing.T) {
+	m := NewClientMetrics(RequestSizeBytes(Enable(), NoBuckets()), ResponseSizeBytes(Enable(), NoBuckets()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", bidiStream)
+	h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{Client: true, WireLength: 100, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutPayload{Client: true, WireLength: 200, SentTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InHeader{Client: true, WireLength: 10})
+	h.HandleRPC(ctx, &stats.InPayload{Client: true, WireLength: 50, RecvTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InTrailer{Client: true, WireLength: 5})
+	h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now()})
+	want := `
+		# HELP grpc_client_request_size_bytes_count Total bytes of gRPC client requests count.
+		# TYPE grpc_client_request_size_bytes_count counter
+		grpc_client_request_size_bytes_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 1
+		# HELP grpc_client_request_size_bytes_sum Total bytes of gRPC client requests sum.
+		# TYPE grpc_client_request_size_bytes_sum counter
+		grpc_client_request_size_bytes_sum{grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 300
+		# HELP grpc_client_response_size_bytes_count Total bytes of gRPC client responses count.
+		# TYPE grpc_client_response_size_bytes_count counter
+		grpc_client_response_size_bytes_count{grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 1
+		# HELP grpc_client_response_size_bytes_sum Total bytes of gRPC client responses sum.
+		# TYPE grpc_client_response_size_bytes_sum counter
+		grpc_client_response_size_bytes_sum{grpc_method="Method",grpc_service="pkg.Service",grpc_type="BidiStream"} 65
+	`
+	names := []string{
+		"grpc_client_request_size_bytes_count", "grpc_client_request_size_bytes_sum",
+		"grpc_client_response_size_bytes_count", "grpc_client_response_size_bytes_sum",
+	}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlineClassLabel(t *testing.T) {
+	m := NewServerMetrics(DeadlineClassLabel())
+	h := m.handler
+	for _, timeout := range []time.Duration{0, 50 * time.Millisecond, 500 * time.Millisecond, 5 * time.Second, time.Minute, time.Minute} {
+		ctx := context.Background()
+		begin := time.Now()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, begin.Add(timeout))
+			defer cancel()
+		}
+		ctx = h.context(ctx, "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_deadline="<100ms",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_deadline="<10s",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_deadline="<1s",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_deadline=">=10s",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_server_requests_total{grpc_code="OK",grpc_deadline="none",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m := NewServerMetrics(
+		ServerLabel(),
+		LatencySeconds(Buckets([]float64{1, 2, 3}), BucketsFor("/pkg.Service/Slow", []float64{10, 20})),
+		SentBytes(NoBuckets()),
+		RecvBytes(Buckets([]float64{64, 1024})),
+		Derived(DerivedMetric{Name: "error_ratio", Help: "Ratio of errors.", Value: func(*MethodStats) (float64, bool) { return 0, false }}),
+	)
+	got := make(map[string]MetricMetadata)
+	for _, md := range m.Metadata() {
+		got[md.Name] = md
+	}
+	for _, want := range []MetricMetadata{
+		{
+			Name:   "grpc_server_connections_open",
+			Type:   dto.MetricType_GAUGE,
+			Help:   "Number of gRPC server connections open.",
+			Labels: nil,
+		},
+		{
+			Name:   "grpc_server_requests_total",
+			Type:   dto.MetricType_COUNTER,
+			Help:   "Total number of gRPC server requests completed.",
+			Labels: []string{"grpc_server", "grpc_type", "grpc_service", "grpc_method", "grpc_code"},
+		},
+		{
+			Name:    "grpc_server_latency_seconds",
+			Type:    dto.MetricType_HISTOGRAM,
+			Help:    "Latency of gRPC server requests.",
+			Labels:  []string{"grpc_server", "grpc_type", "grpc_service", "grpc_method", "grpc_code"},
+			Buckets: []float64{1, 2, 3},
+			MethodBuckets: map[string][]float64{
+				"/pkg.Service/Slow": {10, 20},
+			},
+		},
+		{
+			Name:    "grpc_server_recv_bytes",
+			Type:    dto.MetricType_HISTOGRAM,
+			Help:    "Bytes received in gRPC server requests.",
+			Labels:  []string{"grpc_server", "grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
+			Buckets: []float64{64, 1024},
+		},
+		{
+			Name:   "grpc_server_sent_bytes_sum",
+			Type:   dto.MetricType_COUNTER,
+			Help:   "Bytes sent in gRPC server responses sum.",
+			Labels: []string{"grpc_server", "grpc_type", "grpc_service", "grpc_method", "grpc_frame"},
+		},
+		{
+			Name:   "grpc_server_error_ratio",
+			Type:   dto.MetricType_GAUGE,
+			Help:   "Ratio of errors.",
+			Labels: []string{"grpc_server", "grpc_type", "grpc_service", "grpc_method"},
+		},
+	} {
+		if md, ok := got[want.Name]; !ok {
+			t.Errorf("missing metadata: %s", want.Name)
+		} else if !reflect.DeepEqual(md, want) {
+			t.Errorf("unexpected metadata: got: %+v; want: %+v", md, want)
+		}
+	}
+	for name, md := range got {
+		if md.Type == dto.MetricType_UNTYPED {
+			t.Errorf("untyped metric: %s", name)
+		}
+	}
+}
+
+func TestFallbackMethodLabels(t *testing.T) {
+	m := NewServerMetrics(FallbackMethodLabels("other", "other"))
+	h := m.handler
+	for _, method := range []string{"/tenant/pkg.Service/Method", "/pkg.Service/Method"} {
+		ctx := h.context(context.Background(), method, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_method="other",grpc_service="other",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMethodParser(t *testing.T) {
+	parse := func(fullMethod string) (service, method string, lvs []string) {
+		segs := strings.Split(strings.TrimPrefix(fullMethod, "/"), "/")
+		if len(segs) != 3 {
+			return "", "", nil
+		}
+		return segs[1], segs[2], []string{segs[0]}
+	}
+	m := NewServerMetrics(MethodParser(parse, "tenant"))
+	h := m.handler
+	for _, method := range []string{"/a/pkg.Service/Method", "/b/pkg.Service/Method", "/b/pkg.Service/Method", "/pkg.Service/Method"} {
+		ctx := h.context(context.Background(), method, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant="a"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant="b"} 2
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Unknown",grpc_service="Unknown",grpc_type="Unary",tenant=""} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipRPCs(t *testing.T) {
+	m := NewServerMetrics(SkipRPCs(SkipMetadata("x-load-test")))
+	h := m.handler
+	for _, md := range []metadata.MD{nil, metadata.Pairs("x-load-test", "1"), metadata.Pairs("other", "1")} {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+		ctx = h.context(ctx, "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterMethods(t *testing.T) {
+	m := NewServerMetrics(FilterMethods(func(fullMethod string) bool {
+		return fullMethod != "/pkg.Service/Hot"
+	}))
+	check(t, m.InitMethods("pkg.Service", []grpc.MethodInfo{{Name: "Hot"}, {Name: "Method"}}, codes.OK))
+	h := m.handler
+	for _, method := range []string{"/pkg.Service/Hot", "/pkg.Service/Method"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: method})
+		ctx = h.context(ctx, method, unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtraLabels(t *testing.T) {
+	tenant := func(ctx context.Context, _ string) []string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return md.Get("tenant")
+	}
+	m := NewServerMetrics(ExtraLabels([]string{"tenant"}, tenant), LatencySeconds(NoBuckets()))
+	check(t, m.InitMethods("pkg.Service", []grpc.MethodInfo{{Name: "Method"}}, codes.OK))
+	h := m.handler
+	for _, md := range []metadata.MD{
+		metadata.Pairs("tenant", "a"),
+		metadata.Pairs("tenant", "a"),
+		metadata.Pairs("tenant", "b", "tenant", "c"),
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		ctx = h.context(ctx, "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_latency_seconds_count Latency of gRPC server requests count.
+		# TYPE grpc_server_latency_seconds_count counter
+		grpc_server_latency_seconds_count{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant=""} 1
+		grpc_server_latency_seconds_count{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant="a"} 2
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant=""} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary",tenant="a"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_latency_seconds_count", "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodeClassLabel(t *testing.T) {
+	m := NewServerMetrics(CodeClassLabel(), LatencySeconds(NoBuckets()))
+	check(t, m.InitMethods("pkg.Service", []grpc.MethodInfo{{Name: "Method"}}, codes.OK))
+	h := m.handler
+	for _, err := range []error{
+		nil,
+		status.Error(codes.NotFound, "not found"),
+		status.Error(codes.InvalidArgument, "invalid"),
+		status.Error(codes.Unavailable, "unavailable"),
+	} {
+		ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: err})
+	}
+	want := `
+		# HELP grpc_server_latency_seconds_count Latency of gRPC server requests count.
+		# TYPE grpc_server_latency_seconds_count counter
+		grpc_server_latency_seconds_count{grpc_code_class="client_error",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_server_latency_seconds_count{grpc_code_class="ok",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_latency_seconds_count{grpc_code_class="server_error",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code_class="client_error",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_server_requests_total{grpc_code_class="ok",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code_class="server_error",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_latency_seconds_count", "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodeMapper(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	m := NewServerMetrics(CodeMapper(func(err error) string {
+		if errors.Is(err, errQuota) {
+			return "QuotaExceeded"
+		}
+		return ""
+	}))
+	h := m.handler
+	for _, err := range []error{nil, fmt.Errorf("wrapped: %w", errQuota), status.Error(codes.NotFound, "not found")} {
+		ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: err})
+	}
+	want := `
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="NotFound",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		grpc_server_requests_total{grpc_code="QuotaExceeded",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerLabel(t *testing.T) {
+	m := NewServerMetrics(PeerLabel(1), LatencySeconds(NoBuckets()))
+	h := m.handler
+	local := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+	for _, remote := range []*net.TCPAddr{
+		{IP: net.IPv4(10, 0, 0, 2), Port: 50001},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 50002},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 50003},
+	} {
+		ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{LocalAddr: local, RemoteAddr: remote})
+		ctx = h.context(ctx, "/pkg.Service/Method", unary)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_latency_seconds_count Latency of gRPC server requests count.
+		# TYPE grpc_server_latency_seconds_count counter
+		grpc_server_latency_seconds_count{grpc_code="OK",grpc_method="Method",grpc_peer="10.0.0.2",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_server_latency_seconds_count{grpc_code="OK",grpc_method="Method",grpc_peer="Other",grpc_service="pkg.Service",grpc_type="Unary"} 1
+		# HELP grpc_server_requests_total Total number of gRPC server requests completed.
+		# TYPE grpc_server_requests_total counter
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_peer="10.0.0.2",grpc_service="pkg.Service",grpc_type="Unary"} 2
+		grpc_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_peer="Other",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_requests_total", "grpc_server_latency_seconds_count"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSentHeaderBytes(t *testing.T) {
+	m := NewServerMetrics(SentBytes(NoBuckets()))
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.OutHeader{Header: metadata.Pairs("key", "value", "data-bin", "\x00\x01\x02")})
+	h.HandleRPC(ctx, &stats.OutTrailer{Trailer: metadata.Pairs("k", "v", "k", "vv")})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	want := `
+		# HELP grpc_server_sent_bytes_sum Bytes sent in gRPC server responses sum.
+		# TYPE grpc_server_sent_bytes_sum counter
+		grpc_server_sent_bytes_sum{grpc_frame="Header",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 20
+		grpc_server_sent_bytes_sum{grpc_frame="Trailer",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 5
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_sent_bytes_sum"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	m := NewServerMetrics(
+		Namespace("acme"),
+		SubsystemPrefix("api"),
+		LatencyMaxSeconds(Enable()),
+		LatencyEWMASeconds(Enable()),
+		Derived(DerivedMetric{Name: "error_ratio", Help: "Ratio of errors.", Value: func(*MethodStats) (float64, bool) { return 0, false }}),
+	)
+	h := m.handler
+	ctx := h.context(context.Background(), "/pkg.Service/Method", unary)
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	want := `
+		# HELP acme_api_server_requests_total Total number of gRPC server requests completed.
+		# TYPE acme_api_server_requests_total counter
+		acme_api_server_requests_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="Unary"} 1
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "acme_api_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(m, "grpc_server_requests_total", "grpc_server_latency_max_seconds"); got != 0 {
+		t.Errorf("unexpected default metrics: got: %d; want: 0", got)
+	}
+	if got := testutil.CollectAndCount(m, "acme_api_server_latency_max_seconds"); got != 1 {
+		t.Errorf("unexpected renamed metrics: got: %d; want: 1", got)
+	}
+	for _, md := range m.Metadata() {
+		if !strings.HasPrefix(md.Name, "acme_api_server_") {
+			t.Errorf("unexpected metadata name: %s", md.Name)
+		}
+		if md.Type == dto.MetricType_UNTYPED {
+			t.Errorf("untyped metric: %s", md.Name)
+		}
+	}
+}
+
+func TestGoGRPCPrometheusMetrics(t *testing.T) {
+	m := NewServerMetrics(GoGRPCPrometheusMetrics())
+	h := m.handler
+	for _, code := range []codes.Code{codes.OK, codes.NotFound, codes.NotFound} {
+		ctx := h.context(context.Background(), "/pkg.Service/Method", serverStream)
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.InPayload{RecvTime: time.Now()})
+		h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now()})
+		h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now(), Error: status.Error(code, "")})
+	}
+	want := `
+		# HELP grpc_server_handled_total Total number of RPCs completed on the server, regardless of success or failure.
+		# TYPE grpc_server_handled_total counter
+		grpc_server_handled_total{grpc_code="NotFound",grpc_method="Method",grpc_service="pkg.Service",grpc_type="server_stream"} 2
+		grpc_server_handled_total{grpc_code="OK",grpc_method="Method",grpc_service="pkg.Service",grpc_type="server_stream"} 1
+		# HELP grpc_server_msg_received_total Total number of RPC stream messages received on the server.
+		# TYPE grpc_server_msg_received_total counter
+		grpc_server_msg_received_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="server_stream"} 3
+		# HELP grpc_server_msg_sent_total Total number of gRPC stream messages sent by the server.
+		# TYPE grpc_server_msg_sent_total counter
+		grpc_server_msg_sent_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="server_stream"} 6
+		# HELP grpc_server_started_total Total number of RPCs started on the server.
+		# TYPE grpc_server_started_total counter
+		grpc_server_started_total{grpc_method="Method",grpc_service="pkg.Service",grpc_type="server_stream"} 3
+	`
+	names := []string{
+		"grpc_server_handled_total",
+		"grpc_server_msg_received_total",
+		"grpc_server_msg_sent_total",
+		"grpc_server_started_total",
+	}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(m, "grpc_server_handling_seconds"); got != 1 {
+		t.Errorf("unexpected handling_seconds series: got: %d; want: 1", got)
+	}
+}
+
+func TestRequestsCanceledTotal(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for _, tt := range []struct {
+		name  string
+		ctx   context.Context
+		err   error
+		cause string
+	}{
+		{"client", canceled, status.Error(codes.Canceled, "context canceled"), "client"},
+		{"deadline", expired, status.Error(codes.Canceled, "downstream canceled"), "deadline"},
+		{"shutdown", context.Background(), grpc.ErrClientConnClosing, "shutdown"},
+		{"server", context.Background(), status.Error(codes.Canceled, "handler canceled"), "server"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewClientMetrics(RequestsCanceledTotal(Enable()))
+			h := m.handler
+			ctx := h.TagRPC(tt.ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+			h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: time.Now()})
+			h.HandleRPC(ctx, &stats.End{Client: true, EndTime: time.Now(), Error: tt.err})
+			for _, cause := range cancelCauses {
+				want := 0.0
+				if cause == tt.cause {
+					want = 1
+				}
+				c := h.canceledBy.WithLabelValues(unknown, "pkg.Service", "Method", cause)
+				if got := testutil.ToFloat64(c); got != want {
+					t.Errorf("requests_canceled_total{grpc_cause=%q} = %v; want %v", cause, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataSize(t *testing.T) {
+	m := NewServerMetrics(
+		MetadataBytes(Enable(), NoBuckets()),
+		MetadataEntries(Enable(), NoBuckets(), MetadataKeys("Authorization")),
+	)
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InHeader{Header: metadata.MD{
+		":authority":    {"example.com"},
+		"content-type":  {"application/grpc"},
+		"grpc-timeout":  {"1S"},
+		"authorization": {"Bearer token"},
+		"x-tags":        {"a", "b"},
+		"x-ctx-bin":     {"\x00\x01\x02"},
+	}})
+	h.HandleRPC(ctx, &stats.OutTrailer{Trailer: metadata.MD{"x-cost": {"42"}}})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	size := len("authorization") + len("Bearer token") + 2*len("x-tags") + 2 + len("x-ctx-bin") + 4
+	for _, tt := range []struct {
+		metric string
+		c      *counters
+		dir    string
+		frame  string
+		sum    float64
+		num    float64
+	}{
+		{"metadata_bytes", h.mdBytes.observer.(*counters), "recv", header, float64(size), 1},
+		{"metadata_bytes", h.mdBytes.observer.(*counters), "sent", trailer, float64(len("x-cost") + 2), 1},
+		{"metadata_entries", h.mdEntries.observer.(*counters), "recv", header, 1, 1},
+		{"metadata_entries", h.mdEntries.observer.(*counters), "sent", trailer, 0, 1},
+	} {
+		lvs := []string{unknown, "pkg.Service", "Method", tt.dir, tt.frame}
+		if got := testutil.ToFloat64(tt.c.sum.WithLabelValues(lvs...)); got != tt.sum {
+			t.Errorf("%s_sum{%s,%s} = %v; want %v", tt.metric, tt.dir, tt.frame, got, tt.sum)
+		}
+		if got := testutil.ToFloat64(tt.c.num.WithLabelValues(lvs...)); got != tt.num {
+			t.Errorf("%s_count{%s,%s} = %v; want %v", tt.metric, tt.dir, tt.frame, got, tt.num)
+		}
+	}
+}
+
+func TestUncompressed(t *testing.T) {
+	m := NewServerMetrics(RecvBytes(Uncompressed(), NoBuckets()), SentBytes(NoBuckets()))
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.InPayload{RecvTime: time.Now(), Length: 100, CompressedLength: 35, WireLength: 40})
+	h.HandleRPC(ctx, &stats.OutPayload{SentTime: time.Now(), Length: 100, CompressedLength: 35, WireLength: 40})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	lvs := []string{unknown, "pkg.Service", "Method", payload}
+	if got := testutil.ToFloat64(h.recvBytes.(*counters).sum.WithLabelValues(lvs...)); got != 100 {
+		t.Errorf("recv_bytes_sum = %v; want 100", got)
+	}
+	if got := testutil.ToFloat64(h.sentBytes.(*counters).sum.WithLabelValues(lvs...)); got != 40 {
+		t.Errorf("sent_bytes_sum = %v; want 40", got)
+	}
+}
+
+func TestLatencySummary(t *testing.T) {
+	m := NewServerMetrics(LatencySeconds(Summary(map[float64]float64{0.5: 0.05, 0.99: 0.001})))
+	h := m.handler
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mf *dto.MetricFamily
+	for _, v := range mfs {
+		if v.GetName() == "grpc_server_latency_seconds" {
+			mf = v
+		}
+	}
+	if mf == nil {
+		t.Fatal("missing grpc_server_latency_seconds")
+	}
+	if typ := mf.GetType(); typ != dto.MetricType_SUMMARY {
+		t.Fatalf("grpc_server_latency_seconds type = %v; want %v", typ, dto.MetricType_SUMMARY)
+	}
+	s := mf.GetMetric()[0].GetSummary()
+	if n := s.GetSampleCount(); n != 1 {
+		t.Errorf("grpc_server_latency_seconds_count = %v; want 1", n)
+	}
+	if n := len(s.GetQuantile()); n != 2 {
+		t.Errorf("grpc_server_latency_seconds quantiles = %v; want 2", n)
+	}
+	for _, md := range m.Metadata() {
+		if md.Name == "grpc_server_latency_seconds" && (md.Type != dto.MetricType_SUMMARY || md.Buckets != nil) {
+			t.Errorf("unexpected metadata: %+v", md)
+		}
+	}
+}
+
+func TestBucketsFor(t *testing.T) {
+	m := NewServerMetrics(LatencySeconds(
+		Buckets([]float64{1, 2}),
+		BucketsFor("/pkg.Service/Slow", []float64{10, 20, 30}),
+	))
+	h := m.handler
+	for _, name := range []string{"/pkg.Service/Fast", "/pkg.Service/Slow"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: name})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	for _, mf := range mfs {
+		if mf.GetName() != "grpc_server_latency_seconds" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			for _, lp := range metric.GetLabel() {
+				if lp.GetName() == "grpc_method" {
+					got[lp.GetValue()] = len(metric.GetHistogram().GetBucket())
+				}
+			}
+		}
+	}
+	want := map[string]int{"Fast": 2, "Slow": 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buckets by method: got: %v; want: %v", got, want)
+	}
+}
+
+func TestPendingRequests(t *testing.T) {
+	m := NewServerMetrics(RequestsPending(Disable()))
+	h := m.handler
+	var ctxs []context.Context
+	for _, name := range []string{"/pkg.Service/A", "/pkg.Service/A", "/pkg.Service/B"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: name})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		ctxs = append(ctxs, ctx)
+	}
+	if n := m.PendingRequests("pkg.Service", "A"); n != 2 {
+		t.Fatalf("PendingRequests(A) = %v; want 2", n)
+	}
+	if n := m.PendingRequestsTotal(); n != 3 {
+		t.Fatalf("PendingRequestsTotal() = %v; want 3", n)
+	}
+	for _, ctx := range ctxs {
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	for _, method := range []string{"A", "B", "C"} {
+		if n := m.PendingRequests("pkg.Service", method); n != 0 {
+			t.Fatalf("PendingRequests(%s) = %v; want 0", method, n)
+		}
+	}
+	if n := m.PendingRequestsTotal(); n != 0 {
+		t.Fatalf("PendingRequestsTotal() = %v; want 0", n)
+	}
+}
+
+func TestMaxVecConcurrent(t *testing.T) {
+	desc := prometheus.NewDesc("test_max", "Test.", []string{"l"}, nil)
+	m := newMaxVec(desc, true)
+	c := m.With("a")
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(v float64) {
+			defer wg.Done()
+			c.Observe(v)
+		}(float64(i))
+	}
+	wg.Wait()
+	want := `
+		# HELP test_max Test.
+		# TYPE test_max gauge
+		test_max{l="a"} 100
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	// The maximum is reset to the current value when collected.
+	want = strings.Replace(want, "100", "0", 1)
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxAdderVecConcurrent(t *testing.T) {
+	desc := prometheus.NewDesc("test_max", "Test.", nil, nil)
+	m := maxAdderVec{newMaxVec(desc, true)}
+	c := m.With()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Add(1)
+		}()
+	}
+	wg.Wait()
+	c.Add(-60)
+	want := `
+		# HELP test_max Test.
+		# TYPE test_max gauge
+		test_max 100
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	// The maximum is reset to the current value when collected.
+	want = strings.Replace(want, "100", "40", 1)
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsInterceptors(t *testing.T) {
+	var m Metrics = NewClientMetrics()
+	unary, stream := m.Interceptors()
+	if _, ok := unary.(grpc.UnaryClientInterceptor); !ok {
+		t.Errorf("unexpected client unary interceptor type: %T", unary)
+	}
+	if _, ok := stream.(grpc.StreamClientInterceptor); !ok {
+		t.Errorf("unexpected client stream interceptor type: %T", stream)
+	}
+	m = NewServerMetrics()
+	unary, stream = m.Interceptors()
+	if _, ok := unary.(grpc.UnaryServerInterceptor); !ok {
+		t.Errorf("unexpected server unary interceptor type: %T", unary)
+	}
+	if _, ok := stream.(grpc.StreamServerInterceptor); !ok {
+		t.Errorf("unexpected server stream interceptor type: %T", stream)
+	}
+}
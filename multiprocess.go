@@ -0,0 +1,247 @@
+package grpcprom
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// multiprocessExt is the extension of the metrics files of processes.
+	multiprocessExt = ".grpcprom"
+	// multiprocessDead precedes the extension of the files of dead processes.
+	multiprocessDead = ".dead"
+	// multiprocessLabel is the label of the series of each process
+	// in families that can't be combined.
+	multiprocessLabel = "grpc_process"
+)
+
+// A MultiprocessWriter writes snapshots of metrics to a file in a directory
+// shared by the worker processes of a service, such as in a pre-fork server,
+// so that they may be aggregated into one scrape target by a Multiprocess
+// Aggregator. Each process's file is named by its process ID and a random ID,
+// so that a reused process ID doesn't replace the file of another process.
+type MultiprocessWriter struct {
+	g    prometheus.Gatherer
+	path string
+}
+
+// NewMultiprocessWriter returns a new MultiprocessWriter of the given collectors
+// to a file in dir.
+func NewMultiprocessWriter(dir string, collectors ...prometheus.Collector) (*MultiprocessWriter, error) {
+	r := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	name := strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(id[:])
+	return &MultiprocessWriter{
+		g:    r,
+		path: filepath.Join(dir, name+multiprocessExt),
+	}, nil
+}
+
+// Write writes a snapshot of the metrics. The file is replaced atomically,
+// so that it's never read partially written.
+func (w *MultiprocessWriter) Write() error {
+	mfs, err := w.g.Gather()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(w.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	for _, mf := range mfs {
+		if _, err := protodelim.MarshalTo(bw, mf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), w.path)
+}
+
+// Close marks the process dead and writes a final snapshot of the metrics,
+// which must not be written again. See MarkProcessDead.
+func (w *MultiprocessWriter) Close() error {
+	dead := deadPath(w.path)
+	if err := os.Rename(w.path, dead); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	w.path = dead
+	return w.Write()
+}
+
+// MarkProcessDead marks the files written to dir by the process with the given
+// ID as those of a dead process, such as when a pre-fork server is notified that
+// a worker exited. It must be called before the process ID may be reused.
+// The counters, histograms, and summaries of dead processes are still
+// aggregated, so that they don't appear to reset, but their gauges, such as
+// requests_pending and connections_open, are dropped.
+func MarkProcessDead(dir string, pid int) error {
+	paths, err := filepath.Glob(filepath.Join(dir, strconv.Itoa(pid)+"-*"+multiprocessExt))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range paths {
+		if isDeadPath(path) {
+			continue
+		}
+		if err := os.Rename(path, deadPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deadPath returns the path of the file of a live process once it's dead.
+func deadPath(path string) string {
+	if isDeadPath(path) {
+		return path
+	}
+	return strings.TrimSuffix(path, multiprocessExt) + multiprocessDead + multiprocessExt
+}
+
+// isDeadPath reports whether the path is the file of a dead process.
+func isDeadPath(path string) bool {
+	return strings.HasSuffix(path, multiprocessDead+multiprocessExt)
+}
+
+// Run writes snapshots of the metrics at the interval until the context is done,
+// when it writes a final snapshot and returns the context's error.
+func (w *MultiprocessWriter) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := w.Write(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-t.C:
+			if err := w.Write(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewMultiprocessAggregator returns a new Aggregator of the metrics written
+// to files in dir by the MultiprocessWriters of worker processes.
+//
+// The counters, histograms, and summaries of dead processes are still
+// aggregated, so that they don't appear to reset, until their files are
+// removed, such as when the service is restarted. Their gauges are dropped,
+// because they describe the live process. A process is dead once its writer
+// is closed or it's marked by MarkProcessDead. See Aggregator for how
+// the metrics of processes are combined.
+//
+// Summaries and gauges of states (e.g. circuit_breaker_state or health_status)
+// can't be combined, so the series of each process are labeled grpc_process
+// with the ID of its file, which is its process ID and a random ID.
+func NewMultiprocessAggregator(dir string) *Aggregator {
+	return &Aggregator{gatherers: []prometheus.Gatherer{dirGatherer(dir)}}
+}
+
+// dirGatherer gathers the metrics from the files in a directory.
+type dirGatherer string
+
+// Gather implements the prometheus.Gatherer interface. The families of each
+// file are returned separately, so that they're merged by the Aggregator.
+func (dir dirGatherer) Gather() ([]*dto.MetricFamily, error) {
+	paths, err := filepath.Glob(filepath.Join(string(dir), "*"+multiprocessExt))
+	if err != nil {
+		return nil, err
+	}
+	var mfs []*dto.MetricFamily
+	var errs []error
+	for _, path := range paths {
+		fmfs, err := readMetricsFile(path)
+		if errors.Is(err, os.ErrNotExist) && !isDeadPath(path) {
+			// The process was marked dead since listed.
+			path = deadPath(path)
+			fmfs, err = readMetricsFile(path)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed since listed
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dead := isDeadPath(path)
+		id := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), multiprocessExt), multiprocessDead)
+		for _, mf := range fmfs {
+			if dead && mf.GetType() == dto.MetricType_GAUGE {
+				continue
+			}
+			if aggModeOf(mf.GetName(), mf.GetType()) == aggSingle {
+				labelProcess(mf, id)
+			}
+			mfs = append(mfs, mf)
+		}
+	}
+	return mfs, errors.Join(errs...)
+}
+
+// labelProcess labels the series of the family with the process's file ID.
+// The labels are kept sorted by name, as they're gathered.
+func labelProcess(mf *dto.MetricFamily, id string) {
+	for _, m := range mf.Metric {
+		i := sort.Search(len(m.Label), func(i int) bool {
+			return m.Label[i].GetName() >= multiprocessLabel
+		})
+		lp := &dto.LabelPair{Name: proto.String(multiprocessLabel), Value: proto.String(id)}
+		m.Label = append(m.Label[:i], append([]*dto.LabelPair{lp}, m.Label[i:]...)...)
+	}
+}
+
+func readMetricsFile(path string) ([]*dto.MetricFamily, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var mfs []*dto.MetricFamily
+	for {
+		mf := &dto.MetricFamily{}
+		if err := protodelim.UnmarshalFrom(r, mf); err != nil {
+			if err == io.EOF {
+				return mfs, nil
+			}
+			return nil, err
+		}
+		mfs = append(mfs, mf)
+	}
+}
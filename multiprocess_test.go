@@ -0,0 +1,126 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/stats"
+)
+
+func TestMultiprocess(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"1", "2"} {
+		m := NewClientMetrics()
+		for j := 0; j <= i; j++ {
+			ctx := m.handler.TagConn(context.Background(), &stats.ConnTagInfo{})
+			m.handler.HandleConn(ctx, &stats.ConnBegin{Client: true})
+		}
+		w, err := NewMultiprocessWriter(dir, m)
+		check(t, err)
+		w.path = filepath.Join(dir, name+multiprocessExt) // distinct processes
+		check(t, w.Write())
+		check(t, w.Write()) // replaced
+	}
+	want := `
+# HELP grpc_client_connections_total Total number of gRPC client connections opened.
+# TYPE grpc_client_connections_total counter
+grpc_client_connections_total 3
+`
+	if err := testutil.CollectAndCompare(NewMultiprocessAggregator(dir), strings.NewReader(want), "grpc_client_connections_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiprocessDead(t *testing.T) {
+	dir := t.TempDir()
+	var ws []*MultiprocessWriter
+	for i := 0; i < 2; i++ {
+		m := NewClientMetrics()
+		for j := 0; j <= i; j++ {
+			ctx := m.handler.TagConn(context.Background(), &stats.ConnTagInfo{})
+			m.handler.HandleConn(ctx, &stats.ConnBegin{Client: true})
+		}
+		w, err := NewMultiprocessWriter(dir, m)
+		check(t, err)
+		check(t, w.Write())
+		ws = append(ws, w)
+	}
+	if ws[0].path == ws[1].path {
+		t.Fatalf("writers of one process share a file: %s", ws[0].path)
+	}
+	compare := func(open, total int) {
+		t.Helper()
+		want := fmt.Sprintf(`
+# HELP grpc_client_connections_total Total number of gRPC client connections opened.
+# TYPE grpc_client_connections_total counter
+grpc_client_connections_total %d
+`, total)
+		if open > 0 {
+			want += fmt.Sprintf(`
+# HELP grpc_client_connections_open Number of gRPC client connections open.
+# TYPE grpc_client_connections_open gauge
+grpc_client_connections_open %d
+`, open)
+		}
+		names := []string{"grpc_client_connections_open", "grpc_client_connections_total"}
+		if err := testutil.CollectAndCompare(NewMultiprocessAggregator(dir), strings.NewReader(want), names...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compare(3, 3)
+	check(t, ws[1].Close())
+	compare(1, 3)
+	check(t, MarkProcessDead(dir, os.Getpid()))
+	compare(0, 3)
+}
+
+func TestMultiprocessUncombined(t *testing.T) {
+	dir := t.TempDir()
+	var ws []*MultiprocessWriter
+	for i, name := range []string{"1", "2"} {
+		m := NewServerMetrics(
+			LatencySeconds(Summary(map[float64]float64{0.5: 0.05})),
+			CircuitBreakerState(Enable()),
+		)
+		ctx := m.handler.context(context.Background(), "/pkg.Service/Method", unary)
+		m.handler.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		m.handler.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+		m.SetBreakerState("backend", BreakerState(i))
+		w, err := NewMultiprocessWriter(dir, m)
+		check(t, err)
+		w.path = filepath.Join(dir, name+multiprocessExt) // distinct processes
+		check(t, w.Write())
+		ws = append(ws, w)
+	}
+	compare := func(states string) {
+		t.Helper()
+		r := prometheus.NewRegistry()
+		r.MustRegister(NewMultiprocessAggregator(dir))
+		if _, err := r.Gather(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := testutil.CollectAndCount(NewMultiprocessAggregator(dir), "grpc_server_latency_seconds"); n != 2 {
+			t.Fatalf("unexpected number of summaries: %d", n)
+		}
+		want := `
+# HELP grpc_server_circuit_breaker_state State of gRPC server circuit breakers (0: Closed, 1: HalfOpen, 2: Open).
+# TYPE grpc_server_circuit_breaker_state gauge
+` + states
+		if err := testutil.CollectAndCompare(NewMultiprocessAggregator(dir), strings.NewReader(want), "grpc_server_circuit_breaker_state"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compare(`grpc_server_circuit_breaker_state{grpc_breaker="backend",grpc_process="1"} 0
+grpc_server_circuit_breaker_state{grpc_breaker="backend",grpc_process="2"} 1
+`)
+	check(t, ws[1].Close())
+	compare(`grpc_server_circuit_breaker_state{grpc_breaker="backend",grpc_process="1"} 0
+`)
+}
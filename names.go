@@ -0,0 +1,13 @@
+package grpcprom
+
+// defaultNamespace is the default namespace of metric names.
+const defaultNamespace = "grpc"
+
+// subsystemName returns the subsystem of metric names with the prefix,
+// if any (e.g. "api_server").
+func subsystemName(prefix, subsys string) string {
+	if prefix == "" {
+		return subsys
+	}
+	return prefix + "_" + subsys
+}
@@ -0,0 +1,79 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// opTimerKey is the context key of the rpcInfo of the server RPC
+// whose operations are timed by StartTimer.
+type opTimerKey struct{}
+
+// An opTimer times the operations of a server RPC.
+type opTimer struct {
+	h *handler
+	v *rpcInfo
+}
+
+// StartTimer returns a timer that observes the duration of the operation
+// when its ObserveDuration method is called, labeled with the service and
+// method of the server RPC of the context, so that the phases of handlers
+// may be timed alongside the RPCs' metrics. The operation names must be
+// from a small set, because each is a distinct label value.
+//
+// It does nothing unless the ServerMetrics that handle the RPC are created
+// with the OperationDurationSeconds option enabled.
+func StartTimer(ctx context.Context, operation string) *prometheus.Timer {
+	t, ok := ctx.Value(opTimerKey{}).(*opTimer)
+	if !ok || t.v.methodInfo == nil {
+		return prometheus.NewTimer(nil)
+	}
+	lvs := make([]string, 0, len(t.v.lvs)+1)
+	return prometheus.NewTimer(t.h.opDuration.With(append(append(lvs, t.v.lvs...), operation)...))
+}
+
+// Detach returns a new context, which isn't canceled with the RPC of ctx,
+// that carries the RPC's method tagging and profiler labels, so that the
+// operations of goroutines that outlive the handler, such as background work,
+// are timed by StartTimer with the originating method.
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if t, ok := ctx.Value(opTimerKey{}).(*opTimer); ok && t.v.methodInfo != nil {
+		// Only the method is retained, not the state of the RPC.
+		detached = context.WithValue(detached, opTimerKey{}, &opTimer{t.h, &rpcInfo{methodInfo: t.v.methodInfo}})
+	}
+	var labels []string
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		labels = append(labels, key, value)
+		return true
+	})
+	if len(labels) > 0 {
+		detached = pprof.WithLabels(detached, pprof.Labels(labels...))
+	}
+	return detached
+}
+
+// withOpTimer returns a copy of the server RPC's context in which its
+// operations are timed by StartTimer, if enabled.
+func (h *handler) withOpTimer(ctx context.Context, v *rpcInfo) context.Context {
+	if _, ok := h.opDuration.(noopObserver); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, opTimerKey{}, &opTimer{h, v})
+}
+
+func newOpDuration(subsys string, ms *metricSet, prefix []string, opts histogramOptions) observer {
+	if opts.disable || subsys != "server" {
+		return noopObserver{}
+	}
+	return newHistogramObserver(
+		ms,
+		"operation_duration_seconds",
+		fmt.Sprintf("Duration of operations timed in gRPC %s handlers.", subsys),
+		labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_operation"),
+		opts,
+	)
+}
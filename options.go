@@ -1,13 +1,65 @@
 package grpcprom
 
-// DefaultLatencyBuckets are the default latency histogram buckets.
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+)
+
+// DefaultLatencyBuckets are the previous default latency histogram buckets.
+//
+// Deprecated: Use DefaultClientLatencyBuckets or DefaultServerLatencyBuckets.
 var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
+// DefaultClientLatencyBuckets are the default client latency histogram buckets.
+// They extend higher than the server buckets because client latency includes the network.
+var DefaultClientLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// DefaultServerLatencyBuckets are the default server latency histogram buckets.
+// They extend lower than the client buckets because server latency excludes the network.
+var DefaultServerLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
 // DefaultBytesBuckets are the default bytes histogram buckets.
 var DefaultBytesBuckets = []float64{0, 32, 64, 128, 256, 512, 1024, 2048, 8192, 32768, 131072, 524288}
 
+// DefaultConnectionIdleBuckets are the default connection idle histogram buckets.
+var DefaultConnectionIdleBuckets = []float64{0.01, 0.1, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// DefaultRPCSizeBuckets are the default request and response size histogram buckets.
+var DefaultRPCSizeBuckets = []float64{0, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864}
+
+// DefaultSizeRatioBuckets are the default response size ratio histogram buckets.
+var DefaultSizeRatioBuckets = []float64{0.01, 0.1, 0.5, 1, 2, 5, 10, 50, 100, 1000}
+
+// DefaultBackoffBuckets are the default reconnect backoff histogram buckets.
+var DefaultBackoffBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120}
+
+// DefaultDeadlineUtilizationBuckets are the default deadline utilization ratio histogram buckets.
+var DefaultDeadlineUtilizationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 1}
+
+// DefaultMessageBuckets are the default message count histogram buckets.
+var DefaultMessageBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// DefaultMetadataEntryBuckets are the default metadata entry count histogram buckets.
+var DefaultMetadataEntryBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128}
+
+// DefaultAttemptBuckets are the default request attempt count histogram buckets.
+var DefaultAttemptBuckets = []float64{1, 2, 3, 4, 5}
+
 type metricOptions struct {
 	disable bool
+	reset   bool
+	perCPU  bool
+	methods map[string]bool
+	maxAge  map[string]time.Duration
+	maxSize map[string]int
+	mdKeys  map[string]bool
+
+	halfLife time.Duration
 }
 
 // A MetricOption applies an option to a metric.
@@ -26,9 +78,98 @@ func Disable() MetricOption {
 	return metricOptionFunc(func(o *metricOptions) { o.disable = true })
 }
 
+// Enable returns a MetricOption that enables the metric.
+// Some metrics are disabled by default.
+func Enable() MetricOption {
+	return metricOptionFunc(func(o *metricOptions) { o.disable = false })
+}
+
+// ResetOnCollect returns a MetricOption that resets the metric
+// each time it's collected, for metrics which track maximums.
+// By default, they track the maximum since the process started.
+func ResetOnCollect() MetricOption {
+	return metricOptionFunc(func(o *metricOptions) { o.reset = true })
+}
+
+// PerCPU returns a MetricOption that shards counters by processor,
+// incrementing a random shard and summing them when collected, so that concurrent requests don't
+// contend on shared atomic values. It applies to counters and to
+// histograms without buckets, at the cost of memory for each series.
+func PerCPU() MetricOption {
+	return metricOptionFunc(func(o *metricOptions) { o.perCPU = true })
+}
+
+// Methods returns a MetricOption that selects the full method names
+// (e.g. "/pkg.Service/Method") tracked by metrics which only apply
+// to specific methods, such as last_message_age_seconds.
+func Methods(names ...string) MetricOption {
+	return metricOptionFunc(func(o *metricOptions) {
+		if o.methods == nil {
+			o.methods = make(map[string]bool)
+		}
+		for _, name := range names {
+			o.methods[name] = true
+		}
+	})
+}
+
+// MaxAge returns a MetricOption that sets the maximum age of streams
+// of the given full method names for the stale_streams_total metric.
+func MaxAge(d time.Duration, methods ...string) MetricOption {
+	return metricOptionFunc(func(o *metricOptions) {
+		if o.maxAge == nil {
+			o.maxAge = make(map[string]time.Duration)
+		}
+		for _, name := range methods {
+			o.maxAge[name] = d
+		}
+	})
+}
+
+// HalfLife returns a MetricOption that sets the half-life of metrics which
+// report exponentially-weighted moving averages, such as latency_ewma_seconds.
+func HalfLife(d time.Duration) MetricOption {
+	return metricOptionFunc(func(o *metricOptions) { o.halfLife = d })
+}
+
+// MaxSize returns a MetricOption that sets the maximum size in bytes of
+// messages of the given full method names for the oversized_messages_total
+// metric. Without method names, it sets the maximum size of other methods.
+func MaxSize(n int, methods ...string) MetricOption {
+	return metricOptionFunc(func(o *metricOptions) {
+		if o.maxSize == nil {
+			o.maxSize = make(map[string]int)
+		}
+		if len(methods) == 0 {
+			o.maxSize[""] = n
+		}
+		for _, name := range methods {
+			o.maxSize[name] = n
+		}
+	})
+}
+
+// MetadataKeys returns a MetricOption that restricts the metadata_bytes and
+// metadata_entries metrics to metadata with the given keys. By default, they
+// include all keys except those reserved by gRPC and HTTP/2.
+func MetadataKeys(keys ...string) MetricOption {
+	return metricOptionFunc(func(o *metricOptions) {
+		if o.mdKeys == nil {
+			o.mdKeys = make(map[string]bool)
+		}
+		for _, k := range keys {
+			o.mdKeys[strings.ToLower(k)] = true
+		}
+	})
+}
+
 type histogramOptions struct {
 	metricOptions
-	buckets []float64
+	buckets       []float64
+	bucketsSet    bool // buckets set explicitly
+	objectives    map[float64]float64
+	methodBuckets map[string][]float64 // full method name => buckets
+	uncompressed  bool
 }
 
 // A HistogramOption applies an option to a histogram.
@@ -40,7 +181,40 @@ func (fn histogramOptionFunc) applyHistogramOption(o *histogramOptions) { fn(o)
 
 // Buckets returns a HistogramOption that sets the histogram's buckets.
 func Buckets(v []float64) HistogramOption {
-	return histogramOptionFunc(func(o *histogramOptions) { o.buckets = v })
+	return histogramOptionFunc(func(o *histogramOptions) {
+		o.buckets = v
+		o.bucketsSet = true
+	})
+}
+
+// Summary returns a HistogramOption that observes a summary with the given
+// quantile objectives, which map quantiles to their absolute errors, instead
+// of a histogram, for consumers that can't aggregate histogram buckets. It
+// applies to the latency_seconds metric. Summaries can't be aggregated across
+// instances and are more expensive to observe.
+func Summary(objectives map[float64]float64) HistogramOption {
+	return histogramOptionFunc(func(o *histogramOptions) { o.objectives = objectives })
+}
+
+// Uncompressed returns a HistogramOption that observes the uncompressed length
+// of messages instead of their wire length. It applies to the recv_bytes and
+// sent_bytes metrics, in which it only affects payload frames.
+func Uncompressed() HistogramOption {
+	return histogramOptionFunc(func(o *histogramOptions) { o.uncompressed = true })
+}
+
+// BucketsFor returns a HistogramOption that sets the histogram's buckets
+// for the full method name (e.g. "/pkg.Service/Method"), overriding its
+// default buckets, unless it has none. It applies to the latency_seconds
+// metric.
+func BucketsFor(method string, v []float64) HistogramOption {
+	return histogramOptionFunc(func(o *histogramOptions) {
+		if o.methodBuckets == nil {
+			o.methodBuckets = make(map[string][]float64)
+		}
+		o.methodBuckets[method] = v
+		o.bucketsSet = true
+	})
 }
 
 // NoBuckets returns a HistogramOption that disables the histogram's buckets.
@@ -50,13 +224,95 @@ func NoBuckets() HistogramOption {
 }
 
 type options struct {
-	connsOpen   metricOptions
-	connsTotal  metricOptions
-	reqsPending metricOptions
-	reqsTotal   metricOptions
-	latency     histogramOptions
-	recvBytes   histogramOptions
-	sentBytes   histogramOptions
+	serverLabel   bool
+	connLabel     bool
+	deadlineLabel bool
+	codeClass     bool
+	codeMapper    CodeMapperFunc
+	peerLabel     bool
+	maxPeers      int
+	extraLabels   []string
+	extractLabels ExtraLabelsFunc
+	infra         infraMode
+	fallback      [2]string
+	namespace     string
+	registerer    prometheus.Registerer
+	logger        Logger
+	hooks         observerHooks
+	subsysPrefix  string
+	methodParser  MethodParserFunc
+	skip          SkipFunc
+	filter        func(fullMethod string) bool
+	methodLabels  []string
+	errorsOnly    bool
+	pprofLabels   bool
+	traceTasks    bool
+	topK          int
+	topKey        KeyFunc
+	locality      LocalityFunc
+	caller        CallerFunc
+	anomalyRule   AnomalyRule
+	anomalyFn     func(Anomaly)
+	accessLog     func(context.Context, accessRecord)
+	maxCallers    int
+
+	keepaliveParams keepalive.ServerParameters
+
+	connsOpen      metricOptions
+	connsTotal     metricOptions
+	connsIdle      metricOptions
+	connsIdleTime  histogramOptions
+	reqsPending    metricOptions
+	reqsPendingMax metricOptions
+	reqsTotal      metricOptions
+	reqsRejected   metricOptions
+	reqsCanceled   metricOptions
+	canceledBy     metricOptions
+	authFailures   metricOptions
+	attempts       metricOptions
+	deprecated     metricOptions
+	trailersOnly   metricOptions
+	latency        histogramOptions
+	latencyMax     metricOptions
+	latencyEWMA    metricOptions
+	timeout        histogramOptions
+	noDeadline     metricOptions
+	pickDelay      histogramOptions
+	opDuration     histogramOptions
+	lastError      metricOptions
+	recvBytes      histogramOptions
+	sentBytes      histogramOptions
+	reqMsgs        histogramOptions
+	reqAttempts    histogramOptions
+	retryAttempts  metricOptions
+	transparent    metricOptions
+	upload         histogramOptions
+	msgsTotal      metricOptions
+	reqSize        histogramOptions
+	mdBytes        histogramOptions
+	mdEntries      histogramOptions
+	respSize       histogramOptions
+	sizeRatio      histogramOptions
+	deadlineUtil   histogramOptions
+	msgAge         metricOptions
+	stale          metricOptions
+	oversized      metricOptions
+	breakerState   metricOptions
+	healthStatus   metricOptions
+	connFailures   metricOptions
+	connAttempts   metricOptions
+	backoffs       histogramOptions
+	tcpInfo        metricOptions
+	keepalive      metricOptions
+	rst            metricOptions
+	goAway         metricOptions
+	cpuTime        metricOptions
+	handlers       metricOptions
+	streamsOpen    metricOptions
+	streamMsgsOpen metricOptions
+	derived        []DerivedMetric
+	overhead       histogramOptions
+	compat         histogramOptions
 }
 
 // An Option applies an option.
@@ -68,6 +324,226 @@ type optionFunc func(*options)
 
 func (fn optionFunc) applyOption(o *options) { fn(o) }
 
+// Namespace returns an Option that replaces the "grpc" namespace of metric
+// names, such as to follow a naming policy that requires a product prefix
+// (e.g. Namespace("acme") exports grpc_server_requests_total as
+// acme_server_requests_total). An empty namespace is omitted.
+func Namespace(namespace string) Option {
+	return optionFunc(func(o *options) { o.namespace = namespace })
+}
+
+// WithRegisterer returns an Option that registers the metrics with r when
+// they're created, which panics if they can't be registered, like the
+// Register method of the metrics. By default, they aren't registered.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return optionFunc(func(o *options) { o.registerer = r })
+}
+
+// ObserverHooks returns an Option that calls the hooks with the measurements
+// recorded by the metrics, such as to mirror them into another system.
+func ObserverHooks(hooks ...ObserverHook) Option {
+	return optionFunc(func(o *options) { o.hooks = append(o.hooks, hooks...) })
+}
+
+// WithLogger returns an Option that logs warnings with l, such as when the
+// caller or peer label limits are exceeded. By default, warnings are discarded.
+func WithLogger(l Logger) Option {
+	return optionFunc(func(o *options) {
+		if l == nil {
+			l = noopLogger{}
+		}
+		o.logger = l
+	})
+}
+
+// SubsystemPrefix returns an Option that adds a prefix to the "client" or
+// "server" subsystem of metric names (e.g. SubsystemPrefix("api") exports
+// grpc_server_requests_total as grpc_api_server_requests_total).
+func SubsystemPrefix(prefix string) Option {
+	return optionFunc(func(o *options) { o.subsysPrefix = prefix })
+}
+
+// ServerLabel returns an Option that adds a grpc_server label to request metrics,
+// so that ServerMetrics shared between multiple servers keeps their data separate.
+// Each server is named by its NamedStatsHandler or, by default, its listener address.
+func ServerLabel() Option {
+	return optionFunc(func(o *options) { o.serverLabel = true })
+}
+
+// ConnLabel returns an Option that adds a grpc_conn label to client request metrics,
+// so that ClientConns to the same target with different purposes keep their data
+// separate. Each ClientConn is named by its NamedDialOption, or else it's unnamed.
+func ConnLabel() Option {
+	return optionFunc(func(o *options) { o.connLabel = true })
+}
+
+// DeadlineClassLabel returns an Option that adds a grpc_deadline label to the
+// requests_total metric, which classifies the deadline of each request as
+// "<100ms", "<1s", "<10s", ">=10s", or "none", so that success rates may be
+// analyzed by how much time callers allowed.
+func DeadlineClassLabel() Option {
+	return optionFunc(func(o *options) { o.deadlineLabel = true })
+}
+
+// CodeClassLabel returns an Option that replaces the grpc_code label of the
+// requests_total and latency_seconds metrics with a grpc_code_class label,
+// whose value is "ok", "canceled", "client_error", or "server_error", so that
+// their cardinality is reduced. Derived metrics see the requests of each class
+// as those of OK, Canceled, InvalidArgument, and Internal codes, respectively.
+func CodeClassLabel() Option {
+	return optionFunc(func(o *options) { o.codeClass = true })
+}
+
+// CodeMapper returns an Option that labels the requests_total and latency_seconds
+// metrics with the code label value returned by fn for the error of each RPC,
+// such as to distinguish wrapped application errors, instead of the value of
+// its status code. If fn returns an empty string, the status code is used.
+// Derived metrics don't see requests with custom code label values.
+func CodeMapper(fn CodeMapperFunc) Option {
+	return optionFunc(func(o *options) { o.codeMapper = fn })
+}
+
+// PeerLabel returns an Option that adds a grpc_peer label to the server
+// requests_total and latency_seconds metrics with the IP address of the client,
+// so that load may be attributed to clients. To bound the cardinality of the
+// label, only the first max peers seen are named and the others are labeled
+// "Other". Metrics are initialized with an empty peer.
+func PeerLabel(max int) Option {
+	return optionFunc(func(o *options) {
+		o.peerLabel = true
+		o.maxPeers = max
+	})
+}
+
+// ExtraLabels returns an Option that adds the named labels to the requests_total
+// and latency_seconds metrics with the values returned by extract for each RPC,
+// such as a tenant from incoming metadata. If extract doesn't return a value
+// for each label, the values are empty. Their cardinality must be bounded by
+// extract. Metrics are initialized with empty values.
+func ExtraLabels(names []string, extract ExtraLabelsFunc) Option {
+	return optionFunc(func(o *options) {
+		o.extraLabels = names
+		o.extractLabels = extract
+	})
+}
+
+// Caller returns an Option that adds a grpc_caller label to server request
+// metrics with the name of the calling service returned by fn, such as
+// CallerFromMetadata or CallerFromTLS. To bound the cardinality of the label,
+// only the first max callers seen are named and the others are labeled "Other".
+// Callers without names are labeled "Unknown". Metrics are initialized with
+// an empty caller.
+func Caller(fn CallerFunc, max int) Option {
+	return optionFunc(func(o *options) {
+		o.caller = fn
+		o.maxCallers = max
+	})
+}
+
+// AnomalyHook returns an Option that calls fn with each completed RPC which
+// matches the rule, such as to log it, at the rate limited by the rule.
+// It's called synchronously and must not block.
+func AnomalyHook(rule AnomalyRule, fn func(Anomaly)) Option {
+	return optionFunc(func(o *options) {
+		o.anomalyRule = rule
+		o.anomalyFn = fn
+	})
+}
+
+// ErrorsOnly returns an Option that records the latency and bytes metrics
+// only for failed requests, while the counters are recorded for all requests.
+// The sizes of at most 64 frames are recorded for each failed request.
+func ErrorsOnly() Option {
+	return optionFunc(func(o *options) { o.errorsOnly = true })
+}
+
+// PprofLabels returns an Option that labels the goroutines handling server
+// requests with the grpc_service and grpc_method of the request, so that
+// CPU profiles can be sliced by method. It requires the server interceptors.
+func PprofLabels() Option {
+	return optionFunc(func(o *options) { o.pprofLabels = true })
+}
+
+// TraceTasks returns an Option that creates a runtime/trace task for each
+// request, named by its full method, while an execution trace is running.
+// It requires the interceptors.
+func TraceTasks() Option {
+	return optionFunc(func(o *options) { o.traceTasks = true })
+}
+
+// ExcludeInfraServices returns an Option that excludes the methods of
+// infrastructure services, such as grpc.reflection.*, grpc.health.*, and
+// grpc.channelz.*, from the request metrics. See AggregateInfraServices.
+func ExcludeInfraServices() Option {
+	return optionFunc(func(o *options) { o.infra = excludeInfra })
+}
+
+// AggregateInfraServices returns an Option that records the methods of
+// infrastructure services, such as grpc.reflection.*, grpc.health.*, and
+// grpc.channelz.*, together with the service and method labels "Infra".
+// See ExcludeInfraServices.
+func AggregateInfraServices() Option {
+	return optionFunc(func(o *options) { o.infra = aggregateInfra })
+}
+
+// FallbackMethodLabels returns an Option that sets the service and method
+// labels of requests whose full method names can't be parsed, such as those
+// with more or fewer than two segments. The default labels are "Unknown".
+func FallbackMethodLabels(service, method string) Option {
+	return optionFunc(func(o *options) { o.fallback = [2]string{service, method} })
+}
+
+// A MethodParserFunc returns the service and method labels of a full method name
+// and the values of additional labels, or empty labels if it can't be parsed.
+type MethodParserFunc func(fullMethod string) (service, method string, lvs []string)
+
+// MethodParser returns an Option that parses full method names with fn instead
+// of expecting exactly two segments, so that non-standard paths like
+// "/tenant/pkg.Service/Method" have meaningful labels. The values fn returns
+// for the given label names are added to request metrics. Methods which fn
+// can't parse have the fallback labels and empty values. See FallbackMethodLabels.
+func MethodParser(fn MethodParserFunc, labels ...string) Option {
+	return optionFunc(func(o *options) {
+		o.methodParser = fn
+		o.methodLabels = labels
+	})
+}
+
+// SkipRPCs returns an Option that doesn't record RPCs for which fn returns true,
+// such as synthetic health probes or load tests marked by SkipMetadata, so that
+// they don't need to be filtered from the metrics. It's called once for each RPC
+// when it's tagged.
+func SkipRPCs(fn SkipFunc) Option {
+	return optionFunc(func(o *options) { o.skip = fn })
+}
+
+// FilterMethods returns an Option that only records the methods for which
+// keep returns true, given the full method name (e.g. "/pkg.Service/Method"),
+// so that methods such as health checks or very hot internal RPCs can be
+// excluded entirely. Excluded methods aren't initialized by Init either.
+// It may be combined with SkipRPCs.
+func FilterMethods(keep func(fullMethod string) bool) Option {
+	return optionFunc(func(o *options) { o.filter = keep })
+}
+
+// TopK returns an Option that tracks the top k keys of requests by count
+// and by bytes in the top_requests and top_bytes metrics, without a series
+// for every key. The counts are estimates within bounded space.
+func TopK(k int, key KeyFunc) Option {
+	return optionFunc(func(o *options) {
+		o.topK = k
+		o.topKey = key
+	})
+}
+
+// Locality returns an Option that tracks client requests and latency by
+// the locality of the backend to which they're sent, as returned by fn,
+// in the locality_requests_total and locality_latency_seconds metrics.
+// The latency uses the buckets of the latency_seconds metric.
+func Locality(fn LocalityFunc) Option {
+	return optionFunc(func(o *options) { o.locality = fn })
+}
+
 // ConnectionsOpen returns an Option that applies the given MetricOptions
 // to the connections_open metric.
 func ConnectionsOpen(opts ...MetricOption) Option {
@@ -88,6 +564,26 @@ func ConnectionsTotal(opts ...MetricOption) Option {
 	})
 }
 
+// ConnectionsIdle returns an Option that applies the given MetricOptions
+// to the connections_idle metric.
+func ConnectionsIdle(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.connsIdle)
+		}
+	})
+}
+
+// ConnectionIdleSeconds returns an Option that applies the given HistogramOptions
+// to the connection_idle_seconds metric.
+func ConnectionIdleSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.connsIdleTime)
+		}
+	})
+}
+
 // RequestsPending returns an Option that applies the given MetricOptions
 // to the requests_pending metric.
 func RequestsPending(opts ...MetricOption) Option {
@@ -98,6 +594,17 @@ func RequestsPending(opts ...MetricOption) Option {
 	})
 }
 
+// RequestsPendingMax returns an Option that applies the given MetricOptions
+// to the requests_pending_max metric. The metric is disabled by default.
+// It's always reset when collected.
+func RequestsPendingMax(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.reqsPendingMax)
+		}
+	})
+}
+
 // RequestsTotal returns an Option that applies the given MetricOptions
 // to the requests_total metric.
 func RequestsTotal(opts ...MetricOption) Option {
@@ -108,8 +615,97 @@ func RequestsTotal(opts ...MetricOption) Option {
 	})
 }
 
+// RequestsRejectedTotal returns an Option that applies the given MetricOptions
+// to the requests_rejected_total metric.
+func RequestsRejectedTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.reqsRejected)
+		}
+	})
+}
+
+// RequestsClientCanceledTotal returns an Option that applies the given MetricOptions
+// to the requests_client_canceled_total metric, which counts server requests
+// canceled by their clients, as opposed to handlers returning Canceled.
+// It requires the server interceptors.
+func RequestsClientCanceledTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.reqsCanceled)
+		}
+	})
+}
+
+// RequestsCanceledTotal returns an Option that applies the given MetricOptions
+// to the requests_canceled_total metric, which counts requests completed with
+// the Canceled code by grpc_cause: "client" if canceled by the client's caller
+// or the server's peer, "deadline" if its deadline was exceeded, "shutdown" if
+// the client connection was closing, or "server" if the server or its handler
+// returned Canceled otherwise. The metric is disabled by default.
+func RequestsCanceledTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.canceledBy)
+		}
+	})
+}
+
+// AuthFailuresTotal returns an Option that applies the given MetricOptions
+// to the server auth_failures_total metric, which counts requests completed
+// with Unauthenticated or PermissionDenied by the auth scheme they presented:
+// "bearer" or "basic" authorization metadata, "other" authorization metadata,
+// "mtls" verified client certificates, or "none".
+func AuthFailuresTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.authFailures)
+		}
+	})
+}
+
+// AttemptsTotal returns an Option that applies the given MetricOptions
+// to the client attempts_total metric, which counts each attempt of requests,
+// including those retried. With the client interceptors, the other request
+// metrics record each request once, when its last attempt ends, so that
+// retries aren't counted as requests. Without them, each attempt is recorded
+// as a request.
+func AttemptsTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.attempts)
+		}
+	})
+}
+
+// DeprecatedRequestsTotal returns an Option that applies the given MetricOptions
+// to the deprecated_requests_total metric, which counts the requests of methods
+// marked deprecated, or whose services are marked deprecated, in the proto
+// descriptors registered with protoregistry.GlobalFiles. Methods are looked up
+// when they're initialized or first seen with a known type.
+func DeprecatedRequestsTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.deprecated)
+		}
+	})
+}
+
+// RequestsTrailersOnlyTotal returns an Option that applies the given MetricOptions
+// to the requests_trailers_only_total metric, which counts requests completed
+// with a trailers-only response, without headers or messages, as is typical of
+// requests rejected immediately.
+func RequestsTrailersOnlyTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.trailersOnly)
+		}
+	})
+}
+
 // LatencySeconds returns an Option that applies the given HistogramOption
-// to the latency_seconds metric.
+// to the latency_seconds metric, which may be observed as a summary with
+// the Summary option.
 func LatencySeconds(opts ...HistogramOption) Option {
 	return optionFunc(func(o *options) {
 		for _, opt := range opts {
@@ -118,8 +714,95 @@ func LatencySeconds(opts ...HistogramOption) Option {
 	})
 }
 
+// LatencyMaxSeconds returns an Option that applies the given MetricOptions
+// to the latency_max_seconds metric. The metric is disabled by default.
+func LatencyMaxSeconds(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.latencyMax)
+		}
+	})
+}
+
+// LatencyEWMASeconds returns an Option that applies the given MetricOptions
+// to the latency_ewma_seconds metric, which reports exponentially-weighted
+// moving averages of latencies, for feedback to load balancers. The averages
+// may also be read with the LatencyEWMA methods. The metric is disabled by
+// default. Its default half-life is DefaultHalfLife.
+func LatencyEWMASeconds(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.latencyEWMA)
+		}
+	})
+}
+
+// TimeoutSeconds returns an Option that applies the given HistogramOptions
+// to the timeout_seconds metric, which observes the time remaining until the
+// deadline of each request when it begins, so that timeouts may be compared
+// with latencies. On the server, it's the budget propagated by the client.
+// Requests without deadlines aren't observed, but are counted by
+// RequestsWithoutDeadlineTotal. The metric is disabled by default. Its
+// default buckets are the default client latency buckets.
+func TimeoutSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.timeout)
+		}
+	})
+}
+
+// RequestsWithoutDeadlineTotal returns an Option that applies the given
+// MetricOptions to the requests_without_deadline_total metric, which counts
+// requests which begin without deadlines, such as to enforce deadline
+// propagation by server clients. The metric is disabled by default.
+func RequestsWithoutDeadlineTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.noDeadline)
+		}
+	})
+}
+
+// PickDelaySeconds returns an Option that applies the given HistogramOptions
+// to the client pick_delay_seconds metric, which observes the time from the
+// beginning of each request attempt until its headers are sent, which is
+// mostly spent waiting for the balancer to pick a subchannel, so that pick
+// delays may be distinguished from server latency. The metric is disabled
+// by default. Its default buckets are the default server latency buckets.
+func PickDelaySeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.pickDelay)
+		}
+	})
+}
+
+// OperationDurationSeconds returns an Option that applies the given HistogramOptions
+// to the server operation_duration_seconds metric, which observes the durations
+// of operations timed in handlers by StartTimer. The metric is disabled by default.
+// Its default buckets are the default server latency buckets.
+func OperationDurationSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.opDuration)
+		}
+	})
+}
+
+// LastErrorTimestampSeconds returns an Option that applies the given MetricOptions
+// to the last_error_timestamp_seconds metric. The metric is disabled by default.
+func LastErrorTimestampSeconds(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.lastError)
+		}
+	})
+}
+
 // RecvBytes returns an Option that applies the given HistogramOption
-// to the recv_bytes metric.
+// to the recv_bytes metric. Payloads are observed by their wire length,
+// unless Uncompressed is given.
 func RecvBytes(opts ...HistogramOption) Option {
 	return optionFunc(func(o *options) {
 		for _, opt := range opts {
@@ -129,7 +812,8 @@ func RecvBytes(opts ...HistogramOption) Option {
 }
 
 // SentBytes returns an Option that applies the given HistogramOption
-// to the sent_bytes metric.
+// to the sent_bytes metric. Payloads are observed by their wire length,
+// unless Uncompressed is given.
 func SentBytes(opts ...HistogramOption) Option {
 	return optionFunc(func(o *options) {
 		for _, opt := range opts {
@@ -137,3 +821,445 @@ func SentBytes(opts ...HistogramOption) Option {
 		}
 	})
 }
+
+// RetryAttemptsTotal returns an Option that applies the given MetricOptions
+// to the client retry_attempts_total metric, which counts the attempts of
+// requests after their first, so that retries hidden by successful requests
+// are visible. Transparent retries are counted by transparent_retries_total
+// instead. It requires the client interceptors. The metric is disabled by
+// default.
+func RetryAttemptsTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.retryAttempts)
+		}
+	})
+}
+
+// TransparentRetriesTotal returns an Option that applies the given MetricOptions
+// to the client transparent_retries_total metric, which counts the attempts
+// of requests retried transparently by gRPC, such as when a stream is refused
+// by the server before it's processed. The metric is disabled by default.
+func TransparentRetriesTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.transparent)
+		}
+	})
+}
+
+// RequestAttempts returns an Option that applies the given HistogramOptions
+// to the client request_attempts metric, which observes the number of
+// attempts of each request when it completes. It requires the client
+// interceptors. The metric is disabled by default. Its default buckets
+// are DefaultAttemptBuckets.
+func RequestAttempts(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.reqAttempts)
+		}
+	})
+}
+
+// RequestMessages returns an Option that applies the given HistogramOptions
+// to the request_messages metric, which is observed for client-streaming requests.
+func RequestMessages(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.reqMsgs)
+		}
+	})
+}
+
+// UploadSeconds returns an Option that applies the given HistogramOptions
+// to the upload_seconds metric, which observes the duration from the first
+// to the last message of client-streaming requests, so that slow uploads
+// are distinguishable from slow processing. The metric is disabled by default.
+// Its default buckets are the default latency buckets.
+func UploadSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.upload)
+		}
+	})
+}
+
+// MessagesTotal returns an Option that applies the given MetricOptions
+// to the messages_total metric, which counts messages by direction and by
+// whether they're compressed, so that compression misconfiguration is visible.
+// The metric is disabled by default.
+func MessagesTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.msgsTotal)
+		}
+	})
+}
+
+// RequestSizeBytes returns an Option that applies the given HistogramOptions
+// to the request_size_bytes metric, which observes the total wire bytes of
+// each request, summed across all of its frames. The metric is disabled by
+// default. Its default buckets are DefaultRPCSizeBuckets.
+func RequestSizeBytes(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.reqSize)
+		}
+	})
+}
+
+// ResponseSizeBytes returns an Option that applies the given HistogramOptions
+// to the response_size_bytes metric, which observes the total wire bytes of
+// each response, summed across all of its frames. The metric is disabled by
+// default. Its default buckets are DefaultRPCSizeBuckets.
+func ResponseSizeBytes(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.respSize)
+		}
+	})
+}
+
+// MetadataBytes returns an Option that applies the given HistogramOptions
+// to the metadata_bytes metric, which observes the estimated size of the
+// application metadata in each header and trailer by grpc_direction and
+// grpc_frame, separately from their wire bytes. The metric is disabled by
+// default. Its default buckets are DefaultBytesBuckets.
+func MetadataBytes(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.mdBytes)
+		}
+	})
+}
+
+// MetadataEntries returns an Option that applies the given HistogramOptions
+// to the metadata_entries metric, which observes the number of application
+// metadata entries in each header and trailer by grpc_direction and grpc_frame.
+// The metric is disabled by default. Its default buckets are
+// DefaultMetadataEntryBuckets.
+func MetadataEntries(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.mdEntries)
+		}
+	})
+}
+
+// DeadlineUtilizationRatio returns an Option that applies the given HistogramOptions
+// to the deadline_utilization_ratio metric, which observes the ratio of the
+// latency of each request with a deadline to the time allotted by its deadline
+// when it began, so that requests running close to their budgets may be found
+// even though deadlines vary by caller. Requests which exceed their deadlines
+// may be observed above 1. The metric is disabled by default. Its default
+// buckets are DefaultDeadlineUtilizationBuckets.
+func DeadlineUtilizationRatio(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.deadlineUtil)
+		}
+	})
+}
+
+// ResponseSizeRatio returns an Option that applies the given HistogramOptions
+// to the response_size_ratio metric, which observes the ratio of response bytes
+// to request bytes of unary requests, so that methods with surprising amplification
+// may be found. Requests without request bytes aren't observed. The metric is
+// disabled by default. Its default buckets are DefaultSizeRatioBuckets.
+func ResponseSizeRatio(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.sizeRatio)
+		}
+	})
+}
+
+// LastMessageAgeSeconds returns an Option that applies the given MetricOptions
+// to the last_message_age_seconds metric. The metric is disabled unless
+// long-lived streaming methods are selected with the Methods option.
+func LastMessageAgeSeconds(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.msgAge)
+		}
+	})
+}
+
+// StaleStreamsTotal returns an Option that applies the given MetricOptions
+// to the stale_streams_total metric. The metric is disabled unless
+// maximum stream ages are set with the MaxAge option.
+func StaleStreamsTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.stale)
+		}
+	})
+}
+
+// OversizedMessagesTotal returns an Option that applies the given MetricOptions
+// to the oversized_messages_total metric. The metric is disabled unless
+// maximum message sizes are set with the MaxSize option.
+func OversizedMessagesTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.oversized)
+		}
+	})
+}
+
+// CircuitBreakerState returns an Option that applies the given MetricOptions
+// to the circuit_breaker_state metric.
+func CircuitBreakerState(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.breakerState)
+		}
+	})
+}
+
+// HealthStatus returns an Option that applies the given MetricOptions
+// to the client health_status metric, which is reported by WatchHealth.
+func HealthStatus(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.healthStatus)
+		}
+	})
+}
+
+// ConnectionFailuresTotal returns an Option that applies the given MetricOptions
+// to the client connection_failures_total metric, which counts connections that
+// failed to be established by target address and reason: "refused", "timeout",
+// "dns", "tls", or "other". Dial failures are counted by the Dialer and handshake
+// failures are counted by the TransportCredentials.
+func ConnectionFailuresTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.connFailures)
+		}
+	})
+}
+
+// ConnectionAttemptsTotal returns an Option that applies the given MetricOptions
+// to the client connection_attempts_total metric, which counts connections
+// dialed by target address, so that connection_failures_total may be compared
+// with them. It requires the Dialer. The metric is disabled by default.
+func ConnectionAttemptsTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.connAttempts)
+		}
+	})
+}
+
+// ReconnectBackoffSeconds returns an Option that applies the given HistogramOptions
+// to the client reconnect_backoff_seconds metric, which observes the time between
+// failed connection attempts to each target address and their next attempts.
+// It requires the Dialer. Handshake failures require the TransportCredentials.
+func ReconnectBackoffSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.backoffs)
+		}
+	})
+}
+
+// HandlersRunning returns an Option that applies the given MetricOptions
+// to the server handlers_running metric, which reports the number of handlers
+// running, as opposed to streams open, so that handlers which don't return are
+// distinguishable from long streams. It requires the server interceptors.
+// The metric is disabled by default.
+func HandlersRunning(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.handlers)
+		}
+	})
+}
+
+// StreamsOpen returns an Option that applies the given MetricOptions
+// to the streams_open metric, which reports the number of streams open
+// of streaming methods, as opposed to requests_pending, which includes
+// unary requests. The metric is disabled by default.
+func StreamsOpen(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.streamsOpen)
+		}
+	})
+}
+
+// StreamMessagesOpen returns an Option that applies the given MetricOptions
+// to the stream_messages_open metric, which reports the number of messages
+// sent and received by the streams open of streaming methods, so that the
+// messages in flight may be compared with the streams open. The metric is
+// disabled by default.
+func StreamMessagesOpen(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.streamMsgsOpen)
+		}
+	})
+}
+
+// HTTP2RSTStreamTotal returns an Option that applies the given MetricOptions
+// to the http2_rst_stream_total metric, which counts HTTP/2 RST_STREAM frames
+// read from and written to connections by their error codes. It requires the
+// server Listener or the client Dialer, and connections without TLS credentials
+// from gRPC, because the frames are inspected on the connections. Connections
+// which don't start with plaintext HTTP/2 aren't counted. The metric is disabled
+// by default.
+func HTTP2RSTStreamTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.rst)
+		}
+	})
+}
+
+// GoAwayTotal returns an Option that applies the given MetricOptions to the
+// client goaway_received_total and server goaway_sent_total metrics, which
+// count connections by the error code of the first HTTP/2 GOAWAY frame read
+// by clients or written by servers, such as when servers are restarted or
+// connections reach their maximum age, so that errors may be correlated with
+// them. It requires the server Listener or the client Dialer, and connections
+// without TLS credentials from gRPC, because the frames are inspected on the
+// connections. Connections which don't start with plaintext HTTP/2 aren't
+// counted. The metric is disabled by default.
+func GoAwayTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.goAway)
+		}
+	})
+}
+
+// Derived returns an Option that adds metrics derived from the statistics of each
+// method when they're collected, such as error ratios, so that they don't need to
+// be computed by another collector re-reading the registry.
+func Derived(metrics ...DerivedMetric) Option {
+	return optionFunc(func(o *options) { o.derived = append(o.derived, metrics...) })
+}
+
+// StatsHandlerOverheadSeconds returns an Option that applies the given HistogramOptions
+// to the stats_handler_overhead_seconds metric, which observes the time spent handling
+// each stats event by type, so that the overhead of the metrics may be quantified.
+// The metric is disabled by default. Its default buckets are DefaultOverheadBuckets.
+func StatsHandlerOverheadSeconds(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.overhead)
+		}
+	})
+}
+
+// GoGRPCPrometheusMetrics returns an Option that also exports the metrics of
+// grpc-ecosystem/go-grpc-prometheus with their names and labels (e.g.
+// grpc_server_started_total, grpc_server_handled_total, and
+// grpc_server_handling_seconds), so that dashboards and alerts may be
+// migrated gradually. The given HistogramOptions apply to the handling_seconds
+// metric, whose default buckets are prometheus.DefBuckets. Method types are
+// only known at the start of RPCs if the interceptors are used.
+func GoGRPCPrometheusMetrics(opts ...HistogramOption) Option {
+	return optionFunc(func(o *options) {
+		o.compat.disable = false
+		for _, opt := range opts {
+			opt.applyHistogramOption(&o.compat)
+		}
+	})
+}
+
+// HandlerCPUSeconds returns an Option that applies the given MetricOptions
+// to the experimental handler_cpu_seconds_total metric. The metric is disabled
+// by default and only supported for servers on Linux. It measures the CPU time
+// of handler goroutines, excluding other goroutines they start, by locking them
+// to their threads. It requires the server interceptors.
+func HandlerCPUSeconds(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.cpuTime)
+		}
+	})
+}
+
+// TCPInfo returns an Option that applies the given MetricOptions to the
+// tcp_rtt_seconds and tcp_retransmits metrics, which are only reported
+// on Linux for connections from an instrumented Listener or Dialer.
+// Their grpc_peer label is bounded by the limit given to PeerLabel,
+// or 100 peers by default, and the others are labeled "Other".
+func TCPInfo(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.tcpInfo)
+		}
+	})
+}
+
+// KeepaliveParams returns an Option that gives the keepalive parameters of the
+// server, so that connections_keepalive_closed_total attributes connections
+// closed gracefully to their maximum age or idle time.
+func KeepaliveParams(params keepalive.ServerParameters) Option {
+	return optionFunc(func(o *options) { o.keepaliveParams = params })
+}
+
+// ConnectionsKeepaliveClosedTotal returns an Option that applies the given
+// MetricOptions to the server connections_keepalive_closed_total metric,
+// which is reported by reason for connections from an instrumented Listener.
+// Its frames are inspected as they're written to the connections, so only
+// plaintext HTTP/2 connections are counted. Nothing is counted if they're
+// encrypted by gRPC's transport credentials. Instead, the Listener may wrap
+// a TLS listener. Inspecting the frames hides the *net.TCPConn from gRPC,
+// so the metric is disabled by default. See KeepaliveParams.
+func ConnectionsKeepaliveClosedTotal(opts ...MetricOption) Option {
+	return optionFunc(func(o *options) {
+		for _, opt := range opts {
+			opt.applyMetricOption(&o.keepalive)
+		}
+	})
+}
+
+type initOptions struct {
+	codes        []codes.Code
+	latencyCodes []codes.Code
+	latencySet   bool
+}
+
+func newInitOptions(opts []InitOption) initOptions {
+	var o initOptions
+	for _, opt := range opts {
+		opt.applyInitOption(&o)
+	}
+	return o
+}
+
+// latency returns the codes with which the latency metrics are initialized.
+func (o *initOptions) latency() []codes.Code {
+	if o.latencySet {
+		return o.latencyCodes
+	}
+	return o.codes
+}
+
+// An InitOption applies an option to the initialization of metrics.
+type InitOption interface{ applyInitOption(*initOptions) }
+
+type initOptionFunc func(*initOptions)
+
+func (fn initOptionFunc) applyInitOption(o *initOptions) { fn(o) }
+
+// WithCodes returns an InitOption that initializes the metrics
+// with the given codes.
+func WithCodes(codes ...codes.Code) InitOption {
+	return initOptionFunc(func(o *initOptions) { o.codes = codes })
+}
+
+// WithLatencyCodes returns an InitOption that initializes the latency
+// metrics with the given codes, instead of those given by WithCodes.
+// Histograms are the dominant cost of initialization, so they may be
+// initialized with fewer codes, such as only OK.
+func WithLatencyCodes(codes ...codes.Code) InitOption {
+	return initOptionFunc(func(o *initOptions) {
+		o.latencyCodes = codes
+		o.latencySet = true
+	})
+}
@@ -0,0 +1,118 @@
+package grpcprom
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/stats"
+)
+
+// DefaultOverheadBuckets are the default stats handler overhead histogram buckets.
+var DefaultOverheadBuckets = []float64{1e-7, 2.5e-7, 5e-7, 1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 1e-3}
+
+// Events handled by the stats handler.
+const (
+	eventBegin = iota
+	eventEnd
+	eventInHeader
+	eventInPayload
+	eventInTrailer
+	eventOutHeader
+	eventOutPayload
+	eventOutTrailer
+	eventConnBegin
+	eventConnEnd
+	eventOther
+)
+
+var eventNames = [...]string{
+	eventBegin:      "begin",
+	eventEnd:        "end",
+	eventInHeader:   "in_header",
+	eventInPayload:  "in_payload",
+	eventInTrailer:  "in_trailer",
+	eventOutHeader:  "out_header",
+	eventOutPayload: "out_payload",
+	eventOutTrailer: "out_trailer",
+	eventConnBegin:  "conn_begin",
+	eventConnEnd:    "conn_end",
+	eventOther:      "other",
+}
+
+// overheadTimer observes the time spent handling stats events by type.
+// A nil overheadTimer observes nothing.
+type overheadTimer struct {
+	vec    observer
+	events [len(eventNames)]prometheus.Observer
+}
+
+func newOverhead(subsys string, ms *metricSet, opts histogramOptions) *overheadTimer {
+	if opts.disable {
+		return nil
+	}
+	t := &overheadTimer{
+		vec: newHistogramObserver(
+			ms,
+			"stats_handler_overhead_seconds",
+			fmt.Sprintf("Time spent handling gRPC %s stats events by the metrics.", subsys),
+			[]string{"grpc_event"},
+			opts,
+		),
+	}
+	for i, name := range eventNames {
+		t.events[i] = t.vec.With(name)
+	}
+	return t
+}
+
+// observe observes the time since start handling the event.
+func (t *overheadTimer) observe(event int, start time.Time) {
+	t.events[event].Observe(time.Since(start).Seconds())
+}
+
+// rpcEvent returns the event of the RPC stats.
+func rpcEvent(stat stats.RPCStats) int {
+	switch stat.(type) {
+	case *stats.Begin:
+		return eventBegin
+	case *stats.End:
+		return eventEnd
+	case *stats.InHeader:
+		return eventInHeader
+	case *stats.InPayload:
+		return eventInPayload
+	case *stats.InTrailer:
+		return eventInTrailer
+	case *stats.OutHeader:
+		return eventOutHeader
+	case *stats.OutPayload:
+		return eventOutPayload
+	case *stats.OutTrailer:
+		return eventOutTrailer
+	}
+	return eventOther
+}
+
+// connEvent returns the event of the connection stats.
+func connEvent(stat stats.ConnStats) int {
+	switch stat.(type) {
+	case *stats.ConnBegin:
+		return eventConnBegin
+	case *stats.ConnEnd:
+		return eventConnEnd
+	}
+	return eventOther
+}
+
+func (t *overheadTimer) Describe(ch chan<- *prometheus.Desc) {
+	if t != nil {
+		t.vec.Describe(ch)
+	}
+}
+
+func (t *overheadTimer) Collect(ch chan<- prometheus.Metric) {
+	if t != nil {
+		t.vec.Collect(ch)
+	}
+}
@@ -0,0 +1,67 @@
+package grpcprom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// oversizeCounter counts messages larger than the maximum size of their method.
+// A nil oversizeCounter does nothing.
+type oversizeCounter struct {
+	maxSize map[string]int // full method name => bytes; "" => default
+	total   counterVec
+}
+
+func newOversized(subsys string, ms *metricSet, prefix []string, opts metricOptions) *oversizeCounter {
+	if opts.disable || len(opts.maxSize) == 0 {
+		return nil
+	}
+	return &oversizeCounter{
+		maxSize: opts.maxSize,
+		total: newCounterVec(
+			ms,
+			opts,
+			prometheus.CounterOpts{
+				Name: "oversized_messages_total",
+				Help: fmt.Sprintf("Total number of gRPC %s messages larger than the maximum size of their method.", subsys),
+			},
+			labelNames(prefix, "grpc_type", "grpc_service", "grpc_method", "grpc_direction"),
+		),
+	}
+}
+
+// observe counts the message if it's larger than the maximum size of its method.
+func (c *oversizeCounter) observe(v *rpcInfo, sent bool, size int) {
+	if c == nil {
+		return
+	}
+	max, ok := c.maxSize[v.name]
+	if !ok {
+		if max, ok = c.maxSize[""]; !ok {
+			return
+		}
+	}
+	if size <= max {
+		return
+	}
+	v.oversized.Store(true)
+	dir := "recv"
+	if sent {
+		dir = "sent"
+	}
+	lvs := make([]string, 0, len(v.pending)+1)
+	c.total.WithLabelValues(append(append(lvs, v.pending...), dir)...).Inc()
+}
+
+func (c *oversizeCounter) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		c.total.Describe(ch)
+	}
+}
+
+func (c *oversizeCounter) Collect(ch chan<- prometheus.Metric) {
+	if c != nil {
+		c.total.Collect(ch)
+	}
+}
@@ -0,0 +1,85 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+)
+
+// otherPeer is the peer label value of peers beyond the limit.
+const otherPeer = "Other"
+
+// peerSet bounds the peer label values to the first max peers seen.
+// A nil peerSet labels nothing.
+type peerSet struct {
+	max int
+	log Logger
+
+	mu     sync.RWMutex
+	names  map[string]string
+	warned bool // the limit was exceeded
+}
+
+func newPeerSet(enable bool, max int, log Logger) *peerSet {
+	if !enable {
+		return nil
+	}
+	return &peerSet{
+		max:   max,
+		log:   log,
+		names: make(map[string]string),
+	}
+}
+
+// peer returns the peer label value for the remote address.
+// TCP peers are named by IP, because the port is ephemeral.
+func (s *peerSet) peer(addr net.Addr) string {
+	if s == nil {
+		return ""
+	}
+	var name string
+	switch addr := addr.(type) {
+	case nil:
+		return unknown
+	case *net.TCPAddr:
+		name = addr.IP.String()
+	default:
+		name = addr.String()
+	}
+	if name == "" {
+		return unknown
+	}
+	s.mu.RLock()
+	v, ok := s.names[name]
+	s.mu.RUnlock()
+	if ok {
+		return v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.names[name]; ok {
+		return v
+	}
+	if len(s.names) >= s.max {
+		if !s.warned {
+			s.warned = true
+			s.log.Warn("grpcprom: peer limit exceeded; other peers are labeled "+otherPeer, "max", s.max)
+		}
+		return otherPeer
+	}
+	s.names[name] = name
+	return name
+}
+
+// peerLabel returns the peer label value of the server RPC with the context.
+func (h *handler) peerLabel(ctx context.Context) string {
+	if c, ok := ctx.Value(connKey{h}).(*connInfo); ok {
+		return c.peer
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return h.peers.peer(p.Addr)
+	}
+	return unknown
+}
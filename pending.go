@@ -0,0 +1,36 @@
+package grpcprom
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pendingCounts count pending requests by full method name, so that
+// they may be read without collecting the requests_pending metric.
+type pendingCounts struct {
+	total   atomic.Int64
+	methods sync.Map // full method name => *atomic.Int64
+}
+
+// method returns the count of the full method name.
+func (p *pendingCounts) method(name string) *atomic.Int64 {
+	if c, ok := p.methods.Load(name); ok {
+		return c.(*atomic.Int64)
+	}
+	c, _ := p.methods.LoadOrStore(name, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+// add adds n to the count of the method and to the total.
+func (p *pendingCounts) add(c *atomic.Int64, n int64) {
+	c.Add(n)
+	p.total.Add(n)
+}
+
+// pending returns the count of the full method name.
+func (p *pendingCounts) pending(name string) float64 {
+	if c, ok := p.methods.Load(name); ok {
+		return float64(c.(*atomic.Int64).Load())
+	}
+	return 0
+}
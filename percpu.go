@@ -0,0 +1,167 @@
+package grpcprom
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// numShards returns the number of counter shards, which is
+// the power of two at least the number of processors.
+func numShards() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return n
+}
+
+// perCPUCounterVec is a vector of counters which are sharded by processor,
+// so that concurrent increments rarely contend on a shared cache line.
+// The shards are summed when collected.
+type perCPUCounterVec struct {
+	desc   *prometheus.Desc
+	labels int
+
+	mu     sync.RWMutex
+	values map[uint64][]*perCPUCounter // hash of label values => counters
+}
+
+func newPerCPUCounterVec(opts prometheus.CounterOpts, labelNames []string) *perCPUCounterVec {
+	return &perCPUCounterVec{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help,
+			labelNames,
+			opts.ConstLabels,
+		),
+		labels: len(labelNames),
+		values: make(map[uint64][]*perCPUCounter),
+	}
+}
+
+func (v *perCPUCounterVec) Describe(ch chan<- *prometheus.Desc) { ch <- v.desc }
+
+func (v *perCPUCounterVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.RLock()
+	counters := make([]*perCPUCounter, 0, len(v.values))
+	for _, cs := range v.values {
+		counters = append(counters, cs...)
+	}
+	v.mu.RUnlock()
+	for _, c := range counters {
+		ch <- c
+	}
+}
+
+func (v *perCPUCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	c, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (v *perCPUCounterVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Counter, error) {
+	if len(lvs) != v.labels {
+		return nil, fmt.Errorf("%s: expected %d label values but got %d", v.desc, v.labels, len(lvs))
+	}
+	h := hashLabelValues(lvs)
+	v.mu.RLock()
+	for _, c := range v.values[h] {
+		if equalLabelValues(c.lvs, lvs) {
+			v.mu.RUnlock()
+			return c, nil
+		}
+	}
+	v.mu.RUnlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, c := range v.values[h] {
+		if equalLabelValues(c.lvs, lvs) {
+			return c, nil
+		}
+	}
+	c := newPerCPUCounter(v.desc, append([]string(nil), lvs...))
+	v.values[h] = append(v.values[h], c)
+	return c, nil
+}
+
+// perCPUCounter is a counter which is sharded by processor. Increments pick
+// a random shard, which is cheap and doesn't depend on runtime internals.
+type perCPUCounter struct {
+	desc   *prometheus.Desc
+	lvs    []string
+	mask   uint32
+	shards []counterShard
+}
+
+// counterShard is padded to its own cache line.
+type counterShard struct {
+	valInt  atomic.Uint64 // integer increments
+	valBits atomic.Uint64 // float64 bits of other increments
+	_       [48]byte
+}
+
+func newPerCPUCounter(desc *prometheus.Desc, lvs []string) *perCPUCounter {
+	n := numShards()
+	return &perCPUCounter{
+		desc:   desc,
+		lvs:    lvs,
+		mask:   uint32(n - 1),
+		shards: make([]counterShard, n),
+	}
+}
+
+func (c *perCPUCounter) Desc() *prometheus.Desc              { return c.desc }
+func (c *perCPUCounter) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+func (c *perCPUCounter) Collect(ch chan<- prometheus.Metric) { ch <- c }
+
+// shard returns a random shard.
+func (c *perCPUCounter) shard() *counterShard {
+	return &c.shards[rand.Uint32()&c.mask]
+}
+
+func (c *perCPUCounter) Inc() {
+	c.shard().valInt.Add(1)
+}
+
+func (c *perCPUCounter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease in value")
+	}
+	s := c.shard()
+	if u := uint64(v); float64(u) == v {
+		s.valInt.Add(u)
+		return
+	}
+	for {
+		old := s.valBits.Load()
+		if s.valBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (c *perCPUCounter) value() float64 {
+	var sum float64
+	for i := range c.shards {
+		s := &c.shards[i]
+		sum += float64(s.valInt.Load()) + math.Float64frombits(s.valBits.Load())
+	}
+	return sum
+}
+
+func (c *perCPUCounter) Write(m *dto.Metric) error {
+	pm, err := prometheus.NewConstMetric(c.desc, prometheus.CounterValue, c.value(), c.lvs...)
+	if err != nil {
+		return err
+	}
+	return pm.Write(m)
+}
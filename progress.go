@@ -0,0 +1,40 @@
+package grpcprom
+
+import (
+	"context"
+	"time"
+)
+
+// Progress is the progress of an RPC so far.
+type Progress struct {
+	// Elapsed is the time since the RPC began.
+	Elapsed time.Duration
+	// SentBytes is the number of bytes sent on the wire.
+	SentBytes int
+	// RecvBytes is the number of bytes received on the wire.
+	RecvBytes int
+}
+
+// Progress returns the progress of the server RPC with the context,
+// or false if it's not tracked.
+func (m *ServerMetrics) Progress(ctx context.Context) (Progress, bool) {
+	return m.handler.progress(ctx)
+}
+
+// Progress returns the progress of the client RPC with the context,
+// or false if it's not tracked.
+func (m *ClientMetrics) Progress(ctx context.Context) (Progress, bool) {
+	return m.handler.progress(ctx)
+}
+
+func (h *handler) progress(ctx context.Context) (Progress, bool) {
+	v, ok := ctx.Value(h).(*rpcInfo)
+	if !ok || v.begin.IsZero() {
+		return Progress{}, false
+	}
+	return Progress{
+		Elapsed:   time.Since(v.begin),
+		SentBytes: int(v.sentSize.Load()),
+		RecvBytes: int(v.recvSize.Load()),
+	}, true
+}
@@ -0,0 +1,62 @@
+package grpcprom
+
+import (
+	"errors"
+	"sort"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// initFiles initializes the metrics of the services described by files,
+// or protoregistry.GlobalFiles if it's nil, with the given options.
+// Services without methods are skipped.
+func (h *handler) initFiles(instance string, files *protoregistry.Files, o initOptions) error {
+	if files == nil {
+		files = protoregistry.GlobalFiles
+	}
+	var sds []protoreflect.ServiceDescriptor
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i, svcs := 0, fd.Services(); i < svcs.Len(); i++ {
+			sds = append(sds, svcs.Get(i))
+		}
+		return true
+	})
+	sort.Slice(sds, func(i, k int) bool { return sds[i].FullName() < sds[k].FullName() })
+	var errs []error
+	for _, sd := range sds {
+		if sd.Methods().Len() == 0 {
+			continue
+		}
+		errs = append(errs, h.initServiceDescriptor(instance, sd, o))
+	}
+	return errors.Join(errs...)
+}
+
+// initServiceDescriptors initializes the metrics of the methods of sds with the given options.
+func (h *handler) initServiceDescriptors(instance string, sds []protoreflect.ServiceDescriptor, o initOptions) error {
+	var errs []error
+	for _, sd := range sds {
+		errs = append(errs, h.initServiceDescriptor(instance, sd, o))
+	}
+	return errors.Join(errs...)
+}
+
+// initServiceDescriptor initializes the metrics of the methods of sd with the given options.
+func (h *handler) initServiceDescriptor(instance string, sd protoreflect.ServiceDescriptor, o initOptions) error {
+	if sd == nil {
+		return errors.New("grpcprom: nil service descriptor")
+	}
+	mds := sd.Methods()
+	methods := make([]grpc.MethodInfo, mds.Len())
+	for i := range methods {
+		md := mds.Get(i)
+		methods[i] = grpc.MethodInfo{
+			Name:           string(md.Name()),
+			IsClientStream: md.IsStreamingClient(),
+			IsServerStream: md.IsStreamingServer(),
+		}
+	}
+	return h.init(instance, string(sd.FullName()), methods, o)
+}
@@ -0,0 +1,102 @@
+package grpcprom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// InitFromReflection initializes the metrics for the methods of every service
+// exposed by the server at the target of cc with the given codes, by querying
+// its grpc.reflection.v1alpha.ServerReflection service. It returns an error if
+// the server doesn't implement reflection or its descriptors are invalid, and
+// otherwise its errors are the same as InitE.
+func (m *ClientMetrics) InitFromReflection(ctx context.Context, cc *grpc.ClientConn, codes ...codes.Code) error {
+	sds, err := reflectServices(ctx, rpb.NewServerReflectionClient(cc))
+	if err != nil {
+		return err
+	}
+	return m.handler.initServiceDescriptors("", sds, initOptions{codes: codes})
+}
+
+// reflectServices returns the descriptors of the services listed by client.
+func reflectServices(ctx context.Context, client rpb.ServerReflectionClient) ([]protoreflect.ServiceDescriptor, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("grpcprom: reflection: %w", err)
+	}
+	call := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, fmt.Errorf("grpcprom: reflection: %w", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("grpcprom: reflection: %w", err)
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("grpcprom: reflection: %s", e.GetErrorMessage())
+		}
+		return resp, nil
+	}
+
+	resp, err := call(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		names = append(names, svc.GetName())
+	}
+
+	// The server sends each file once per stream, along with
+	// its dependencies which haven't already been sent.
+	var set descriptorpb.FileDescriptorSet
+	for _, name := range names {
+		resp, err := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: name},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := new(descriptorpb.FileDescriptorProto)
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return nil, fmt.Errorf("grpcprom: reflection: %w", err)
+			}
+			set.File = append(set.File, fd)
+		}
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("grpcprom: reflection: %w", err)
+	}
+
+	sds := make([]protoreflect.ServiceDescriptor, 0, len(names))
+	var errs []error
+	for _, name := range names {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("grpcprom: reflection: service %q: %w", name, err))
+			continue
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			errs = append(errs, fmt.Errorf("grpcprom: reflection: %q is not a service", name))
+			continue
+		}
+		sds = append(sds, sd)
+	}
+	return sds, errors.Join(errs...)
+}
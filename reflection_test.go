@@ -0,0 +1,44 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+func TestInitFromReflection(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	check(t, err)
+	defer lis.Close()
+	srv := grpc.NewServer()
+	defer srv.Stop()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	check(t, err)
+	defer conn.Close()
+
+	m := NewClientMetrics()
+	check(t, m.InitFromReflection(context.Background(), conn, codes.OK))
+	want := `
+# HELP grpc_client_requests_total Total number of gRPC client requests completed.
+# TYPE grpc_client_requests_total counter
+grpc_client_requests_total{grpc_code="OK",grpc_method="Check",grpc_service="grpc.health.v1.Health",grpc_type="Unary"} 0
+grpc_client_requests_total{grpc_code="OK",grpc_method="ServerReflectionInfo",grpc_service="grpc.reflection.v1alpha.ServerReflection",grpc_type="BidiStream"} 0
+grpc_client_requests_total{grpc_code="OK",grpc_method="Watch",grpc_service="grpc.health.v1.Health",grpc_type="ServerStream"} 0
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
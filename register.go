@@ -0,0 +1,48 @@
+package grpcprom
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var fqNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// mustRegister registers c, the metrics of the subsystem, with the handler's
+// registerer, if any, and panics if they can't be registered.
+func (h *handler) mustRegister(c prometheus.Collector, subsys string) {
+	if h.registerer == nil {
+		return
+	}
+	if err := register(h.registerer, c, subsys); err != nil {
+		panic(err)
+	}
+}
+
+// register registers c, the metrics of the subsystem, with r,
+// explaining collisions with metrics which are already registered.
+func register(r prometheus.Registerer, c prometheus.Collector, subsys string) error {
+	err := r.Register(c)
+	if err == nil {
+		return nil
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if are.ExistingCollector == c {
+			return fmt.Errorf("grpcprom: %s metrics are already registered", subsys)
+		}
+		return fmt.Errorf("grpcprom: other %s metrics with the same names are already registered; "+
+			"share one instance between servers with the ServerLabel option, "+
+			"rename each instance's metrics with the Namespace or SubsystemPrefix option, "+
+			"or register each instance with its own registry: %w", subsys, err)
+	}
+	if m := fqNameRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("grpcprom: %s metric %s collides with a registered metric "+
+			"with different labels or help; disable it with its option, "+
+			"rename the metrics with the Namespace or SubsystemPrefix option, "+
+			"or register the metrics with their own registry: %w", subsys, m[1], err)
+	}
+	return fmt.Errorf("grpcprom: failed to register %s metrics: %w", subsys, err)
+}
@@ -0,0 +1,152 @@
+package grpcprom
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HTTP/2 error codes, by value.
+var h2ErrCodes = [...]string{
+	"NO_ERROR",
+	"PROTOCOL_ERROR",
+	"INTERNAL_ERROR",
+	"FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT",
+	"STREAM_CLOSED",
+	"FRAME_SIZE_ERROR",
+	"REFUSED_STREAM",
+	"CANCEL",
+	"COMPRESSION_ERROR",
+	"CONNECT_ERROR",
+	"ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY",
+	"HTTP_1_1_REQUIRED",
+}
+
+// rstConns counts the HTTP/2 RST_STREAM frames read from and written to
+// connections by their error codes. A nil rstConns does nothing.
+type rstConns struct {
+	vec   *prometheus.CounterVec
+	total [2][len(h2ErrCodes) + 1]prometheus.Counter // recv, sent; code or unknown
+}
+
+func newRSTStream(subsys string, ms *metricSet, opts metricOptions) *rstConns {
+	if opts.disable {
+		return nil
+	}
+	r := &rstConns{
+		vec: ms.counterVec(
+			prometheus.CounterOpts{
+				Name: "http2_rst_stream_total",
+				Help: fmt.Sprintf("Total number of HTTP/2 RST_STREAM frames of gRPC %s connections.", subsys),
+			},
+			[]string{"grpc_direction", "grpc_http2_error"},
+		),
+	}
+	for dir, dirLv := range [2]string{"recv", "sent"} {
+		for code, codeLv := range h2ErrCodes {
+			r.total[dir][code] = r.vec.WithLabelValues(dirLv, codeLv)
+		}
+		r.total[dir][len(h2ErrCodes)] = r.vec.WithLabelValues(dirLv, "UNKNOWN")
+	}
+	return r
+}
+
+func (r *rstConns) listener(lis net.Listener) net.Listener {
+	if r == nil {
+		return lis
+	}
+	return &rstListener{Listener: lis, r: r}
+}
+
+func (r *rstConns) dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	if r == nil {
+		return dial
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return r.track(conn, true), nil
+	}
+}
+
+// track returns the connection with its frames scanned. The client
+// connection preface precedes the frames written by clients, and nothing
+// is counted in either direction of a connection without it, such as one
+// encrypted by gRPC's transport credentials.
+func (r *rstConns) track(conn net.Conn, client bool) net.Conn {
+	c := &rstConn{Conn: conn}
+	c.read = frameScanner{keep: keepRSTStream, frame: r.counter(0)}
+	c.write = frameScanner{keep: keepRSTStream, frame: r.counter(1)}
+	if client {
+		c.write.preface = clientPreface
+	} else {
+		c.read.preface = clientPreface
+	}
+	return c
+}
+
+// counter returns a function which counts RST_STREAM frames in the direction.
+func (r *rstConns) counter(dir int) func(typ, flags byte, payload []byte) {
+	return func(typ, flags byte, payload []byte) {
+		if typ != frameRSTStream || len(payload) < 4 {
+			return
+		}
+		code := binary.BigEndian.Uint32(payload)
+		if code > uint32(len(h2ErrCodes)) {
+			code = uint32(len(h2ErrCodes))
+		}
+		r.total[dir][code].Inc()
+	}
+}
+
+func keepRSTStream(typ byte) bool { return typ == frameRSTStream }
+
+func (r *rstConns) Describe(ch chan<- *prometheus.Desc) {
+	if r != nil {
+		r.vec.Describe(ch)
+	}
+}
+
+func (r *rstConns) Collect(ch chan<- prometheus.Metric) {
+	if r != nil {
+		r.vec.Collect(ch)
+	}
+}
+
+type rstListener struct {
+	net.Listener
+	r *rstConns
+}
+
+func (lis *rstListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return lis.r.track(conn, false), nil
+}
+
+type rstConn struct {
+	net.Conn
+	read  frameScanner // guarded by the single reader
+	write frameScanner // guarded by the single writer
+}
+
+func (c *rstConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.scan(b[:n])
+	return n, err
+}
+
+func (c *rstConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.write.scan(b[:n])
+	return n, err
+}
@@ -0,0 +1,88 @@
+package grpcprom
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2RSTStream(t *testing.T) {
+	m := NewServerMetrics(HTTP2RSTStreamTotal(Enable()))
+	server, client := net.Pipe()
+	defer client.Close()
+	conn, err := m.Listener(&pipeListener{conn: server}).Accept()
+	check(t, err)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.WriteString(client, http2.ClientPreface)
+		fr := http2.NewFramer(client, client)
+		fr.WriteSettings()
+		fr.WriteRSTStream(1, http2.ErrCodeCancel)
+		fr.WriteRSTStream(3, http2.ErrCodeCancel)
+		fr.WriteRSTStream(5, http2.ErrCode(0x99))
+		fr.ReadFrame() // settings
+		fr.ReadFrame() // reset
+		client.Close()
+	}()
+	// Read the preface, the settings frame, and the three reset frames.
+	_, err = io.ReadFull(conn, make([]byte, len(http2.ClientPreface)+9+3*13))
+	check(t, err)
+	fr := http2.NewFramer(conn, nil)
+	check(t, fr.WriteSettings())
+	check(t, fr.WriteRSTStream(7, http2.ErrCodeEnhanceYourCalm))
+	<-done
+
+	r := m.handler.rst
+	for _, tt := range []struct {
+		dir  int
+		code http2.ErrCode
+		want float64
+	}{
+		{0, http2.ErrCodeCancel, 2},
+		{0, http2.ErrCode(len(h2ErrCodes)), 1}, // unknown
+		{0, http2.ErrCodeNo, 0},
+		{1, http2.ErrCodeEnhanceYourCalm, 1},
+		{1, http2.ErrCodeCancel, 0},
+	} {
+		if got := testutil.ToFloat64(r.total[tt.dir][tt.code]); got != tt.want {
+			t.Errorf("http2_rst_stream_total{dir=%d,code=%v} = %v; want %v", tt.dir, tt.code, got, tt.want)
+		}
+	}
+	if n := testutil.CollectAndCount(m, "grpc_server_http2_rst_stream_total"); n != 2*(len(h2ErrCodes)+1) {
+		t.Errorf("http2_rst_stream_total series = %d; want %d", n, 2*(len(h2ErrCodes)+1))
+	}
+}
+
+func TestHTTP2RSTStreamEncrypted(t *testing.T) {
+	m := NewServerMetrics(HTTP2RSTStreamTotal(Enable()))
+	server, client := net.Pipe()
+	defer client.Close()
+	conn, err := m.Listener(&pipeListener{conn: server}).Accept()
+	check(t, err)
+	defer conn.Close()
+
+	// Without the preface, such as when a TLS handshake record comes first,
+	// the frames that follow aren't counted.
+	record := []byte{0x16, 0x03, 0x01, 0x00, 0x00}
+	go func() {
+		client.Write(record)
+		fr := http2.NewFramer(client, nil)
+		fr.WriteSettings()
+		fr.WriteRSTStream(1, http2.ErrCodeCancel)
+	}()
+	_, err = io.ReadFull(conn, make([]byte, len(record)+9+13))
+	check(t, err)
+
+	r := m.handler.rst
+	for _, c := range r.total[0] {
+		if got := testutil.ToFloat64(c); got != 0 {
+			t.Fatalf("http2_rst_stream_total of encrypted connection = %v; want 0", got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package grpcprom
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+// A SkipFunc returns true if the RPC with the context and tag info
+// shouldn't be recorded.
+type SkipFunc func(ctx context.Context, info *stats.RPCTagInfo) bool
+
+// SkipMetadata returns a SkipFunc that skips RPCs with the given key
+// in their incoming or outgoing metadata, such as to mark load tests.
+func SkipMetadata(key string) SkipFunc {
+	return func(ctx context.Context, _ *stats.RPCTagInfo) bool {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(key)) > 0 {
+			return true
+		}
+		if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(key)) > 0 {
+			return true
+		}
+		return false
+	}
+}
+
+// filterSkip returns a SkipFunc that skips RPCs of methods for which keep
+// returns false or for which skip returns true. Either may be nil.
+func filterSkip(keep func(fullMethod string) bool, skip SkipFunc) SkipFunc {
+	if keep == nil {
+		return skip
+	}
+	return func(ctx context.Context, info *stats.RPCTagInfo) bool {
+		return !keep(info.FullMethodName) || (skip != nil && skip(ctx, info))
+	}
+}
+
+// skipKey is the context key that marks an RPC which isn't recorded.
+type skipKey struct{ h *handler }
+
+// skipped returns true if the RPC of ctx was marked to be skipped.
+func (h *handler) skipped(ctx context.Context) bool {
+	return h.skip != nil && ctx.Value(skipKey{h}) != nil
+}
+
+// skipRPC returns a copy of ctx marked to be skipped and true if the RPC
+// shouldn't be recorded.
+func (h *handler) skipRPC(ctx context.Context, info *stats.RPCTagInfo) (context.Context, bool) {
+	if h.skip == nil || !h.skip(ctx, info) {
+		return ctx, false
+	}
+	return context.WithValue(ctx, skipKey{h}, true), true
+}
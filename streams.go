@@ -0,0 +1,147 @@
+package grpcprom
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A streamSet is the set of open streams of selected methods.
+type streamSet struct {
+	methods map[string]bool
+
+	mu      sync.Mutex
+	streams map[*rpcInfo]struct{}
+}
+
+func newStreamSet(methods map[string]bool) *streamSet {
+	return &streamSet{
+		methods: methods,
+		streams: make(map[*rpcInfo]struct{}),
+	}
+}
+
+func (s *streamSet) add(v *rpcInfo) {
+	if !s.methods[v.name] {
+		return
+	}
+	s.mu.Lock()
+	s.streams[v] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *streamSet) remove(v *rpcInfo) {
+	if !s.methods[v.name] {
+		return
+	}
+	s.mu.Lock()
+	delete(s.streams, v)
+	s.mu.Unlock()
+}
+
+// msgAgeCollector reports the maximum time since the last message
+// of the open streams of each method. A nil msgAgeCollector does nothing.
+type msgAgeCollector struct {
+	desc *prometheus.Desc
+	set  *streamSet
+}
+
+func (c *msgAgeCollector) begin(v *rpcInfo) {
+	if c != nil {
+		c.set.add(v)
+	}
+}
+
+func (c *msgAgeCollector) end(v *rpcInfo) {
+	if c != nil {
+		c.set.remove(v)
+	}
+}
+
+func (c *msgAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		ch <- c.desc
+	}
+}
+
+func (c *msgAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	if c == nil {
+		return
+	}
+	type series struct {
+		lvs []string
+		age time.Duration
+	}
+	now := time.Now()
+	max := make(map[string]*series) // joined label values => series
+	c.set.mu.Lock()
+	for v := range c.set.streams {
+		age := now.Sub(time.Unix(0, v.lastMsg.Load()))
+		key := strings.Join(v.pending, "\x00")
+		if s, ok := max[key]; !ok {
+			max[key] = &series{lvs: v.pending, age: age}
+		} else if age > s.age {
+			s.age = age
+		}
+	}
+	c.set.mu.Unlock()
+	for _, s := range max {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, s.age.Seconds(), s.lvs...)
+	}
+}
+
+// staleCollector counts streams which stay open longer than the maximum age
+// of their method. Open streams are checked when collected. A nil staleCollector
+// does nothing.
+type staleCollector struct {
+	maxAge map[string]time.Duration
+	set    *streamSet
+	total  counterVec
+}
+
+func (c *staleCollector) begin(v *rpcInfo) {
+	if c != nil {
+		c.set.add(v)
+	}
+}
+
+func (c *staleCollector) end(v *rpcInfo) {
+	if c == nil {
+		return
+	}
+	c.set.remove(v)
+	c.check(v, time.Now())
+}
+
+// check counts the stream if it's newly stale.
+// It must be called with c.set.mu held or after the stream is removed.
+func (c *staleCollector) check(v *rpcInfo, now time.Time) {
+	if v.stale {
+		return
+	}
+	if maxAge, ok := c.maxAge[v.name]; ok && now.Sub(v.begin) > maxAge {
+		v.stale = true
+		c.total.WithLabelValues(v.pending...).Inc()
+	}
+}
+
+func (c *staleCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		c.total.Describe(ch)
+	}
+}
+
+func (c *staleCollector) Collect(ch chan<- prometheus.Metric) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.set.mu.Lock()
+	for v := range c.set.streams {
+		c.check(v, now)
+	}
+	c.set.mu.Unlock()
+	c.total.Collect(ch)
+}
@@ -0,0 +1,182 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// defaultMaxTCPPeers is the number of peers named by the TCP info metrics
+// if the peer limit isn't given by PeerLabel.
+const defaultMaxTCPPeers = 100
+
+// minTCPSweep is the number of tracked connections before closed
+// connections are first swept from them.
+const minTCPSweep = 64
+
+// tcpConns samples the TCP info of tracked connections when collected,
+// aggregated by peer host. A nil tcpConns tracks nothing.
+//
+// Connections aren't wrapped, so that gRPC may still find the *net.TCPConn
+// to set options such as TCP_USER_TIMEOUT. Instead, they're held on the side
+// and forgotten once sampling them fails because they're closed.
+type tcpConns struct {
+	rtt     *prometheus.Desc
+	retrans *prometheus.Desc
+	peers   *peerSet
+
+	mu    sync.Mutex
+	conns map[net.Conn]string // peer label values
+	sweep int                 // number of conns at which to sweep closed conns
+}
+
+func newTCPConns(subsys string, ms *metricSet, opts metricOptions, maxPeers int, log Logger) *tcpConns {
+	if opts.disable || !tcpInfoSupported {
+		return nil
+	}
+	ms.setAggMode("tcp_rtt_seconds", aggMax)
+	return &tcpConns{
+		rtt: ms.desc(
+			dto.MetricType_GAUGE,
+			"tcp_rtt_seconds",
+			fmt.Sprintf("Maximum smoothed round-trip time of gRPC %s TCP connections.", subsys),
+			[]string{"grpc_peer"},
+		),
+		retrans: ms.desc(
+			dto.MetricType_GAUGE,
+			"tcp_retransmits",
+			fmt.Sprintf("Number of segments retransmitted by open gRPC %s TCP connections.", subsys),
+			[]string{"grpc_peer"},
+		),
+		peers: newPeerSet(true, maxPeers, log),
+		conns: make(map[net.Conn]string),
+		sweep: minTCPSweep,
+	}
+}
+
+// tcpPeers returns the number of peers named by the TCP info metrics.
+func tcpPeers(o *options) int {
+	if o.peerLabel {
+		return o.maxPeers
+	}
+	return defaultMaxTCPPeers
+}
+
+// track tracks conn until it's closed and returns it unwrapped.
+func (t *tcpConns) track(conn net.Conn) net.Conn {
+	if t == nil {
+		return conn
+	}
+	peer := t.peers.peer(conn.RemoteAddr())
+	t.mu.Lock()
+	t.conns[conn] = peer
+	if len(t.conns) >= t.sweep {
+		// Bound the closed conns held between collections.
+		for c := range t.conns {
+			if _, _, ok := tcpInfo(c); !ok {
+				delete(t.conns, c)
+			}
+		}
+		t.sweep = 2 * len(t.conns)
+		if t.sweep < minTCPSweep {
+			t.sweep = minTCPSweep
+		}
+	}
+	t.mu.Unlock()
+	return conn
+}
+
+func (t *tcpConns) listener(lis net.Listener) net.Listener {
+	if t == nil {
+		return lis
+	}
+	return &tcpListener{Listener: lis, t: t}
+}
+
+func (t *tcpConns) dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+	if t == nil {
+		return dial
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return t.track(conn), nil
+	}
+}
+
+func (t *tcpConns) Describe(ch chan<- *prometheus.Desc) {
+	if t != nil {
+		ch <- t.rtt
+		ch <- t.retrans
+	}
+}
+
+func (t *tcpConns) Collect(ch chan<- prometheus.Metric) {
+	if t == nil {
+		return
+	}
+	type sample struct {
+		rtt     time.Duration
+		retrans uint32
+	}
+	type tracked struct {
+		conn net.Conn
+		peer string
+	}
+	t.mu.Lock()
+	conns := make([]tracked, 0, len(t.conns))
+	for c, peer := range t.conns {
+		conns = append(conns, tracked{c, peer})
+	}
+	t.mu.Unlock()
+	peers := make(map[string]*sample)
+	for _, c := range conns {
+		rtt, retrans, ok := tcpInfo(c.conn)
+		if !ok {
+			// It's closed or isn't a TCP conn.
+			t.mu.Lock()
+			delete(t.conns, c.conn)
+			t.mu.Unlock()
+			continue
+		}
+		s, ok := peers[c.peer]
+		if !ok {
+			s = &sample{}
+			peers[c.peer] = s
+		}
+		if rtt > s.rtt {
+			s.rtt = rtt
+		}
+		s.retrans += retrans
+	}
+	for peer, s := range peers {
+		ch <- prometheus.MustNewConstMetric(t.rtt, prometheus.GaugeValue, s.rtt.Seconds(), peer)
+		ch <- prometheus.MustNewConstMetric(t.retrans, prometheus.GaugeValue, float64(s.retrans), peer)
+	}
+}
+
+type tcpListener struct {
+	net.Listener
+	t *tcpConns
+}
+
+func (lis *tcpListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return lis.t.track(conn), nil
+}
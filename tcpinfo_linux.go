@@ -0,0 +1,34 @@
+//go:build linux
+
+package grpcprom
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpInfoSupported reports whether tcpInfo is supported on this platform.
+const tcpInfoSupported = true
+
+// tcpInfo returns the smoothed round-trip time and total retransmits of conn.
+func tcpInfo(conn net.Conn) (rtt time.Duration, retrans uint32, ok bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var info *unix.TCPInfo
+	err = raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info == nil {
+		return 0, 0, false
+	}
+	return time.Duration(info.Rtt) * time.Microsecond, info.Total_retrans, true
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package grpcprom
+
+import (
+	"net"
+	"time"
+)
+
+// tcpInfoSupported reports whether tcpInfo is supported on this platform.
+const tcpInfoSupported = false
+
+// tcpInfo isn't supported on this platform.
+func tcpInfo(conn net.Conn) (rtt time.Duration, retrans uint32, ok bool) {
+	return 0, 0, false
+}
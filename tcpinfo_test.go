@@ -0,0 +1,50 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTCPInfo(t *testing.T) {
+	m := NewServerMetrics()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	check(t, err)
+	lis := m.Listener(l)
+	defer lis.Close()
+
+	dial, err := net.Dial("tcp", lis.Addr().String())
+	check(t, err)
+	defer dial.Close()
+	conn, err := lis.Accept()
+	check(t, err)
+
+	want := 0
+	if runtime.GOOS == "linux" {
+		want = 2
+	}
+	if got := testutil.CollectAndCount(m.handler.tcpConns); got != want {
+		t.Fatalf("unexpected number of tcp metrics: got %d; want %d", got, want)
+	}
+	check(t, conn.Close())
+	if got := testutil.CollectAndCount(m.handler.tcpConns); got != 0 {
+		t.Fatalf("unexpected number of tcp metrics after close: got %d; want 0", got)
+	}
+}
+
+func TestTCPInfoUnwrapped(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	check(t, err)
+	defer lis.Close()
+
+	m := NewClientMetrics()
+	conn, err := m.Dialer(nil)(context.Background(), lis.Addr().String())
+	check(t, err)
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("unexpected conn type: got %T; want *net.TCPConn", conn)
+	}
+}
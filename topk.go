@@ -0,0 +1,219 @@
+package grpcprom
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/peer"
+)
+
+// A KeyFunc returns the key of an RPC with the given full method name
+// for tracking the top keys.
+type KeyFunc func(ctx context.Context, fullMethod string) string
+
+// MethodKey is a KeyFunc which returns the full method name.
+func MethodKey(ctx context.Context, fullMethod string) string {
+	return fullMethod
+}
+
+// PeerKey is a KeyFunc which returns the peer's host, if known.
+// It's only known on servers.
+func PeerKey(ctx context.Context, fullMethod string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return unknown
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// topKShards is the number of shards of a topKCollector, by which keys are
+// partitioned so that concurrent requests with different keys don't contend.
+const topKShards = 16
+
+// topKCollector tracks the top keys of requests by count and by bytes.
+// A nil topKCollector does nothing.
+type topKCollector struct {
+	key    KeyFunc
+	k      int
+	seed   maphash.Seed
+	shards [topKShards]topKShard
+
+	reqs  *prometheus.Desc
+	bytes *prometheus.Desc
+}
+
+// topKShard tracks the top keys of a partition of keys.
+type topKShard struct {
+	mu    sync.Mutex
+	reqs  *spaceSaving
+	bytes *spaceSaving
+	_     [64]byte // avoid false sharing
+}
+
+func newTopK(subsys string, ms *metricSet, k int, key KeyFunc) *topKCollector {
+	if k <= 0 || key == nil {
+		return nil
+	}
+	c := &topKCollector{
+		key:  key,
+		k:    k,
+		seed: maphash.MakeSeed(),
+		reqs: ms.desc(
+			dto.MetricType_GAUGE,
+			"top_requests",
+			fmt.Sprintf("Estimated number of gRPC %s requests completed by the top keys.", subsys),
+			[]string{"grpc_key"},
+		),
+		bytes: ms.desc(
+			dto.MetricType_GAUGE,
+			"top_bytes",
+			fmt.Sprintf("Estimated number of bytes sent and received in gRPC %s requests by the top keys.", subsys),
+			[]string{"grpc_key"},
+		),
+	}
+	for i := range c.shards {
+		c.shards[i].reqs = newSpaceSaving(k)
+		c.shards[i].bytes = newSpaceSaving(k)
+	}
+	return c
+}
+
+func (c *topKCollector) observe(ctx context.Context, v *rpcInfo) {
+	if c == nil {
+		return
+	}
+	key := c.key(ctx, v.name)
+	s := &c.shards[maphash.String(c.seed, key)%topKShards]
+	s.mu.Lock()
+	s.reqs.add(key, 1)
+	s.bytes.add(key, float64(v.recvSize.Load()+v.sentSize.Load()))
+	s.mu.Unlock()
+}
+
+func (c *topKCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c != nil {
+		ch <- c.reqs
+		ch <- c.bytes
+	}
+}
+
+// Collect sends the top k keys of all shards. Each key is tracked
+// by a single shard, so their estimates don't need to be merged.
+func (c *topKCollector) Collect(ch chan<- prometheus.Metric) {
+	if c == nil {
+		return
+	}
+	var reqs, bytes []ssEntry
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		reqs = s.reqs.appendEntries(reqs)
+		bytes = s.bytes.appendEntries(bytes)
+		s.mu.Unlock()
+	}
+	for _, top := range []struct {
+		desc    *prometheus.Desc
+		entries []ssEntry
+	}{
+		{c.reqs, reqs},
+		{c.bytes, bytes},
+	} {
+		sort.Slice(top.entries, func(i, j int) bool { return top.entries[i].weight > top.entries[j].weight })
+		if len(top.entries) > c.k {
+			top.entries = top.entries[:c.k]
+		}
+		for _, e := range top.entries {
+			ch <- prometheus.MustNewConstMetric(top.desc, prometheus.GaugeValue, e.weight, e.key)
+		}
+	}
+}
+
+// spaceSaving estimates the top k keys by weight with the Space-Saving
+// algorithm. When a new key arrives and all counters are used, the key
+// with the least weight is replaced and its weight is inherited, so the
+// weights of the top keys are overestimated by at most that amount.
+// Counters are kept in a min-heap, so each update is O(log k).
+// It must be synchronized by its user.
+type spaceSaving struct {
+	k       int
+	heap    ssHeap
+	entries map[string]*ssEntry
+}
+
+type ssEntry struct {
+	key    string
+	weight float64
+	index  int // in the heap
+}
+
+func newSpaceSaving(k int) *spaceSaving {
+	return &spaceSaving{
+		k:       k,
+		heap:    make(ssHeap, 0, k),
+		entries: make(map[string]*ssEntry, k),
+	}
+}
+
+func (s *spaceSaving) add(key string, weight float64) {
+	if e, ok := s.entries[key]; ok {
+		e.weight += weight
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.k {
+		e := &ssEntry{key: key, weight: weight}
+		heap.Push(&s.heap, e)
+		s.entries[key] = e
+		return
+	}
+	e := s.heap[0]
+	delete(s.entries, e.key)
+	e.key = key
+	e.weight += weight
+	s.entries[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// appendEntries appends copies of the entries to dst.
+func (s *spaceSaving) appendEntries(dst []ssEntry) []ssEntry {
+	for _, e := range s.heap {
+		dst = append(dst, *e)
+	}
+	return dst
+}
+
+// ssHeap is a min-heap of entries by weight.
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].weight < h[j].weight }
+
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x any) {
+	e := x.(*ssEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *ssHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,49 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/stats"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(2)
+	for _, key := range []string{"a", "a", "a", "b", "c", "a", "d"} {
+		s.add(key, 1)
+	}
+	if len(s.entries) != 2 || len(s.heap) != 2 {
+		t.Fatalf("tracked keys = %d; want 2", len(s.entries))
+	}
+	if got := s.entries["a"].weight; got != 4 {
+		t.Fatalf("weight of heavy hitter = %v; want 4", got)
+	}
+	if got := s.entries["d"].weight; got != 3 {
+		t.Fatalf("weight of replacement = %v; want 3", got)
+	}
+	if got := s.heap[0].key; got != "d" {
+		t.Fatalf("least weighted key = %q; want %q", got, "d")
+	}
+}
+
+func TestTopK(t *testing.T) {
+	m := NewServerMetrics(TopK(2, MethodKey))
+	h := m.handler
+	for _, method := range []string{"A", "A", "A", "B", "B", "C"} {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Service/" + method})
+		h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+		h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	}
+	want := `
+		# HELP grpc_server_top_requests Estimated number of gRPC server requests completed by the top keys.
+		# TYPE grpc_server_top_requests gauge
+		grpc_server_top_requests{grpc_key="/pkg.Service/A"} 3
+		grpc_server_top_requests{grpc_key="/pkg.Service/B"} 2
+	`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "grpc_server_top_requests"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package grpcprom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newMetricsWithError is like newMetrics, but it returns an error if the
+// options are invalid or if they fail to build the metrics.
+func newMetricsWithError(subsys string, opts ...Option) (h *handler, err error) {
+	o := newOptions(subsys, opts...)
+	if err := validateOptions(subsys, o); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			h, err = nil, fmt.Errorf("grpcprom: invalid %s options: %v", subsys, r)
+		}
+	}()
+	return newHandler(subsys, o), nil
+}
+
+// checkMetrics returns an error if c, the metrics of the subsystem, have
+// invalid or inconsistent descriptors, which can't be registered.
+func checkMetrics(c prometheus.Collector, subsys string) error {
+	if err := prometheus.NewPedanticRegistry().Register(c); err != nil {
+		return fmt.Errorf("grpcprom: invalid %s metrics: %w", subsys, err)
+	}
+	return nil
+}
+
+// validateOptions returns an error if the options of the subsystem
+// are invalid or conflict with each other.
+func validateOptions(subsys string, o *options) error {
+	var errs []error
+	for _, hist := range []struct {
+		name string
+		opts *histogramOptions
+	}{
+		{"connection_idle_seconds", &o.connsIdleTime},
+		{"latency_seconds", &o.latency},
+		{"timeout_seconds", &o.timeout},
+		{"pick_delay_seconds", &o.pickDelay},
+		{"operation_duration_seconds", &o.opDuration},
+		{"recv_bytes", &o.recvBytes},
+		{"sent_bytes", &o.sentBytes},
+		{"request_messages", &o.reqMsgs},
+		{"request_attempts", &o.reqAttempts},
+		{"upload_seconds", &o.upload},
+		{"request_size_bytes", &o.reqSize},
+		{"metadata_bytes", &o.mdBytes},
+		{"metadata_entries", &o.mdEntries},
+		{"response_size_bytes", &o.respSize},
+		{"response_size_ratio", &o.sizeRatio},
+		{"deadline_utilization_ratio", &o.deadlineUtil},
+		{"reconnect_backoff_seconds", &o.backoffs},
+		{"stats_handler_overhead_seconds", &o.overhead},
+		{"handling_seconds", &o.compat},
+	} {
+		name, h := hist.name, hist.opts
+		invalid := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("grpcprom: %s metric %s: %s", subsys, name, fmt.Sprintf(format, args...)))
+		}
+		if h.disable && (h.bucketsSet || len(h.objectives) > 0) {
+			invalid("buckets or objectives are set, but the metric is disabled")
+		}
+		if h.bucketsSet && len(h.objectives) > 0 {
+			invalid("both buckets and summary objectives are set")
+		}
+		if err := validateBuckets(h.buckets); err != nil {
+			invalid("%v", err)
+		}
+		for method, buckets := range h.methodBuckets {
+			if err := validateBuckets(buckets); err != nil {
+				invalid("%s: %v", method, err)
+			}
+		}
+		for q, e := range h.objectives {
+			if !(q >= 0 && q <= 1) || !(e >= 0 && e <= 1) {
+				invalid("invalid summary objective %v with error %v", q, e)
+			}
+		}
+		if len(h.methodBuckets) > 0 && name != "latency_seconds" {
+			invalid("method buckets are only supported by latency_seconds")
+		}
+		if len(h.objectives) > 0 && name != "latency_seconds" {
+			invalid("summaries are only supported by latency_seconds")
+		}
+		if h.uncompressed && name != "recv_bytes" && name != "sent_bytes" {
+			invalid("uncompressed sizes are only supported by recv_bytes and sent_bytes")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateBuckets returns an error if the buckets aren't non-negative
+// and strictly increasing, because all observations are non-negative.
+func validateBuckets(buckets []float64) error {
+	for i, b := range buckets {
+		if math.IsNaN(b) || b < 0 {
+			return fmt.Errorf("invalid bucket %v", b)
+		}
+		if i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("buckets aren't strictly increasing: %v", buckets)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewMetricsWithError(t *testing.T) {
+	_, err := NewServerMetricsWithError()
+	check(t, err)
+	_, err = NewClientMetricsWithError()
+	check(t, err)
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "decreasing buckets",
+			opts: []Option{LatencySeconds(Buckets([]float64{2, 1}))},
+			want: "strictly increasing",
+		},
+		{
+			name: "negative buckets",
+			opts: []Option{SentBytes(Buckets([]float64{-1, 0, 1}))},
+			want: "invalid bucket -1",
+		},
+		{
+			name: "method buckets",
+			opts: []Option{LatencySeconds(BucketsFor("/pkg.Service/Method", []float64{1, 1}))},
+			want: "/pkg.Service/Method",
+		},
+		{
+			name: "disabled buckets",
+			opts: []Option{TimeoutSeconds(Buckets([]float64{1, 2}))},
+			want: "disabled",
+		},
+		{
+			name: "summary and buckets",
+			opts: []Option{LatencySeconds(Buckets([]float64{1, 2}), Summary(map[float64]float64{0.5: 0.05}))},
+			want: "both buckets and summary",
+		},
+		{
+			name: "unsupported summary",
+			opts: []Option{SentBytes(Summary(map[float64]float64{0.5: 0.05}))},
+			want: "only supported by latency_seconds",
+		},
+		{
+			name: "invalid label",
+			opts: []Option{ExtraLabels([]string{"not-a-label"}, func(context.Context, string) []string { return []string{""} })},
+			want: "not-a-label",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServerMetricsWithError(tt.opts...); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("unexpected error: %v; want: %q", err, tt.want)
+			}
+		})
+	}
+
+	r := prometheus.NewRegistry()
+	_, err = NewServerMetricsWithError(WithRegisterer(r))
+	check(t, err)
+	if _, err := NewServerMetricsWithError(WithRegisterer(r)); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("registering another instance: unexpected error: %v", err)
+	}
+}